@@ -0,0 +1,93 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// putAtomic uploads value to a temporary key and copies it onto objectKey
+// on the server, so readers only ever see whole objects, even on providers
+// that serve objects still being written. The temporary object is deleted
+// afterwards.
+func (s3 S3) putAtomic(ctx context.Context, objectKey string, value []byte, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	client := s3.client()
+
+	upload, err := s3.uploadKey()
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+
+	defer s3.removeUpload(client, upload)
+
+	// the temporary object is short lived: infrequent access classes would
+	// charge for it as if it wasn't, and a retention would keep it
+	uploadOpts := opts
+	uploadOpts.StorageClass = ""
+	uploadOpts.Mode = ""
+	uploadOpts.RetainUntilDate = time.Time{}
+
+	_, err = client.PutObject(ctx, s3.Bucket, upload, bytes.NewReader(value), int64(len(value)), uploadOpts)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+
+	src := minio.CopySrcOptions{
+		Bucket:     s3.Bucket,
+		Object:     upload,
+		Encryption: opts.ServerSideEncryption,
+	}
+
+	return client.CopyObject(ctx, copyDestOptions(s3.Bucket, objectKey, opts), src)
+}
+
+// copyDestOptions are the options of a server side copy onto objectKey
+// that writes it the way PutObject with opts does.
+func copyDestOptions(bucket, objectKey string, opts minio.PutObjectOptions) minio.CopyDestOptions {
+	metadata := make(map[string]string, len(opts.UserMetadata)+1)
+	for name, value := range opts.UserMetadata {
+		if value != "" {
+			metadata[name] = value
+		}
+	}
+	if opts.StorageClass != "" {
+		metadata["X-Amz-Storage-Class"] = opts.StorageClass
+	}
+
+	return minio.CopyDestOptions{
+		Bucket:          bucket,
+		Object:          objectKey,
+		Encryption:      opts.ServerSideEncryption,
+		UserMetadata:    metadata,
+		ReplaceMetadata: true,
+		UserTags:        opts.UserTags,
+		ReplaceTags:     len(opts.UserTags) > 0,
+		Mode:            opts.Mode,
+		RetainUntilDate: opts.RetainUntilDate,
+	}
+}
+
+// uploadKey returns a new temporary object key to upload to.
+func (s3 S3) uploadKey() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return s3.KeyPrefix(uploadPrefix + hex.EncodeToString(buf)), nil
+}
+
+// removeUpload deletes a temporary object, even once the write timed out.
+func (s3 S3) removeUpload(client *minio.Client, upload string) {
+	ctx, cancel := s3.withTimeout(context.Background(), timeoutWrite)
+	defer cancel()
+
+	err := client.RemoveObject(ctx, s3.Bucket, upload, minio.RemoveObjectOptions{})
+	if err != nil && !isNotFound(err) {
+		s3.log(logOperations).Error("deleting temporary object", append(s3.errorFields(err), s3.keyField(upload), zap.Error(err))...)
+	}
+}
@@ -0,0 +1,138 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// auditPrefix is where audit records go below the storage prefix, unless
+// the audit sets its own prefix.
+const auditPrefix = ".audit/"
+
+// auditTimeout bounds writing a record, which happens after the operation,
+// whether its context is done or not.
+const auditTimeout = 10 * time.Second
+
+// Audit records every Store, Delete, Lock and Unlock of this instance, for
+// an immutable trail of who changed certificate material. Each record is
+// written as an object of its own below Prefix, a prefix in the bucket
+// that is never overwritten, so a policy allowing only s3:PutObject, or
+// Object Lock, can keep it append-only. Records are posted to Webhook, with
+// Headers, instead if it is set and Prefix isn't, or to both if both are.
+type Audit struct {
+	Prefix  string            `json:"prefix"`
+	Webhook string            `json:"webhook"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// auditRecord is a single mutation of the storage.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Instance  string    `json:"instance"`
+	Operation string    `json:"operation"`
+	Key       string    `json:"key"`
+	Size      int       `json:"size"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type auditSink struct {
+	prefix  string
+	webhook string
+	headers map[string]string
+	client  *http.Client
+
+	// seq tells apart the records of an instance written at once
+	seq uint64
+}
+
+func (s3 *S3) provisionAudit() error {
+	if err := s3.loadInstanceID(); err != nil {
+		return fmt.Errorf("audit: %v", err)
+	}
+
+	sink := &auditSink{
+		webhook: s3.Audit.Webhook,
+		headers: s3.Audit.Headers,
+		client:  &http.Client{Timeout: auditTimeout},
+	}
+	switch {
+	case s3.Audit.Prefix != "":
+		sink.prefix = cleanPrefix(s3.Audit.Prefix)
+	case s3.Audit.Webhook == "":
+		sink.prefix = path.Join(cleanPrefix(s3.Prefix), auditPrefix)
+	}
+	s3.auditSink = sink
+
+	return nil
+}
+
+// audit records the operation on key, which failed with err if not nil.
+// Failing to record it is logged, but doesn't fail the operation, which
+// happened already.
+func (s3 S3) audit(operation, key string, size int, err error) {
+	if s3.auditSink == nil {
+		return
+	}
+
+	record := auditRecord{
+		Time:      time.Now().UTC(),
+		Instance:  s3.instanceID,
+		Operation: operation,
+		Key:       key,
+		Size:      size,
+		Result:    "ok",
+	}
+	if err != nil {
+		record.Result = "error"
+		record.Error = err.Error()
+	}
+
+	contents, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+
+	if s3.auditSink.prefix != "" {
+		if err := s3.storeAuditRecord(ctx, record, contents); err != nil {
+			s3.logger.Error("writing audit record", zap.String("operation", operation), s3.keyField(key), zap.Error(err))
+		}
+	}
+	if s3.auditSink.webhook != "" {
+		if err := s3.auditSink.post(ctx, contents); err != nil {
+			s3.logger.Error("posting audit record", zap.String("operation", operation), s3.keyField(key), zap.Error(err))
+		}
+	}
+}
+
+// storeAuditRecord writes record to an object of its own, named after its
+// time, so the records of a day list in order.
+func (s3 S3) storeAuditRecord(ctx context.Context, record auditRecord, contents []byte) error {
+	seq := atomic.AddUint64(&s3.auditSink.seq, 1)
+	objectKey := path.Join(s3.auditSink.prefix, record.Time.Format("2006/01/02"),
+		fmt.Sprintf("%s-%s-%d.json", record.Time.Format("20060102T150405.000000000Z"), record.Instance, seq))
+
+	opts := s3.putObjectOptions()
+	opts.ContentType = "application/json"
+	opts.Mode, opts.RetainUntilDate = s3.retention()
+
+	return s3.do(ctx, "store", func() error {
+		_, err := s3.client().PutObject(ctx, s3.Bucket, objectKey, bytes.NewReader(contents), int64(len(contents)), opts)
+		return err
+	})
+}
+
+func (a *auditSink) post(ctx context.Context, contents []byte) error {
+	return postJSON(ctx, a.client, a.webhook, a.headers, contents)
+}
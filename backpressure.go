@@ -0,0 +1,55 @@
+package certmagic_s3
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrBackPressure is matched by the errors returned instead of queueing a
+// low priority write while the module is saturated. Such writes are safe to
+// retry later, certmagic simply keeps the OCSP staple in memory until its
+// next maintenance run.
+var ErrBackPressure = errors.New("s3 storage is saturated")
+
+type backPressureError struct {
+	reason string
+}
+
+func (e backPressureError) Error() string {
+	return "deferring low priority write, " + ErrBackPressure.Error() + ": " + e.reason
+}
+
+func (e backPressureError) Is(target error) bool {
+	return target == ErrBackPressure
+}
+
+// Temporary marks the error as retryable.
+func (e backPressureError) Temporary() bool {
+	return true
+}
+
+// pressureSource is implemented by the parts of the module that throttle
+// or shed requests, so low priority work can be refused before it queues.
+type pressureSource interface {
+	saturated() (bool, string)
+}
+
+// isLowPriorityKey reports whether writes to key may be deferred, which is
+// the case for OCSP staples that certmagic refreshes periodically anyway.
+func isLowPriorityKey(key string) bool {
+	return strings.HasPrefix(key, "ocsp/")
+}
+
+func (s3 S3) checkBackPressure(key string) error {
+	if !isLowPriorityKey(key) {
+		return nil
+	}
+
+	for _, source := range s3.pressure {
+		if saturated, reason := source.saturated(); saturated {
+			return backPressureError{reason: reason}
+		}
+	}
+
+	return nil
+}
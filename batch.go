@@ -0,0 +1,142 @@
+package certmagic_s3
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// removePrefix deletes every object below prefix with multi-object
+// DeleteObjects requests, up to 1000 objects each, as the listing streams
+// in, or one by one if the endpoint has no bulk delete. If match isn't nil,
+// only objects it reports true for are deleted. It calls deleted for every
+// object deleted, and returns the first error of the listing or of an
+// object.
+func removePrefix(ctx context.Context, client *minio.Client, bucket, prefix string, caps Capabilities, match func(objectKey string) bool, deleted func(objectKey string)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var listErr error
+	objects := make(chan minio.ObjectInfo)
+
+	go func() {
+		defer close(objects)
+
+		for object := range client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true, UseV1: !caps.ListV2}) {
+			if object.Err != nil {
+				listErr = object.Err
+				return
+			}
+			if match != nil && !match(object.Key) {
+				continue
+			}
+
+			select {
+			case objects <- object:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var err error
+
+	var results <-chan minio.RemoveObjectResult
+	if caps.BulkDelete {
+		results = client.RemoveObjectsWithResult(ctx, bucket, objects, minio.RemoveObjectsOptions{})
+	} else {
+		results = removeEach(ctx, client, bucket, objects)
+	}
+
+	for result := range results {
+		if result.Err != nil {
+			if err == nil {
+				err = fmt.Errorf("deleting %s: %w", result.ObjectName, result.Err)
+			}
+			continue
+		}
+		if deleted != nil {
+			deleted(result.ObjectName)
+		}
+	}
+
+	// the listing is done once objects is closed, which ends the results
+	if listErr != nil {
+		return listErr
+	}
+	return err
+}
+
+// removeEach deletes objects one request each, for endpoints without
+// multi-object deletes, with the results RemoveObjectsWithResult gives.
+func removeEach(ctx context.Context, client *minio.Client, bucket string, objects <-chan minio.ObjectInfo) <-chan minio.RemoveObjectResult {
+	results := make(chan minio.RemoveObjectResult)
+
+	go func() {
+		defer close(results)
+
+		for object := range objects {
+			err := client.RemoveObject(ctx, bucket, object.Key, minio.RemoveObjectOptions{})
+			select {
+			case results <- minio.RemoveObjectResult{ObjectName: object.Key, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return results
+}
+
+// deleteDirectory deletes the keys below key, like deleting a directory in
+// file system storage does, or moves them to the trash as deleted at t with
+// soft_delete.
+func (s3 S3) deleteDirectory(ctx context.Context, key string, t time.Time) error {
+	// never everything
+	if path.Clean("/"+key) == "/" {
+		return nil
+	}
+	prefix := s3.listPrefix(key)
+
+	var match func(objectKey string) bool
+	if s3.scans(key) {
+		match = func(objectKey string) bool {
+			return strings.HasPrefix(s3.relKey(strings.TrimPrefix(objectKey, prefix)), key+"/")
+		}
+	}
+
+	var count int
+
+	// along with the directory in every tenant
+	var err error
+	for _, prefix := range append([]string{prefix}, s3.tenantListPrefixes(key)...) {
+		prefix := prefix
+		err = s3.do(ctx, "delete_batch", func() error {
+			if s3.softDeletes(key) {
+				return s3.trashObjects(ctx, prefix, match, t, func(objectKey string) {
+					count++
+				})
+			}
+			return removePrefix(ctx, s3.client(), s3.Bucket, prefix, s3.Capabilities(), match, func(objectKey string) {
+				count++
+			})
+		})
+		if err != nil {
+			break
+		}
+	}
+
+	s3.cache.invalidatePrefix(key + "/")
+	s3.spool.removeAll(key)
+
+	if count > 0 {
+		s3.log(logOperations).Debug("delete directory", s3.keyField(key), zap.Int("keys", count))
+	}
+
+	return err
+}
@@ -0,0 +1,148 @@
+package certmagic_s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultBreakerFailures      = 5
+	defaultBreakerProbeInterval = 30 * time.Second
+)
+
+// CircuitBreaker makes requests fail fast while the endpoint is down. It
+// opens after Failures consecutive requests failed with an error retrying
+// may fix, like a timeout or a 5xx response. Every ProbeInterval, a single
+// request is let through to probe the endpoint, and closes it again if it
+// succeeds.
+type CircuitBreaker struct {
+	Failures      int            `json:"failures,omitempty"`
+	ProbeInterval caddy.Duration `json:"probe_interval,omitempty"`
+}
+
+// CircuitOpenError is returned for requests not sent while the circuit
+// breaker is open.
+type CircuitOpenError struct {
+	Since time.Time
+	Err   error
+}
+
+func (e CircuitOpenError) Error() string {
+	return fmt.Sprintf("S3 endpoint is unavailable since %s, failing fast: %v", e.Since.Format(time.RFC3339), e.Err)
+}
+
+func (e CircuitOpenError) Unwrap() error {
+	return e.Err
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type circuitBreaker struct {
+	failures      int
+	probeInterval time.Duration
+	logger        *zap.Logger
+	meter         metricsBackend
+	endpoint      func() string
+
+	mu          sync.Mutex
+	state       circuitState
+	consecutive int
+	opened      time.Time
+	since       time.Time
+	lastErr     error
+}
+
+func newCircuitBreaker(config *CircuitBreaker, logger *zap.Logger, meter metricsBackend, endpoint func() string) *circuitBreaker {
+	b := &circuitBreaker{
+		endpoint:      endpoint,
+		failures:      config.Failures,
+		probeInterval: time.Duration(config.ProbeInterval),
+		logger:        logger,
+		meter:         meter,
+	}
+	if b.failures <= 0 {
+		b.failures = defaultBreakerFailures
+	}
+	if b.probeInterval <= 0 {
+		b.probeInterval = defaultBreakerProbeInterval
+	}
+	return b
+}
+
+// allow returns a CircuitOpenError if the request must not be sent.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.opened) < b.probeInterval {
+			return CircuitOpenError{Since: b.since, Err: b.lastErr}
+		}
+		// this request is the probe
+		b.setState(circuitHalfOpen)
+		b.logger.Info("probing endpoint")
+	case circuitHalfOpen:
+		return CircuitOpenError{Since: b.since, Err: b.lastErr}
+	}
+
+	return nil
+}
+
+// record counts the result of a request that was allowed.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// says nothing about the endpoint, but a probe must be retried
+		if b.state == circuitHalfOpen {
+			b.setState(circuitOpen)
+		}
+		return
+	}
+
+	if !isRetryable(err) {
+		if b.state != circuitClosed {
+			b.logger.Info("endpoint is available again, closing circuit breaker", zap.Time("opened", b.since))
+		}
+		b.consecutive = 0
+		b.setState(circuitClosed)
+		return
+	}
+
+	b.consecutive++
+	b.lastErr = err
+
+	switch {
+	case b.state == circuitHalfOpen:
+		b.opened = time.Now()
+		b.setState(circuitOpen)
+		b.logger.Warn("probing endpoint failed", zap.Duration("retry_in", b.probeInterval), zap.Error(err))
+	case b.state == circuitClosed && b.consecutive >= b.failures:
+		b.opened = time.Now()
+		b.since = b.opened
+		b.setState(circuitOpen)
+		b.logger.Error("opening circuit breaker, failing fast", append(errorFields(b.endpoint(), err), zap.Int("failures", b.consecutive), zap.Duration("retry_in", b.probeInterval), zap.Error(err))...)
+	}
+}
+
+// setState changes the state and reports it as metric. b.mu must be held.
+func (b *circuitBreaker) setState(state circuitState) {
+	b.state = state
+	if b.meter != nil {
+		b.meter.setCircuitState(state)
+	}
+}
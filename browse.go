@@ -0,0 +1,123 @@
+package certmagic_s3
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const browsePath = "/s3-storage/keys"
+
+// browsableClasses are the key classes whose values the admin API serves.
+// Private keys, and accounts, trash and archives, which hold them too, are
+// never served.
+var browsableClasses = map[string]bool{
+	ClassCertificate: true,
+	ClassMetadata:    true,
+	ClassOCSP:        true,
+	ClassLock:        true,
+}
+
+// BrowsedKey is a key as the admin API serves it. Terminal, Modified and
+// Size are only set for a single key, not in listings.
+type BrowsedKey struct {
+	Key      string    `json:"key"`
+	Class    string    `json:"class"`
+	Terminal bool      `json:"terminal,omitempty"`
+	Modified time.Time `json:"modified,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+}
+
+// handleBrowse serves the keys of the storage for debugging: the keys below
+// the prefix query parameter at /s3-storage/keys (recursive with
+// recursive=true), what Stat tells about a key at /s3-storage/keys/<key>,
+// and its value with value=true if its class is browsable.
+func (a *ReconcileAPI) handleBrowse(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	s3, ok := a.ctx.Storage().(S3)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("storage is not s3"),
+		}
+	}
+
+	query := r.URL.Query()
+	key := strings.Trim(strings.TrimPrefix(r.URL.Path, browsePath), "/")
+
+	if key == "" {
+		keys, err := s3.List(r.Context(), query.Get("prefix"), query.Get("recursive") == "true")
+		if err != nil {
+			return browseError(err)
+		}
+
+		listed := make([]BrowsedKey, 0, len(keys))
+		for _, k := range keys {
+			listed = append(listed, BrowsedKey{Key: k, Class: keyClass(k)})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(listed)
+	}
+
+	if query.Get("value") == "true" {
+		class := keyClass(key)
+		if !browsableClasses[class] {
+			return caddy.APIError{
+				HTTPStatus: http.StatusForbidden,
+				Err:        fmt.Errorf("values of %s keys are not served", class),
+			}
+		}
+
+		value, err := s3.Load(r.Context(), key)
+		if err != nil {
+			return browseError(err)
+		}
+
+		switch path.Ext(key) {
+		case ".crt":
+			w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		case ".json":
+			w.Header().Set("Content-Type", "application/json")
+		default:
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		_, err = w.Write(value)
+		return err
+	}
+
+	info, err := s3.Stat(r.Context(), key)
+	if err != nil {
+		return browseError(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(BrowsedKey{
+		Key:      info.Key,
+		Class:    keyClass(info.Key),
+		Terminal: info.IsTerminal,
+		Modified: info.Modified,
+		Size:     info.Size,
+	})
+}
+
+func browseError(err error) error {
+	status := http.StatusInternalServerError
+	if errors.Is(err, fs.ErrNotExist) {
+		status = http.StatusNotFound
+	}
+	return caddy.APIError{HTTPStatus: status, Err: err}
+}
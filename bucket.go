@@ -0,0 +1,88 @@
+package certmagic_s3
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+const bucketPollInterval = time.Second
+
+// CreateBucket creates the bucket at provisioning if it doesn't exist, in
+// Region, by default the region of the storage, and with versioning if
+// Versioning is set. With object_lock, the bucket has Object Lock enabled.
+type CreateBucket struct {
+	Region     string `json:"region"`
+	Versioning bool   `json:"versioning"`
+}
+
+// createBucket creates the bucket unless it exists.
+func (s3 S3) createBucket(ctx context.Context) error {
+	exists, err := s3.client().BucketExists(ctx, s3.Bucket)
+	if err != nil {
+		return fmt.Errorf("checking bucket %s: %w", s3.Bucket, s3.explainError(err))
+	}
+	if exists {
+		return nil
+	}
+
+	region := s3.CreateBucket.Region
+	if region == "" {
+		region = s3.Region
+	}
+
+	err = s3.client().MakeBucket(ctx, s3.Bucket, minio.MakeBucketOptions{Region: region, ObjectLocking: s3.ObjectLock != nil})
+	if minio.ToErrorResponse(err).Code == "BucketAlreadyOwnedByYou" {
+		// another instance created it meanwhile
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("creating bucket %s: %w", s3.Bucket, s3.explainError(err))
+	}
+
+	s3.logger.Info("created bucket", zap.String("bucket", s3.Bucket))
+
+	if s3.CreateBucket.Versioning {
+		if err := s3.client().EnableVersioning(ctx, s3.Bucket); err != nil {
+			return fmt.Errorf("enabling versioning of bucket %s: %w", s3.Bucket, s3.explainError(err))
+		}
+	}
+
+	return nil
+}
+
+// waitForBucket polls until the bucket can be used, for up to timeout.
+// Some providers keep answering NoSuchBucket for a few seconds after a
+// bucket was created.
+func (s3 S3) waitForBucket(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		exists, err := s3.client().BucketExists(ctx, s3.Bucket)
+		if err == nil && exists {
+			if attempt > 1 {
+				s3.logger.Info("bucket is usable", zap.String("bucket", s3.Bucket), zap.Duration("waited", time.Since(start)))
+			}
+			return nil
+		}
+
+		if err != nil && minio.ToErrorResponse(err).Code != "NoSuchBucket" && ctx.Err() == nil {
+			return s3.explainError(err)
+		}
+		if attempt == 1 {
+			s3.logger.Info("bucket is not usable yet, waiting", zap.String("bucket", s3.Bucket), zap.Duration("timeout", timeout))
+		}
+
+		select {
+		case <-time.After(bucketPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("bucket %s is still not usable after %s", s3.Bucket, timeout)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+const (
+	budgetPrefix = "ratelimit"
+
+	// Members publish their request rate this often, and drop out of the
+	// ledger after three missed updates.
+	budgetInterval = 10 * time.Second
+)
+
+// budgetEntry is the ledger object of one member of the cluster.
+type budgetEntry struct {
+	Rate    float64   `json:"rate"`
+	Updated time.Time `json:"updated"`
+}
+
+// clusterBudget keeps the request rate of all instances sharing the bucket
+// under a cap. Every instance publishes the rate it used in a ledger object
+// of its own and takes what the others leave, but at least an equal share,
+// so the cap holds coarsely, over budgetInterval.
+type clusterBudget struct {
+	limit  float64
+	member string
+	bucket *tokenBucket
+
+	mu   sync.Mutex
+	used int
+}
+
+func newClusterBudget(limit float64) (*clusterBudget, error) {
+	member, err := newLockOwner()
+	if err != nil {
+		return nil, err
+	}
+
+	return &clusterBudget{
+		limit:  limit,
+		member: member,
+		bucket: newTokenBucket(limit, 0),
+	}, nil
+}
+
+func (b *clusterBudget) wait(ctx context.Context, operation string, p priority) (func(), error) {
+	if err := b.bucket.take(ctx, p); err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.used++
+	b.mu.Unlock()
+
+	return func() {}, nil
+}
+
+func (b *clusterBudget) saturated() (bool, string) {
+	if b.bucket.empty() {
+		return true, fmt.Sprintf("cluster request budget of %.1f/s exhausted", b.limit)
+	}
+	return false, ""
+}
+
+// setRate sets the rate of this instance from the rates the others used.
+func (b *clusterBudget) setRate(others []float64) {
+	var used float64
+	for _, rate := range others {
+		used += rate
+	}
+
+	rate := b.limit - used
+	if share := b.limit / float64(len(others)+1); rate < share {
+		rate = share
+	}
+
+	b.bucket.setRate(rate)
+}
+
+// takeUsed returns the number of requests made since the last call.
+func (b *clusterBudget) takeUsed() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	used := b.used
+	b.used = 0
+	return used
+}
+
+// syncBudget publishes the rate of this instance and adjusts it to the
+// rates of the others every budgetInterval, until ctx is done.
+func (s3 S3) syncBudget(ctx context.Context, b *clusterBudget) {
+	ticker := time.NewTicker(budgetInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s3.syncBudgetOnce(ctx, b); err != nil {
+			s3.logger.Error("syncing cluster request budget", append(s3.errorFields(err), zap.Error(err))...)
+		}
+	}
+}
+
+func (s3 S3) syncBudgetOnce(ctx context.Context, b *clusterBudget) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	entry, err := json.Marshal(budgetEntry{
+		Rate:    float64(b.takeUsed()) / budgetInterval.Seconds(),
+		Updated: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	prefix := s3.KeyPrefix(budgetPrefix) + "/"
+
+	_, err = s3.client().PutObject(ctx, s3.Bucket, prefix+b.member+".json", bytes.NewReader(entry), int64(len(entry)), s3.putObjectOptions())
+	if err != nil {
+		return err
+	}
+
+	var others []float64
+
+	for object := range s3.listBucket(ctx, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		if strings.TrimSuffix(path.Base(object.Key), ".json") == b.member {
+			continue
+		}
+
+		entry, err := s3.loadBudgetEntry(ctx, object.Key)
+		if err != nil {
+			return err
+		}
+
+		if time.Since(entry.Updated) > 3*budgetInterval {
+			// the member is gone, clean up after it
+			s3.client().RemoveObject(ctx, s3.Bucket, object.Key, minio.RemoveObjectOptions{})
+			continue
+		}
+
+		others = append(others, entry.Rate)
+	}
+
+	b.setRate(others)
+
+	return nil
+}
+
+func (s3 S3) loadBudgetEntry(ctx context.Context, objectKey string) (budgetEntry, error) {
+	var entry budgetEntry
+
+	object, err := s3.client().GetObject(ctx, s3.Bucket, objectKey, s3.getObjectOptions())
+	if err != nil {
+		return entry, err
+	}
+	defer object.Close()
+
+	contents, err := ioutil.ReadAll(object)
+	if err != nil {
+		return entry, err
+	}
+
+	err = json.Unmarshal(contents, &entry)
+
+	return entry, err
+}
@@ -0,0 +1,174 @@
+package certmagic_s3
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+const (
+	defaultCacheTTL        = time.Minute
+	defaultCacheMaxEntries = 10000
+)
+
+// Cache configures the in-memory cache Load, Exists and Stat are served
+// from. Entries expire after TTL, and the least recently used are evicted
+// beyond MaxEntries. Store and Delete invalidate the keys they write, but
+// writes of other instances are only seen once the entries expired, unless
+// bucket notifications invalidate them: with ListenNotifications from MinIO,
+// or on AWS through SNS and the s3_storage_notifications handler.
+type Cache struct {
+	TTL                 caddy.Duration `json:"ttl,omitempty"`
+	MaxEntries          int            `json:"max_entries,omitempty"`
+	ListenNotifications bool           `json:"listen_notifications"`
+}
+
+// cacheEntry is what is known about a key. value and info are nil until
+// the key was loaded or stat'ed.
+type cacheEntry struct {
+	key     string
+	exists  bool
+	value   []byte
+	info    *certmagic.KeyInfo
+	expires time.Time
+}
+
+type readCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	recent  *list.List
+}
+
+func newReadCache(config *Cache) *readCache {
+	c := &readCache{
+		ttl:        time.Duration(config.TTL),
+		maxEntries: config.MaxEntries,
+		entries:    make(map[string]*list.Element),
+		recent:     list.New(),
+	}
+	if c.ttl <= 0 {
+		c.ttl = defaultCacheTTL
+	}
+	if c.maxEntries <= 0 {
+		c.maxEntries = defaultCacheMaxEntries
+	}
+	return c
+}
+
+// get returns the unexpired entry of key. A nil cache has none.
+func (c *readCache) get(key string) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.recent.Remove(element)
+		delete(c.entries, key)
+		return cacheEntry{}, false
+	}
+
+	c.recent.MoveToFront(element)
+
+	return *entry, true
+}
+
+// update changes the entry of key with fn, creating it if needed.
+func (c *readCache) update(key string, fn func(entry *cacheEntry)) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if ok && time.Now().After(element.Value.(*cacheEntry).expires) {
+		c.recent.Remove(element)
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		element = c.recent.PushFront(&cacheEntry{key: key, expires: time.Now().Add(c.ttl)})
+		c.entries[key] = element
+	}
+
+	fn(element.Value.(*cacheEntry))
+	c.recent.MoveToFront(element)
+
+	for c.recent.Len() > c.maxEntries {
+		oldest := c.recent.Back()
+		c.recent.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *readCache) invalidate(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.recent.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// invalidatePrefix drops the entries of the keys starting with prefix.
+func (c *readCache) invalidatePrefix(prefix string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.recent.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *readCache) putValue(key string, value []byte) {
+	c.update(key, func(entry *cacheEntry) {
+		entry.exists = true
+		entry.value = append([]byte(nil), value...)
+	})
+}
+
+func (c *readCache) putExists(key string, exists bool) {
+	c.update(key, func(entry *cacheEntry) {
+		if entry.exists != exists {
+			entry.value = nil
+			entry.info = nil
+		}
+		entry.exists = exists
+	})
+}
+
+func (c *readCache) putInfo(key string, info certmagic.KeyInfo) {
+	c.update(key, func(entry *cacheEntry) {
+		entry.exists = true
+		entry.info = &info
+	})
+}
@@ -0,0 +1,393 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// Lock strategies. Conditional locks are written with If-None-Match and
+// If-Match, and read back for endpoints that ignore the condition.
+// Candidate locks need no conditional writes: every instance trying to take
+// a lock writes a candidate object of its own, and the earliest candidate
+// gets the lock. Auto picks one by probing the endpoint.
+const (
+	lockConditional = "conditional"
+	lockCandidates  = "candidates"
+	lockAuto        = "auto"
+)
+
+// List APIs. Auto falls back to v1 if the endpoint doesn't take v2.
+const (
+	listV1   = "v1"
+	listV2   = "v2"
+	listAuto = "auto"
+)
+
+// lockCandidateSeparator separates the owner from the lock object key in
+// the keys of candidates. Lock names never contain it.
+const lockCandidateSeparator = "@"
+
+// Probed capabilities are reused for capabilityCacheTTL by storages on the
+// same endpoint, bucket and prefix, so reloading the config doesn't probe
+// again.
+const capabilityCacheTTL = time.Hour
+
+func validLockStrategy(strategy string) bool {
+	switch strategy {
+	case "", lockConditional, lockCandidates, lockAuto:
+		return true
+	}
+	return false
+}
+
+func validListAPI(api string) bool {
+	switch api {
+	case "", listV1, listV2, listAuto:
+		return true
+	}
+	return false
+}
+
+// Capabilities are what the endpoint supports of what the module relies
+// on, as probed when connecting: conditional PUTs, object tags, bucket
+// versioning, ETags that are the MD5 of objects uploaded in a single part,
+// SHA-256 sums kept in user metadata, multi-object DeleteObjects and
+// ListObjectsV2. Until probed, or if probing isn't possible, everything but
+// versioning is assumed to be supported.
+type Capabilities struct {
+	ConditionalWrites bool      `json:"conditional_writes"`
+	ObjectTagging     bool      `json:"object_tagging"`
+	Versioning        bool      `json:"versioning"`
+	MD5ETags          bool      `json:"md5_etags"`
+	SHA256Metadata    bool      `json:"sha256_metadata"`
+	BulkDelete        bool      `json:"bulk_delete"`
+	ListV2            bool      `json:"list_v2"`
+	Probed            time.Time `json:"probed,omitempty"`
+}
+
+var defaultCapabilities = Capabilities{
+	ConditionalWrites: true,
+	ObjectTagging:     true,
+	MD5ETags:          true,
+	SHA256Metadata:    true,
+	BulkDelete:        true,
+	ListV2:            true,
+}
+
+// capabilities holds the probed capabilities of a storage.
+type capabilities struct {
+	mu     sync.Mutex
+	probed Capabilities
+}
+
+func newCapabilities() *capabilities {
+	return &capabilities{probed: defaultCapabilities}
+}
+
+func (c *capabilities) get() Capabilities {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.probed
+}
+
+func (c *capabilities) set(probed Capabilities) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probed = probed
+}
+
+var capabilityCache = struct {
+	sync.Mutex
+	entries map[string]Capabilities
+}{entries: make(map[string]Capabilities)}
+
+// Capabilities returns what the endpoint supports, as probed, overridden by
+// lock_strategy and list_api unless those are auto.
+func (s3 S3) Capabilities() Capabilities {
+	caps := defaultCapabilities
+	if s3.caps != nil {
+		caps = s3.caps.get()
+	}
+
+	switch s3.LockStrategy {
+	case "", lockConditional:
+		caps.ConditionalWrites = true
+	case lockCandidates:
+		caps.ConditionalWrites = false
+	}
+	switch s3.ListAPI {
+	case "", listV2:
+		caps.ListV2 = true
+	case listV1:
+		caps.ListV2 = false
+	}
+
+	return caps
+}
+
+// conditionalWrites reports whether locks and conditional stores may rely
+// on If-None-Match and If-Match.
+func (s3 S3) conditionalWrites() bool {
+	return s3.Capabilities().ConditionalWrites
+}
+
+// listBucket lists objects like the client does, with the list API the
+// endpoint supports.
+func (s3 S3) listBucket(ctx context.Context, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	opts.UseV1 = !s3.Capabilities().ListV2
+	return s3.client().ListObjects(ctx, s3.Bucket, opts)
+}
+
+// probeCapabilities probes the endpoint, or takes what was probed recently,
+// and logs what it lacks of what is configured. Probes that fail for other
+// reasons than the endpoint not supporting the request, like a missing
+// permission, leave the capability assumed, and the self-test reports the
+// reason.
+func (s3 S3) probeCapabilities(ctx context.Context) {
+	cacheKey := s3.endpoint() + "/" + s3.Bucket + "/" + s3.listPrefix("")
+
+	capabilityCache.Lock()
+	caps, ok := capabilityCache.entries[cacheKey]
+	capabilityCache.Unlock()
+
+	if !ok || time.Since(caps.Probed) > capabilityCacheTTL {
+		caps = s3.probe(ctx)
+
+		capabilityCache.Lock()
+		capabilityCache.entries[cacheKey] = caps
+		capabilityCache.Unlock()
+	}
+
+	s3.caps.set(caps)
+
+	endpoint := zap.String("endpoint", s3.endpoint())
+
+	s3.logger.Debug("capabilities of endpoint", endpoint,
+		zap.Bool("conditional_writes", caps.ConditionalWrites),
+		zap.Bool("object_tagging", caps.ObjectTagging),
+		zap.Bool("versioning", caps.Versioning),
+		zap.Bool("md5_etags", caps.MD5ETags),
+		zap.Bool("sha256_metadata", caps.SHA256Metadata),
+		zap.Bool("bulk_delete", caps.BulkDelete),
+		zap.Bool("list_v2", caps.ListV2))
+
+	if s3.ListAPI == listAuto && !caps.ListV2 {
+		s3.logger.Info("endpoint doesn't support ListObjectsV2, list with v1", endpoint)
+	}
+	if s3.LockStrategy == lockAuto && !caps.ConditionalWrites {
+		s3.logger.Info("endpoint doesn't support conditional writes, use candidate locks", endpoint)
+	}
+	if s3.Tagging != nil && !caps.ObjectTagging {
+		s3.logger.Warn("endpoint doesn't support object tags, store objects without tagging", endpoint)
+	}
+	if !caps.SHA256Metadata {
+		s3.logger.Warn("endpoint drops user metadata, objects are verified by their ETags only", endpoint)
+	}
+}
+
+// probe writes a probe object with tags and a checksum, reads them back,
+// creates it again only if it doesn't exist, and deletes it in bulk.
+func (s3 S3) probe(ctx context.Context) Capabilities {
+	caps := defaultCapabilities
+	caps.Probed = time.Now()
+
+	var err error
+	for object := range s3.client().ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{Prefix: s3.listPrefix(""), MaxKeys: 1}) {
+		err = object.Err
+		break
+	}
+	caps.ListV2 = !isNotSupported(err)
+
+	versioning, err := s3.client().GetBucketVersioning(ctx, s3.Bucket)
+	caps.Versioning = err == nil && versioning.Status != ""
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return caps
+	}
+	key := s3.KeyPrefix(preflightPrefix + hex.EncodeToString(buf))
+	value := []byte("certmagic-s3 capabilities")
+	sum := sha256Hex(value)
+
+	opts := s3.putObjectOptions()
+	opts.DisableMultipart = true
+	opts.UserMetadata = map[string]string{checksumMetadata: sum}
+	opts.UserTags = map[string]string{"probe": "true"}
+
+	_, err = s3.client().PutObject(ctx, s3.Bucket, key, bytes.NewReader(value), int64(len(value)), opts)
+	if isNotSupported(err) {
+		caps.ObjectTagging = false
+		opts.UserTags = nil
+		_, err = s3.client().PutObject(ctx, s3.Bucket, key, bytes.NewReader(value), int64(len(value)), opts)
+	}
+	if err != nil {
+		return caps
+	}
+	defer func() {
+		// the probe object has to go either way
+		if !caps.BulkDelete {
+			s3.client().RemoveObject(ctx, s3.Bucket, key, minio.RemoveObjectOptions{})
+		}
+	}()
+
+	if info, err := s3.client().StatObject(ctx, s3.Bucket, key, s3.getObjectOptions()); err == nil {
+		md5Sum := md5.Sum(value)
+		caps.MD5ETags = s3.sse != nil || strings.ToLower(strings.Trim(info.ETag, `"`)) == hex.EncodeToString(md5Sum[:])
+		caps.SHA256Metadata = info.UserMetadata[checksumMetadata] == sum
+	}
+
+	if caps.ObjectTagging {
+		objectTags, err := s3.client().GetObjectTagging(ctx, s3.Bucket, key, minio.GetObjectTaggingOptions{})
+		switch {
+		case err == nil:
+			// tags the endpoint ignored aren't there
+			caps.ObjectTagging = objectTags.ToMap()["probe"] == "true"
+		case isNotSupported(err):
+			caps.ObjectTagging = false
+		}
+	}
+
+	_, err = s3.client().PutObject(withCondition(ctx, ifMatch("")), s3.Bucket, key, bytes.NewReader(value), int64(len(value)), opts)
+	switch {
+	case errorKind(err) == ErrPreconditionFailed:
+	case err == nil, isNotSupported(err):
+		caps.ConditionalWrites = false
+	}
+
+	objects := make(chan minio.ObjectInfo, 1)
+	objects <- minio.ObjectInfo{Key: key}
+	close(objects)
+	for result := range s3.client().RemoveObjectsWithResult(ctx, s3.Bucket, objects, minio.RemoveObjectsOptions{}) {
+		caps.BulkDelete = !isNotSupported(result.Err)
+	}
+
+	return caps
+}
+
+// isNotSupported reports whether err is the endpoint rejecting a request it
+// doesn't implement, which older Ceph RGW and Swift builds answer with
+// NotImplemented or InvalidArgument.
+func isNotSupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "NotImplemented" || resp.Code == "InvalidArgument" || resp.StatusCode == 501
+}
+
+// tryAcquireCandidateLock takes the lock object without conditional
+// writes, for the stale one with etag or where there is none. It writes a
+// candidate of its own next to the lock object and, after a short delay,
+// lists the candidates: unless its own is the earliest of the fresh ones,
+// by the time the endpoint gives them, another instance gets the lock.
+// Otherwise it writes the lock object, if it isn't held by then, and reads
+// it back. It returns an empty owner if it lost. This relies on listings
+// showing objects right after they are written, like RGW does.
+func (s3 S3) tryAcquireCandidateLock(ctx context.Context, objectKey, etag string) (string, error) {
+	owner, err := newLockOwner()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	meta := lockMeta{Owner: owner, Created: now, Updated: now}
+
+	candidate := objectKey + lockCandidateSeparator + owner
+	if err := s3.storeLockMeta(ctx, candidate, meta, ""); err != nil {
+		return "", err
+	}
+	defer func() {
+		err := s3.do(context.Background(), "lock_delete", func() error {
+			return s3.client().RemoveObject(context.Background(), s3.Bucket, candidate, minio.RemoveObjectOptions{})
+		})
+		if err != nil {
+			s3.log(logLocks).Warn("removing lock candidate", s3.keyField(candidate), zap.Error(err))
+		}
+	}()
+
+	select {
+	case <-time.After(lockSettleDelay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	var candidates []minio.ObjectInfo
+	var own minio.ObjectInfo
+	for object := range s3.listBucket(ctx, minio.ListObjectsOptions{Prefix: objectKey + lockCandidateSeparator}) {
+		if object.Err != nil {
+			return "", object.Err
+		}
+		if object.Key == candidate {
+			own = object
+		}
+		candidates = append(candidates, object)
+	}
+	if own.Key == "" {
+		return "", fmt.Errorf("lock candidate %s is not listed", s3.logKey(candidate))
+	}
+
+	// candidates left behind by crashed instances are older than any
+	// fresh lock, by the clock of the endpoint
+	fresh := candidates[:0]
+	for _, object := range candidates {
+		if own.LastModified.Sub(object.LastModified) <= lockFreshnessInterval*2 {
+			fresh = append(fresh, object)
+		}
+	}
+	candidates = fresh
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].LastModified.Equal(candidates[j].LastModified) {
+			return candidates[i].LastModified.Before(candidates[j].LastModified)
+		}
+		return candidates[i].Key < candidates[j].Key
+	})
+	if candidates[0].Key != candidate {
+		return "", nil
+	}
+
+	// another instance may have taken the lock since it was looked at
+	current, err := s3.loadLockMeta(ctx, objectKey)
+	switch {
+	case err == nil && current.etag != etag && !current.stale():
+		return "", nil
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return "", err
+	}
+
+	if err := s3.storeLockMeta(ctx, objectKey, meta, ""); err != nil {
+		return "", err
+	}
+
+	select {
+	case <-time.After(lockSettleDelay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	current, err = s3.loadLockMeta(ctx, objectKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if current.Owner != owner {
+		return "", nil
+	}
+
+	return owner, nil
+}
@@ -0,0 +1,137 @@
+package certmagic_s3
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// currentClient holds the client for the endpoint in use, which changes
+// when discovery no longer returns it.
+type currentClient struct {
+	mu     sync.RWMutex
+	host   string
+	client *minio.Client
+}
+
+func (c *currentClient) get() (string, *minio.Client) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.host, c.client
+}
+
+func (c *currentClient) set(host string, client *minio.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.host = host
+	c.client = client
+}
+
+// client returns the minio client to use for the next request.
+func (s3 S3) client() *minio.Client {
+	if s3.current == nil {
+		return s3.Client
+	}
+	_, client := s3.current.get()
+	return client
+}
+
+// endpoint returns the host of the endpoint in use.
+func (s3 S3) endpoint() string {
+	if s3.current == nil {
+		return s3.Host
+	}
+	host, _ := s3.current.get()
+	return host
+}
+
+// core returns the low level API of the client, for multipart uploads.
+func (s3 S3) core() minio.Core {
+	return minio.Core{Client: s3.client()}
+}
+
+// The endpoints of S3 Transfer Acceleration, which route requests through
+// the nearest edge location.
+const (
+	accelerateEndpoint          = "s3-accelerate.amazonaws.com"
+	accelerateDualStackEndpoint = "s3-accelerate.dualstack.amazonaws.com"
+)
+
+func (s3 S3) newClient(host string) (*minio.Client, error) {
+	var transport http.RoundTripper = s3.httpTransport
+	if s3.TraceRequests {
+		transport = tracingTransport{next: transport, logger: s3.log(logRequests)}
+	}
+
+	opts := &minio.Options{
+		Creds:     s3.creds,
+		Secure:    !s3.Insecure,
+		Region:    s3.regionFor(host),
+		Transport: s3.throttle.roundTripper(transport),
+	}
+
+	client, err := minio.New(host, opts)
+	if err != nil {
+		return nil, err
+	}
+	if s3.Accelerate {
+		endpoint := accelerateEndpoint
+		if s3.DualStack {
+			endpoint = accelerateDualStackEndpoint
+		}
+		client.SetS3TransferAccelerate(endpoint)
+	}
+	return client, nil
+}
+
+// detectRegion looks up the region of the bucket, so the client signs for
+// it from the start. If that fails, minio looks it up on first use.
+func (s3 *S3) detectRegion(ctx context.Context) {
+	region, err := s3.client().GetBucketLocation(ctx, s3.Bucket)
+	if err != nil {
+		s3.logger.Warn("unable to detect the region of the bucket", zap.String("bucket", s3.Bucket), zap.Error(err))
+		return
+	}
+
+	s3.logger.Info("detected region of the bucket", zap.String("bucket", s3.Bucket), zap.String("region", region))
+
+	s3.Region = region
+
+	host, _ := s3.current.get()
+	client, err := s3.newClient(host)
+	if err != nil {
+		s3.logger.Warn("unable to detect the region of the bucket", zap.String("bucket", s3.Bucket), zap.Error(err))
+		return
+	}
+	s3.current.set(host, client)
+}
+
+// refreshClient rebuilds the client after its credentials were rejected as
+// expired, unless another request has replaced it already.
+func (s3 S3) refreshClient(failed *minio.Client) error {
+	if s3.current == nil {
+		return nil
+	}
+
+	s3.current.mu.Lock()
+	defer s3.current.mu.Unlock()
+
+	if s3.current.client != failed {
+		return nil
+	}
+
+	s3.log(logRequests).Info("credentials were rejected as expired, refreshing them")
+
+	s3.creds.Expire()
+
+	client, err := s3.newClient(s3.current.host)
+	if err != nil {
+		return err
+	}
+	s3.current.client = client
+
+	return nil
+}
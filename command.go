@@ -0,0 +1,188 @@
+package certmagic_s3
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+// subcommand is one of the commands of "caddy s3-storage".
+type subcommand struct {
+	usage string
+	short string
+	flags func(*flag.FlagSet)
+	run   func(caddycmd.Flags) (int, error)
+}
+
+var subcommands = map[string]subcommand{
+	"copy": {
+		usage: "--target <bucket> [--host <host>] [--target-prefix <prefix>] | --target-config <file> [--config <file>]",
+		short: "Copies the keys to another bucket, resuming an interrupted copy",
+		flags: copyFlags,
+		run:   cmdCopy,
+	},
+	"diff": {
+		usage: "--target <bucket> [--host <host>] [--apply] [--config <file>]",
+		short: "Lists the keys that are missing or different in another bucket",
+		flags: diffFlags,
+		run:   cmdDiff,
+	},
+	"encode-keys": {
+		usage: "[--from <encoding>] [--config <file>]",
+		short: "Renames the objects stored without or with another key_encoding to the configured one",
+		flags: encodeKeysFlags,
+		run:   cmdEncodeKeys,
+	},
+	"export": {
+		usage: "[--output <file>] [--domains <globs>] [--classes <classes>] [--config <file>]",
+		short: "Writes the keys under the prefix to a tar archive",
+		flags: exportFlags,
+		run:   cmdExport,
+	},
+	"import": {
+		usage: "[--input <file>] [--config <file>]",
+		short: "Stores the keys of a tar archive under the prefix",
+		flags: importFlags,
+		run:   cmdImport,
+	},
+	"migrate": {
+		usage: "[--from <data dir>] [--cleanup] [--config <file>]",
+		short: "Copies the certificates and accounts of a file_system storage to the bucket",
+		flags: migrateFlags,
+		run:   cmdMigrate,
+	},
+	"preflight": {
+		usage: "[--json] [--config <file>]",
+		short: "Checks which operations the credentials may do and prints the IAM policy needed",
+		flags: preflightFlags,
+		run:   cmdPreflight,
+	},
+	"promote": {
+		usage: "--target <bucket> [--host <host>] [--address <admin>]",
+		short: "Makes the mirror or standby bucket the primary of a running Caddy",
+		flags: promoteFlags,
+		run:   cmdPromote,
+	},
+	"restore": {
+		usage: "--key <key> [--version <id>] [--config <file>]",
+		short: "Lists the versions of a key in a versioned bucket, or restores one of them",
+		flags: restoreFlags,
+		run:   cmdRestore,
+	},
+}
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "s3-storage",
+		Func:  cmdS3Storage,
+		Usage: "<command> [flags]",
+		Short: "Manages the certificate storage in S3",
+		Long:  s3StorageHelp(),
+	})
+}
+
+func s3StorageHelp() string {
+	var names []string
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var help strings.Builder
+	help.WriteString("\nCommands:\n\n")
+	for _, name := range names {
+		fmt.Fprintf(&help, "  %s %s\n      %s\n", name, subcommands[name].usage, subcommands[name].short)
+	}
+	return help.String()
+}
+
+func cmdS3Storage(fl caddycmd.Flags) (int, error) {
+	args := fl.Args()
+	if len(args) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("missing command, usage: caddy s3-storage <command> [flags]%s", s3StorageHelp())
+	}
+
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("unknown command %s%s", args[0], s3StorageHelp())
+	}
+
+	fs := flag.NewFlagSet("s3-storage "+args[0], flag.ExitOnError)
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	return cmd.run(caddycmd.Flags{FlagSet: fs})
+}
+
+// adminFlags adds the flags needed to find the admin API of a running
+// Caddy, the same way "caddy reload" does.
+func adminFlags(fs *flag.FlagSet) {
+	fs.String("address", "", "Address of the administration listener, if different from config")
+	fs.String("config", "", "Configuration file to read the administration listener from")
+	fs.String("adapter", "", "Name of config adapter to apply")
+}
+
+// configFlags adds the flags needed to load the config of the storage.
+func configFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "Configuration file with the s3 storage")
+	fs.String("adapter", "", "Name of config adapter to apply")
+}
+
+// loadStorageConfig returns the s3 storage section of the config given with
+// --config and --adapter.
+func loadStorageConfig(fl caddycmd.Flags) (map[string]interface{}, error) {
+	return loadStorageConfigFile(fl.String("config"), fl.String("adapter"))
+}
+
+// loadStorageConfigFile returns the s3 storage section of the config file
+// adapted with adapter.
+func loadStorageConfigFile(configFile, adapter string) (map[string]interface{}, error) {
+	body, _, err := caddycmd.LoadConfig(configFile, adapter)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Storage map[string]interface{} `json:"storage"`
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return nil, err
+	}
+	if config.Storage == nil {
+		return nil, errors.New("config has no storage")
+	}
+	if config.Storage["module"] != "s3" {
+		return nil, fmt.Errorf("config uses %v storage, not s3", config.Storage["module"])
+	}
+
+	return config.Storage, nil
+}
+
+// provisionStorage sets up the s3 storage of a config section, for commands
+// that work on the bucket directly.
+func provisionStorage(ctx caddy.Context, storage map[string]interface{}) (*S3, error) {
+	body, err := json.Marshal(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	s3 := new(S3)
+	if err := json.Unmarshal(body, s3); err != nil {
+		return nil, err
+	}
+	if err := s3.Provision(ctx); err != nil {
+		return nil, err
+	}
+
+	return s3, nil
+}
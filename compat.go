@@ -0,0 +1,31 @@
+package certmagic_s3
+
+import (
+	"context"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+// Newer certmagic releases look for these optional storage interfaces with
+// a type assertion. They are declared here rather than taken from certmagic,
+// so the module builds against releases that predate them and is picked up
+// by the ones that have them, without build tags.
+type (
+	tryLocker interface {
+		TryLock(ctx context.Context, name string) (bool, error)
+	}
+
+	lockLeaseRenewer interface {
+		RenewLockLease(ctx context.Context, lockKey string, leaseDuration time.Duration) error
+	}
+)
+
+var (
+	_ certmagic.Storage  = S3{}
+	_ tryLocker          = S3{}
+	_ lockLeaseRenewer   = S3{}
+	_ caddy.Validator    = S3{}
+	_ caddy.CleanerUpper = S3{}
+)
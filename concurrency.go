@@ -0,0 +1,86 @@
+package certmagic_s3
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// concurrencyLimit bounds the requests in flight. Requests over the limit
+// queue, and every slot freed goes to the oldest request of the highest
+// priority waiting.
+type concurrencyLimit struct {
+	max int
+
+	mu     sync.Mutex
+	free   int
+	queues [priorityMaintenance + 1][]chan struct{}
+}
+
+func newConcurrencyLimit(max int) *concurrencyLimit {
+	return &concurrencyLimit{max: max, free: max}
+}
+
+func (c *concurrencyLimit) wait(ctx context.Context, operation string, p priority) (func(), error) {
+	c.mu.Lock()
+	if c.free > 0 {
+		c.free--
+		c.mu.Unlock()
+		return c.release, nil
+	}
+	ready := make(chan struct{})
+	c.queues[p] = append(c.queues[p], ready)
+	c.mu.Unlock()
+
+	select {
+	case <-ready:
+		return c.release, nil
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	queued := false
+	for i, waiting := range c.queues[p] {
+		if waiting == ready {
+			c.queues[p] = append(c.queues[p][:i], c.queues[p][i+1:]...)
+			queued = true
+			break
+		}
+	}
+	c.mu.Unlock()
+
+	if !queued {
+		// the slot was handed over meanwhile
+		c.release()
+	}
+
+	return nil, ctx.Err()
+}
+
+func (c *concurrencyLimit) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for p := range c.queues {
+		if len(c.queues[p]) > 0 {
+			close(c.queues[p][0])
+			c.queues[p] = c.queues[p][1:]
+			return
+		}
+	}
+	c.free++
+}
+
+func (c *concurrencyLimit) saturated() (bool, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var queued int
+	for p := range c.queues {
+		queued += len(c.queues[p])
+	}
+	if queued > 0 {
+		return true, fmt.Sprintf("%d requests in flight, %d queued", c.max, queued)
+	}
+	return false, ""
+}
@@ -0,0 +1,123 @@
+package certmagic_s3
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// minio can't send conditional PUTs, so the preconditions travel in the
+// context of the request and the transport adds them. They are headers S3
+// doesn't need signed.
+type conditionKey struct{}
+
+func withCondition(ctx context.Context, condition http.Header) context.Context {
+	return context.WithValue(ctx, conditionKey{}, condition)
+}
+
+// conditional adds the preconditions in the context of req to it, if it is
+// a PUT. Other requests sent on the way, like region lookups, go as they are.
+func conditional(req *http.Request) *http.Request {
+	condition, ok := req.Context().Value(conditionKey{}).(http.Header)
+	if !ok || req.Method != http.MethodPut {
+		return req
+	}
+
+	req = req.Clone(req.Context())
+	for name, values := range condition {
+		req.Header[name] = values
+	}
+	return req
+}
+
+// ifMatch is the precondition of writing over the object with etag, or of
+// creating it if etag is empty.
+func ifMatch(etag string) http.Header {
+	if etag == "" {
+		return http.Header{"If-None-Match": {"*"}}
+	}
+	return http.Header{"If-Match": {quoteETag(etag)}}
+}
+
+// quoteETag quotes etag the way S3 sends them, as minio strips the quotes.
+func quoteETag(etag string) string {
+	if strings.HasPrefix(etag, `"`) || strings.HasPrefix(etag, `W/"`) {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
+// LoadWithETag loads key like Load, and also returns the ETag of the object
+// to pass to StoreIfMatch. It always reads from S3, never from the read
+// cache or the spool.
+func (s3 S3) LoadWithETag(ctx context.Context, key string) (value []byte, etag string, err error) {
+	ctx, span := s3.startSpan(ctx, "load", key)
+	defer func() { endSpan(span, err) }()
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutRead)
+	defer cancel()
+
+	value, etag, err = s3.loadObject(ctx, key)
+	return value, etag, err
+}
+
+// StoreIfMatch stores value at key like Store, but only if the object still
+// has etag, or doesn't exist yet if etag is empty. Otherwise it fails with
+// an error matching ErrPreconditionFailed, and the caller is expected to
+// load the key again and retry. Conditional writes are never spooled.
+//
+// Endpoints that don't support conditional writes ignore the condition.
+func (s3 S3) StoreIfMatch(ctx context.Context, key string, value []byte, etag string) (err error) {
+	ctx, span := s3.startSpan(ctx, "store", key)
+	defer func() { endSpan(span, err) }()
+
+	return s3.store(ctx, key, value, ifMatch(etag))
+}
+
+// etagSet remembers the ETags of the objects last read or written, for
+// keys that are written conditionally on them.
+type etagSet struct {
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+func newETagSet() *etagSet {
+	return &etagSet{etags: make(map[string]string)}
+}
+
+func (set *etagSet) get(key string) (string, bool) {
+	if set == nil {
+		return "", false
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	etag, ok := set.etags[key]
+	return etag, ok
+}
+
+func (set *etagSet) put(key, etag string) {
+	if set == nil || etag == "" {
+		return
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.etags[key] = etag
+}
+
+func (set *etagSet) remove(key string) {
+	if set == nil {
+		return
+	}
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	delete(set.etags, key)
+}
+
+// isConditionalKey reports whether writes to key are conditional on the
+// object being what this instance last read or wrote. That's the case for
+// OCSP staples: when instances refresh the same staple at once, the first
+// write wins and the others keep it.
+func isConditionalKey(key string) bool {
+	return strings.HasPrefix(key, "ocsp/")
+}
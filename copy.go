@@ -0,0 +1,264 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/minio/minio-go/v7"
+)
+
+// copyManifestInterval is how many keys are copied between saves of the
+// manifest, which is how many are copied again after an interruption.
+const copyManifestInterval = 100
+
+// copyManifest records the keys copied from a source to a target, with the
+// ETags they had in the source.
+type copyManifest struct {
+	Source   string            `json:"source"`
+	Started  time.Time         `json:"started"`
+	Finished time.Time         `json:"finished"`
+	Copied   map[string]string `json:"copied"`
+}
+
+// CopyBucket copies every key under the prefix of s3 to target, e.g. a
+// bucket at another provider. Keys are copied on the server when both are
+// at the same endpoint and store data the same way, and loaded and stored
+// otherwise.
+//
+// The keys copied are recorded in a manifest object under the prefix of
+// target, so an interrupted copy resumes where it stopped. Keys copied
+// before are only copied again once they changed, so copying again just
+// before switching over is quick.
+func (s3 S3) CopyBucket(ctx context.Context, target S3, progress ProgressFunc) error {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	etags, err := s3.objectETags(ctx)
+	if err != nil {
+		return err
+	}
+
+	manifestKey := s3.copyManifestKey(target)
+
+	manifest, err := target.loadCopyManifest(ctx, manifestKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		manifest = copyManifest{Source: s3.location(), Started: time.Now()}
+	} else if err != nil {
+		return fmt.Errorf("loading copy manifest: %v", err)
+	}
+	if manifest.Copied == nil {
+		manifest.Copied = make(map[string]string)
+	}
+	manifest.Finished = time.Time{}
+
+	keys := make([]string, 0, len(etags))
+	for key := range etags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	serverSide := s3.copiesServerSide(target)
+	copied := 0
+
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if manifest.Copied[key] == etags[key] {
+			report(progress, key, i+1, len(keys))
+			continue
+		}
+
+		if serverSide {
+			err = s3.copyObject(ctx, target, key)
+			if errorKind(err) == ErrPermissionDenied {
+				// the target credentials can't read the source
+				serverSide = false
+			}
+		}
+		if !serverSide {
+			err = s3.copyValue(ctx, target, key)
+		}
+		if err != nil {
+			return fmt.Errorf("copying %s: %v", key, err)
+		}
+
+		manifest.Copied[key] = etags[key]
+		copied++
+
+		if copied%copyManifestInterval == 0 {
+			if err := target.storeCopyManifest(ctx, manifestKey, manifest); err != nil {
+				return fmt.Errorf("saving copy manifest: %v", err)
+			}
+		}
+
+		report(progress, key, i+1, len(keys))
+	}
+
+	manifest.Finished = time.Now()
+	if err := target.storeCopyManifest(ctx, manifestKey, manifest); err != nil {
+		return fmt.Errorf("saving copy manifest: %v", err)
+	}
+
+	return nil
+}
+
+// copiesServerSide reports whether objects of s3 can be copied to target
+// as they are stored, on the server.
+func (s3 S3) copiesServerSide(target S3) bool {
+	return s3.Host == target.Host && s3.Discovery == nil && target.Discovery == nil &&
+		s3.sse == nil && target.sse == nil && s3.dataSettings() == target.dataSettings()
+}
+
+// copyObject copies key to target on the server, with the tags, storage
+// class and retention target stores keys with.
+func (s3 S3) copyObject(ctx context.Context, target S3, key string) error {
+	objectKey := s3.KeyPrefix(key)
+
+	return target.do(ctx, "copy", func() error {
+		info, err := s3.client().StatObject(ctx, s3.Bucket, objectKey, minio.StatObjectOptions{})
+		if err != nil {
+			return err
+		}
+
+		opts := target.storeOptions(key, info.UserMetadata[checksumMetadata])
+		dst := copyDestOptions(target.Bucket, target.KeyPrefix(key), opts)
+		src := minio.CopySrcOptions{Bucket: s3.Bucket, Object: objectKey}
+
+		_, err = target.client().CopyObject(ctx, dst, src)
+		if err == nil {
+			target.cache.invalidate(key)
+		}
+		return err
+	})
+}
+
+func (s3 S3) copyValue(ctx context.Context, target S3, key string) error {
+	value, err := s3.Load(ctx, key)
+	if err != nil {
+		return err
+	}
+	return target.Store(ctx, key, value)
+}
+
+// copyManifestKey is the object key of the manifest of copying s3 to
+// target.
+func (s3 S3) copyManifestKey(target S3) string {
+	sum := sha256.Sum256([]byte(s3.location()))
+	return target.KeyPrefix(copyManifestPrefix + hex.EncodeToString(sum[:8]) + ".json")
+}
+
+func (s3 S3) loadCopyManifest(ctx context.Context, objectKey string) (copyManifest, error) {
+	var manifest copyManifest
+
+	err := s3.do(ctx, "load", func() error {
+		object, err := s3.client().GetObject(ctx, s3.Bucket, objectKey, s3.getObjectOptions())
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		contents, err := ioutil.ReadAll(object)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(contents, &manifest)
+	})
+	if isNotFound(err) {
+		return manifest, fs.ErrNotExist
+	}
+
+	return manifest, err
+}
+
+func (s3 S3) storeCopyManifest(ctx context.Context, objectKey string, manifest copyManifest) error {
+	contents, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	opts := s3.putObjectOptions()
+	opts.ContentType = "application/json"
+
+	return s3.do(ctx, "store", func() error {
+		_, err := s3.client().PutObject(ctx, s3.Bucket, objectKey, bytes.NewReader(contents), int64(len(contents)), opts)
+		return err
+	})
+}
+
+func copyFlags(fs *flag.FlagSet) {
+	fs.String("target", "", "Bucket to copy to")
+	fs.String("host", "", "Endpoint of the target bucket, if different")
+	fs.String("target-prefix", "", "Prefix in the target bucket, if different")
+	fs.String("target-config", "", "Configuration file with the s3 storage to copy to, instead of --target")
+	configFlags(fs)
+}
+
+func cmdCopy(fl caddycmd.Flags) (int, error) {
+	targetBucket := fl.String("target")
+	targetConfig := fl.String("target-config")
+	if targetBucket == "" && targetConfig == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--target or --target-config is required")
+	}
+
+	storage, err := loadStorageConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var targetStorage map[string]interface{}
+	if targetConfig != "" {
+		targetStorage, err = loadStorageConfigFile(targetConfig, fl.String("adapter"))
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("target config: %v", err)
+		}
+	} else {
+		// the target has the same config, but the bucket, so copy it deeply
+		// before changing it
+		body, err := json.Marshal(storage)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		if err := json.Unmarshal(body, &targetStorage); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		promoteBucket(targetStorage, targetBucket, fl.String("host"))
+	}
+	if prefix := fl.String("target-prefix"); prefix != "" {
+		targetStorage["prefix"] = prefix
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s3, err := provisionStorage(ctx, storage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	target, err := provisionStorage(ctx, targetStorage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("target bucket: %v", err)
+	}
+
+	err = s3.CopyBucket(ctx, *target, func(p Progress) {
+		fmt.Printf("copied %s (%d/%d)\n", p.Key, p.Done, p.Total)
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
@@ -0,0 +1,306 @@
+package certmagic_s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/signer"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSTSEndpoint     = "https://sts.amazonaws.com"
+	defaultRoleSessionName = "certmagic-s3"
+	ecsCredentialsHost     = "http://169.254.170.2"
+
+	// credentialsTimeout bounds every request for credentials, so a hanging
+	// endpoint can't block the S3 requests waiting for them.
+	credentialsTimeout = 30 * time.Second
+
+	// maxCredentialsResponse caps the responses read from the credentials
+	// endpoints.
+	maxCredentialsResponse = 1 << 20
+)
+
+func (s3 S3) newCredentials() (*credentials.Credentials, error) {
+	var creds *credentials.Credentials
+	switch {
+	case s3.Vault != nil:
+		s3.logger.Info("use vault secret for credentials", zap.String("vault", s3.Vault.Address), zap.String("secret", s3.Vault.SecretPath))
+		creds = credentials.New(&vaultCredentials{
+			client: &http.Client{Transport: http.DefaultTransport, Timeout: credentialsTimeout},
+			vault:  *s3.Vault,
+		})
+	case s3.AccessIDFile != "" || s3.SecretKeyFile != "":
+		if s3.AccessIDFile == "" || s3.SecretKeyFile == "" {
+			return nil, errors.New("access_id_file and secret_key_file must be given together")
+		}
+		s3.logger.Info("use access_id_file and secret_key_file for credentials", zap.String("access_id_file", s3.AccessIDFile), zap.String("secret_key_file", s3.SecretKeyFile))
+		provider := &secretFiles{accessIDFile: s3.AccessIDFile, secretKeyFile: s3.SecretKeyFile}
+		if _, err := provider.Retrieve(); err != nil {
+			return nil, err
+		}
+		creds = credentials.New(provider)
+	case s3.UseIamProvider:
+		if endpoint := ecsCredentialsEndpoint(); endpoint != "" {
+			creds = s3.ecsCredentials(endpoint)
+			break
+		}
+		s3.logger.Info("use iam aws provider for credentials")
+		creds = credentials.NewIAM("")
+	case s3.AccessID == "" && s3.WebIdentityTokenFile != "":
+		if s3.RoleARN == "" {
+			return nil, errors.New("web identity credentials require role_arn or AWS_ROLE_ARN")
+		}
+
+		s3.logger.Info("use web identity token to assume role for credentials", zap.String("token_file", s3.WebIdentityTokenFile), zap.String("role_arn", s3.RoleARN))
+
+		return credentials.New(&credentials.STSWebIdentity{
+			Client:      &http.Client{Transport: http.DefaultTransport, Timeout: credentialsTimeout},
+			STSEndpoint: s3.STSEndpoint,
+			RoleARN:     s3.RoleARN,
+			GetWebIDTokenExpiry: func() (*credentials.WebIdentityToken, error) {
+				token, err := ioutil.ReadFile(s3.WebIdentityTokenFile)
+				if err != nil {
+					return nil, err
+				}
+				return &credentials.WebIdentityToken{Token: strings.TrimSpace(string(token))}, nil
+			},
+		}), nil
+	case s3.AccessID == "" && (s3.Profile != "" || s3.CredentialsFile != ""):
+		s3.logger.Info("use profile of shared credentials file for credentials", zap.String("profile", s3.profileName()))
+		creds = credentials.NewFileAWSCredentials(s3.CredentialsFile, s3.Profile)
+	case s3.AccessID == "" && ecsCredentialsEndpoint() != "":
+		creds = s3.ecsCredentials(ecsCredentialsEndpoint())
+	case s3.AccessID == "" && s3.RoleARN != "":
+		s3.logger.Info("no access_id given, use iam aws provider as source credentials to assume role")
+		creds = credentials.NewIAM("")
+	case s3.SessionToken != "":
+		s3.logger.Info("use secret_key, access_id and session_token for credentials")
+		creds = credentials.NewStaticV4(s3.AccessID, s3.SecretKey, s3.SessionToken)
+	default:
+		s3.logger.Info("use secret_key and access_id for credentials")
+		creds = credentials.NewStaticV4(s3.AccessID, s3.SecretKey, "")
+	}
+
+	if s3.RoleARN == "" {
+		return creds, nil
+	}
+
+	s3.logger.Info("assume role for credentials", zap.String("role_arn", s3.RoleARN))
+
+	return credentials.New(&assumeRole{
+		client:          &http.Client{Transport: http.DefaultTransport, Timeout: credentialsTimeout},
+		source:          creds,
+		endpoint:        s3.STSEndpoint,
+		region:          s3.STSRegion,
+		roleARN:         s3.RoleARN,
+		externalID:      s3.ExternalID,
+		roleSessionName: s3.RoleSessionName,
+	}), nil
+}
+
+// stsRegion returns the region requests to the STS endpoint are signed
+// for: that of a regional AWS endpoint, us-east-1 for the global one, and
+// the storage region for others.
+func stsRegion(endpoint, region string) string {
+	host := endpoint
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	host = strings.ToLower(host)
+
+	labels := strings.Split(host, ".")
+	switch {
+	case host == "sts.amazonaws.com":
+		return "us-east-1"
+	case len(labels) >= 4 && (labels[0] == "sts" || labels[0] == "sts-fips") && labels[2] == "amazonaws":
+		return labels[1]
+	case region != "":
+		return region
+	}
+	return "us-east-1"
+}
+
+// ecsCredentialsEndpoint returns the endpoint serving the ECS task role,
+// if running on ECS or Fargate.
+func ecsCredentialsEndpoint() string {
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return ecsCredentialsHost + uri
+	}
+	return os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+}
+
+// ecsCredentials retrieves the ECS task role credentials from endpoint, as
+// resolved by ecsCredentialsEndpoint. The endpoint is left to minio, which
+// resolves it from the same environment, so a full URI is only used on a
+// loopback address, like the AWS SDKs do, and a web identity token file
+// set along with it is still used against STS rather than the endpoint.
+func (s3 S3) ecsCredentials(endpoint string) *credentials.Credentials {
+	s3.logger.Info("use ecs task role for credentials", zap.String("endpoint", endpoint))
+
+	return credentials.New(&credentials.IAM{
+		Client: &http.Client{Transport: http.DefaultTransport, Timeout: credentialsTimeout},
+	})
+}
+
+func (s3 S3) profileName() string {
+	if s3.Profile == "" {
+		return "default"
+	}
+	return s3.Profile
+}
+
+// secretFiles reads the access ID and secret key from files, as mounted by
+// Docker and Kubernetes secrets. The files are read again once either of
+// them changes.
+type secretFiles struct {
+	accessIDFile  string
+	secretKeyFile string
+
+	mu       sync.Mutex
+	modified [2]time.Time
+}
+
+func (f *secretFiles) Retrieve() (credentials.Value, error) {
+	modified, err := f.modTimes()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	accessID, err := ioutil.ReadFile(f.accessIDFile)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("reading access_id_file: %v", err)
+	}
+	secretKey, err := ioutil.ReadFile(f.secretKeyFile)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("reading secret_key_file: %v", err)
+	}
+
+	f.mu.Lock()
+	f.modified = modified
+	f.mu.Unlock()
+
+	return credentials.Value{
+		AccessKeyID:     strings.TrimSpace(string(accessID)),
+		SecretAccessKey: strings.TrimSpace(string(secretKey)),
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+func (f *secretFiles) IsExpired() bool {
+	modified, err := f.modTimes()
+	if err != nil {
+		// keep the credentials we have, the files may be in the middle
+		// of being replaced
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return modified != f.modified
+}
+
+func (f *secretFiles) modTimes() ([2]time.Time, error) {
+	var modified [2]time.Time
+	for i, name := range []string{f.accessIDFile, f.secretKeyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return modified, err
+		}
+		modified[i] = info.ModTime()
+	}
+	return modified, nil
+}
+
+// assumeRole retrieves temporary credentials from STS AssumeRole, signing
+// the request with the source credentials. Unlike credentials.STSAssumeRole
+// it supports an external ID and temporary source credentials.
+type assumeRole struct {
+	credentials.Expiry
+
+	client          *http.Client
+	source          *credentials.Credentials
+	endpoint        string
+	region          string
+	roleARN         string
+	externalID      string
+	roleSessionName string
+}
+
+func (a *assumeRole) Retrieve() (credentials.Value, error) {
+	source, err := a.source.Get()
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("retrieving source credentials to assume role: %v", err)
+	}
+
+	values := url.Values{}
+	values.Set("Action", "AssumeRole")
+	values.Set("Version", credentials.STSVersion)
+	values.Set("RoleArn", a.roleARN)
+	values.Set("RoleSessionName", a.roleSessionName)
+	if a.externalID != "" {
+		values.Set("ExternalId", a.externalID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.endpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Amz-Content-Sha256", sha256Hex([]byte(values.Encode())))
+	if source.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", source.SessionToken)
+	}
+	req = signer.SignV4STS(*req, source.AccessKeyID, source.SecretAccessKey, a.region)
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCredentialsResponse))
+	if err != nil {
+		return credentials.Value{}, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp credentials.ErrorResponse
+		if err := xml.Unmarshal(body, &errResp); err != nil {
+			return credentials.Value{}, fmt.Errorf("assuming role %s: %s", a.roleARN, resp.Status)
+		}
+		return credentials.Value{}, errResp
+	}
+
+	var result credentials.AssumeRoleResponse
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return credentials.Value{}, err
+	}
+
+	a.SetExpiration(result.Result.Credentials.Expiration, credentials.DefaultExpiryWindow)
+
+	return credentials.Value{
+		AccessKeyID:     result.Result.Credentials.AccessKey,
+		SecretAccessKey: result.Result.Credentials.SecretKey,
+		SessionToken:    result.Result.Credentials.SessionToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,197 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+// Difference lists how the keys of a target storage differ from s3.
+type Difference struct {
+	// Missing keys are in s3 but not in the target.
+	Missing []string
+	// Different keys have another value in the target.
+	Different []string
+	// Extra keys are in the target but not in s3.
+	Extra []string
+}
+
+// Diff compares the keys under the prefix of s3 with those of target. Keys
+// with the same ETag are equal; otherwise both values are loaded and
+// compared, as encryption makes the stored objects differ for equal values.
+func (s3 S3) Diff(ctx context.Context, target S3, progress ProgressFunc) (Difference, error) {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	var diff Difference
+
+	source, err := s3.objectETags(ctx)
+	if err != nil {
+		return diff, err
+	}
+	targets, err := target.objectETags(ctx)
+	if err != nil {
+		return diff, err
+	}
+
+	keys := make([]string, 0, len(source))
+	for key := range source {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return diff, err
+		}
+
+		etag, ok := targets[key]
+		switch {
+		case !ok:
+			diff.Missing = append(diff.Missing, key)
+		case etag != source[key]:
+			equal, err := s3.sameValue(ctx, target, key)
+			if err != nil {
+				return diff, fmt.Errorf("comparing %s: %v", key, err)
+			}
+			if !equal {
+				diff.Different = append(diff.Different, key)
+			}
+		}
+
+		report(progress, key, i+1, len(keys))
+	}
+
+	for key := range targets {
+		if _, ok := source[key]; !ok {
+			diff.Extra = append(diff.Extra, key)
+		}
+	}
+	sort.Strings(diff.Extra)
+
+	return diff, nil
+}
+
+// ApplyDiff copies the missing and different keys of diff from s3 to
+// target. Extra keys are left alone.
+func (s3 S3) ApplyDiff(ctx context.Context, target S3, diff Difference, progress ProgressFunc) error {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	keys := append(append([]string{}, diff.Missing...), diff.Different...)
+
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		value, err := s3.Load(ctx, key)
+		if err != nil {
+			return fmt.Errorf("copying %s: %v", key, err)
+		}
+
+		if err := target.Store(ctx, key, value); err != nil {
+			return fmt.Errorf("copying %s: %v", key, err)
+		}
+
+		report(progress, key, i+1, len(keys))
+	}
+
+	return nil
+}
+
+func (s3 S3) sameValue(ctx context.Context, target S3, key string) (bool, error) {
+	value, err := s3.Load(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	targetValue, err := target.Load(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(value, targetValue), nil
+}
+
+func diffFlags(fs *flag.FlagSet) {
+	fs.String("target", "", "Bucket to compare with")
+	fs.String("host", "", "Endpoint of the target bucket, if different")
+	fs.Bool("apply", false, "Copy missing and different keys to the target")
+	configFlags(fs)
+}
+
+func cmdDiff(fl caddycmd.Flags) (int, error) {
+	targetBucket := fl.String("target")
+	if targetBucket == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--target is required")
+	}
+
+	storage, err := loadStorageConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s3, err := provisionStorage(ctx, storage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	// the target has the same config, but the bucket, so copy it deeply
+	// before changing it
+	body, err := json.Marshal(storage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	var targetStorage map[string]interface{}
+	if err := json.Unmarshal(body, &targetStorage); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	promoteBucket(targetStorage, targetBucket, fl.String("host"))
+
+	target, err := provisionStorage(ctx, targetStorage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("target bucket: %v", err)
+	}
+
+	diff, err := s3.Diff(ctx, *target, nil)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	for _, key := range diff.Missing {
+		fmt.Println("missing   ", key)
+	}
+	for _, key := range diff.Different {
+		fmt.Println("different ", key)
+	}
+	for _, key := range diff.Extra {
+		fmt.Println("extra     ", key)
+	}
+	fmt.Printf("%d missing, %d different, %d extra in %s\n", len(diff.Missing), len(diff.Different), len(diff.Extra), targetBucket)
+
+	if !fl.Bool("apply") {
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	err = s3.ApplyDiff(ctx, *target, diff, func(p Progress) {
+		fmt.Printf("copied %s (%d/%d)\n", p.Key, p.Done, p.Total)
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
@@ -0,0 +1,131 @@
+package certmagic_s3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const defaultDiscoveryInterval = time.Minute
+
+// Discovery looks up the endpoints of a MinIO or Ceph cluster from DNS SRV
+// records or a JSON document, so the cluster can grow without editing every
+// Caddy config. The JSON document is a list of "host:port" strings, either
+// on its own or as the "endpoints" member of an object.
+type Discovery struct {
+	SRV      string         `json:"srv,omitempty"`
+	URL      string         `json:"url,omitempty"`
+	Interval caddy.Duration `json:"interval,omitempty"`
+}
+
+func (d Discovery) lookup(ctx context.Context) ([]string, error) {
+	if d.SRV != "" {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.SRV)
+		if err != nil {
+			return nil, err
+		}
+
+		var endpoints []string
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			endpoints = append(endpoints, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+		return endpoints, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", d.URL, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []string
+	if err := json.Unmarshal(body, &endpoints); err != nil {
+		var document struct {
+			Endpoints []string `json:"endpoints"`
+		}
+		if err := json.Unmarshal(body, &document); err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", d.URL, err)
+		}
+		endpoints = document.Endpoints
+	}
+
+	return endpoints, nil
+}
+
+// discoverEndpoint switches to the first discovered endpoint, unless the
+// endpoint in use is still part of the discovered list.
+func (s3 S3) discoverEndpoint(ctx context.Context) error {
+	endpoints, err := s3.Discovery.lookup(ctx)
+	if err != nil {
+		return fmt.Errorf("discovering endpoints: %v", err)
+	}
+	if len(endpoints) == 0 {
+		return errors.New("discovering endpoints: no endpoints found")
+	}
+
+	host, _ := s3.current.get()
+	for _, endpoint := range endpoints {
+		if endpoint == host {
+			return nil
+		}
+	}
+
+	client, err := s3.newClient(endpoints[0])
+	if err != nil {
+		return err
+	}
+
+	s3.logger.Info("discovered endpoints", zap.Strings("endpoints", endpoints), zap.String("endpoint", endpoints[0]))
+
+	s3.current.set(endpoints[0], client)
+
+	return nil
+}
+
+// refreshEndpoints repeats discovery until ctx is done.
+func (s3 S3) refreshEndpoints(ctx context.Context) {
+	interval := time.Duration(s3.Discovery.Interval)
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s3.discoverEndpoint(ctx); err != nil {
+			s3.logger.Error("discovering endpoints", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"filippo.io/age"
+)
+
+// ageHeader starts every object encrypted by age, which lets Load tell
+// encrypted objects apart from ones written before encryption was enabled.
+const ageHeader = "age-encryption.org/v1\n"
+
+// defaultEncryptionPatterns cover private keys and ACME account data, the
+// only values worth protecting from someone reading the bucket.
+var defaultEncryptionPatterns = []string{"*.key", "acme/*/users/*"}
+
+// Encryption configures client side encryption of stored values to one or
+// more age recipients. Caddy holds the identity used to decrypt them again.
+//
+// Only keys matching one of Patterns are encrypted. Patterns without a slash
+// match the last element of a key, others match the key or any of its
+// parent "directories".
+type Encryption struct {
+	AgeIdentityFile string   `json:"age_identity_file,omitempty"`
+	AgeRecipients   []string `json:"age_recipients,omitempty"`
+	Patterns        []string `json:"patterns,omitempty"`
+}
+
+type ageEncryptor struct {
+	identities []age.Identity
+	recipients []age.Recipient
+	patterns   []string
+}
+
+func newAgeEncryptor(config *Encryption) (*ageEncryptor, error) {
+	if config.AgeIdentityFile == "" {
+		return nil, errors.New("encryption requires age_identity_file to decrypt stored values")
+	}
+
+	file, err := os.Open(config.AgeIdentityFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening age_identity_file: %v", err)
+	}
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("parsing age_identity_file: %v", err)
+	}
+
+	encryptor := &ageEncryptor{identities: identities, patterns: config.Patterns}
+	if len(encryptor.patterns) == 0 {
+		encryptor.patterns = defaultEncryptionPatterns
+	}
+
+	for _, pattern := range encryptor.patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid encryption pattern %s: %v", pattern, err)
+		}
+	}
+
+	// always encrypt to our own identities as well, or we could not read
+	// back what we store
+	for _, identity := range identities {
+		if x25519, ok := identity.(*age.X25519Identity); ok {
+			encryptor.recipients = append(encryptor.recipients, x25519.Recipient())
+		}
+	}
+
+	for _, value := range config.AgeRecipients {
+		recipient, err := age.ParseX25519Recipient(value)
+		if err != nil {
+			return nil, fmt.Errorf("parsing age recipient %s: %v", value, err)
+		}
+		encryptor.recipients = append(encryptor.recipients, recipient)
+	}
+
+	return encryptor, nil
+}
+
+func (e *ageEncryptor) matches(key string) bool {
+	for _, pattern := range e.patterns {
+		if matchKey(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ageEncryptor) encrypt(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := age.Encrypt(&buf, e.recipients...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (e *ageEncryptor) decrypt(value []byte) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(value), e.identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+func isAgeEncrypted(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(ageHeader))
+}
@@ -0,0 +1,45 @@
+package certmagic_s3
+
+import "strings"
+
+// fipsRegions are the regions with S3 FIPS endpoints that minio keeps
+// requests on. It sends requests to other FIPS hosts to the regular
+// endpoint of the region.
+var fipsRegions = []string{"us-east-1", "us-east-2", "us-west-1", "us-west-2", "us-gov-west-1"}
+
+func validFIPSRegion(region string) bool {
+	for _, r := range fipsRegions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
+
+// awsEndpoint returns the host of the AWS S3 endpoint of region, the
+// dual-stack one reachable over IPv6 and IPv4, or the FIPS one, or both.
+func awsEndpoint(region string, dualStack, fips bool) string {
+	host := "s3."
+	if fips {
+		host = "s3-fips."
+	}
+	if dualStack {
+		host += "dualstack."
+	}
+	host += region + ".amazonaws.com"
+	if strings.HasPrefix(region, "cn-") {
+		host += ".cn"
+	}
+	return host
+}
+
+// awsEndpointOption names the options awsEndpoint builds the host for.
+func (s3 S3) awsEndpointOption() string {
+	switch {
+	case s3.DualStack && s3.FIPS:
+		return "dual_stack and fips"
+	case s3.FIPS:
+		return "fips"
+	}
+	return "dual_stack"
+}
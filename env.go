@@ -0,0 +1,52 @@
+package certmagic_s3
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// envBool sets *value from the environment variable name, unless the config
+// set it already. A malformed value is ignored with a warning, or fails
+// provisioning with strict_env.
+func (s3 S3) envBool(name string, value *bool) error {
+	if *value {
+		return nil
+	}
+
+	raw := os.Getenv(name)
+	if raw == "" {
+		return nil
+	}
+
+	parsed, err := strconv.ParseBool(raw)
+	if err != nil {
+		return s3.malformedEnv(name, "a boolean like true or false", raw)
+	}
+	*value = parsed
+
+	return nil
+}
+
+func (s3 S3) malformedEnv(name, expected, raw string) error {
+	message := fmt.Sprintf("malformed %s: expected %s, got %s", name, expected, envShape(raw))
+	if s3.StrictEnv {
+		return errors.New(message)
+	}
+
+	s3.logger.Warn("ignoring malformed environment variable", zap.String("variable", name), zap.String("expected", expected), zap.String("got", envShape(raw)))
+
+	return nil
+}
+
+// envShape describes a value for a message without spelling out long ones,
+// which may be secrets set in the wrong variable.
+func envShape(raw string) string {
+	if len(raw) > 16 {
+		return fmt.Sprintf("a value of %d characters", len(raw))
+	}
+	return strconv.Quote(raw)
+}
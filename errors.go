@@ -0,0 +1,180 @@
+package certmagic_s3
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// expiredCredentialCodes are the error codes S3 and STS respond with once
+// temporary credentials are no longer valid.
+var expiredCredentialCodes = map[string]bool{
+	"ExpiredToken":          true,
+	"ExpiredTokenException": true,
+	"TokenRefreshRequired":  true,
+}
+
+func isExpiredCredentials(err error) bool {
+	return expiredCredentialCodes[minio.ToErrorResponse(err).Code]
+}
+
+// isRejectedCredentials reports whether err may go away by retrieving the
+// credentials again, as they expired or were rotated.
+func isRejectedCredentials(err error) bool {
+	return isExpiredCredentials(err) || minio.ToErrorResponse(err).Code == "InvalidAccessKeyId"
+}
+
+// explainError adds a hint to errors whose cause isn't obvious from the
+// S3 response alone.
+func (s3 S3) explainError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if response := minio.ToErrorResponse(err); response.Code == "InvalidRequest" && strings.Contains(response.Message, "Transfer Acceleration") {
+		return fmt.Errorf("transfer acceleration is not enabled on bucket %s, enable it or unset accelerate: %w", s3.Bucket, err)
+	}
+
+	if isExpiredCredentials(err) {
+		if s3.SessionToken != "" {
+			return fmt.Errorf("temporary credentials have expired, renew access_id, secret_key and session_token: %w", err)
+		}
+		return fmt.Errorf("temporary credentials have expired: %w", err)
+	}
+
+	return err
+}
+
+// Errors the storage operations fail with, to tell with errors.Is. The
+// errors returned are StorageError values, which also carry the error of
+// the S3 client.
+var (
+	ErrNotExist            = fs.ErrNotExist
+	ErrPermissionDenied    = fs.ErrPermission
+	ErrThrottled           = errors.New("throttled by S3")
+	ErrEndpointUnreachable = errors.New("S3 endpoint unreachable")
+	ErrBucketMissing       = errors.New("bucket does not exist")
+	ErrPreconditionFailed  = errors.New("object changed since it was read")
+	ErrInvalidKey          = errors.New("invalid key")
+)
+
+// StorageError is the error of a storage operation on a key. Kind is one of
+// the Err values above, or nil if the error is of no known kind. Host is the
+// endpoint the request went to; RequestID and ExtendedRequestID are the IDs
+// S3 assigned to the failed request (x-amz-request-id and x-amz-id-2), if
+// it got that far, which AWS support asks for.
+type StorageError struct {
+	Operation         string
+	Key               string
+	Kind              error
+	Host              string
+	RequestID         string
+	ExtendedRequestID string
+	Err               error
+}
+
+func (e StorageError) Error() string {
+	msg := fmt.Sprintf("%s %s: %v (host %s", e.Operation, e.Key, e.Err, e.Host)
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(", request ID %s", e.RequestID)
+	}
+	if e.ExtendedRequestID != "" {
+		msg += fmt.Sprintf(", extended request ID %s", e.ExtendedRequestID)
+	}
+	return msg + ")"
+}
+
+func (e StorageError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is match the kind of the error.
+func (e StorageError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// isNotFound reports whether err means the object doesn't exist. HEAD
+// responses have no body, so some providers only tell by the status.
+func isNotFound(err error) bool {
+	resp := minio.ToErrorResponse(err)
+	return resp.Code == "NoSuchKey" || resp.StatusCode == 404 && resp.Code != "NoSuchBucket"
+}
+
+// errorKind classifies err as one of the Err values, or returns nil.
+func errorKind(err error) error {
+	if errors.As(err, new(CircuitOpenError)) {
+		return ErrEndpointUnreachable
+	}
+
+	resp := minio.ToErrorResponse(err)
+	switch {
+	case resp.Code == "NoSuchBucket":
+		return ErrBucketMissing
+	case isNotFound(err):
+		return ErrNotExist
+	case resp.StatusCode == 403 || resp.Code == "AccessDenied" || resp.Code == "SignatureDoesNotMatch" || isRejectedCredentials(err):
+		return ErrPermissionDenied
+	case resp.StatusCode == 429 || resp.Code == "SlowDown" || resp.Code == "Throttling" || resp.Code == "ThrottlingException" || resp.Code == "RequestLimitExceeded":
+		return ErrThrottled
+	case resp.StatusCode == 412 || resp.Code == "PreconditionFailed" || resp.Code == "ConditionalRequestConflict":
+		return ErrPreconditionFailed
+	case endpointDown(err):
+		return ErrEndpointUnreachable
+	}
+	return nil
+}
+
+// storageError is err of operation on key as StorageError, the way
+// certmagic expects errors: missing keys are fs.ErrNotExist.
+func (s3 S3) storageError(operation, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	requestID, extendedRequestID := requestIDs(err)
+
+	return StorageError{
+		Operation:         operation,
+		Key:               s3.logKey(key),
+		Kind:              errorKind(err),
+		Host:              s3.endpoint(),
+		RequestID:         requestID,
+		ExtendedRequestID: extendedRequestID,
+		Err:               s3.explainError(err),
+	}
+}
+
+// requestIDs returns the request ID and extended request ID of the S3
+// response err came with, if any.
+func requestIDs(err error) (string, string) {
+	var resp minio.ErrorResponse
+	if errors.As(err, &resp) {
+		return resp.RequestID, resp.HostID
+	}
+	return "", ""
+}
+
+// errorFields are the log fields that identify the request err came with.
+func errorFields(host string, err error) []zap.Field {
+	fields := []zap.Field{zap.String("host", host)}
+
+	requestID, extendedRequestID := requestIDs(err)
+	if requestID != "" {
+		fields = append(fields, zap.String("request_id", requestID))
+	}
+	if extendedRequestID != "" {
+		fields = append(fields, zap.String("extended_request_id", extendedRequestID))
+	}
+
+	return fields
+}
+
+// errorFields are the log fields that identify the request to the current
+// endpoint err came with.
+func (s3 S3) errorFields(err error) []zap.Field {
+	return errorFields(s3.endpoint(), err)
+}
@@ -0,0 +1,120 @@
+package certmagic_s3
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+func exportFlags(fs *flag.FlagSet) {
+	fs.String("output", "-", "Tar archive to write, - for stdout")
+	fs.String("domains", "", "Comma separated domain globs of the keys to export")
+	fs.String("classes", "", "Comma separated key classes to export")
+	configFlags(fs)
+}
+
+func cmdExport(fl caddycmd.Flags) (int, error) {
+	filter := KeyFilter{
+		Domains: splitList(fl.String("domains")),
+		Classes: splitList(fl.String("classes")),
+	}
+	for _, class := range filter.Classes {
+		if !validKeyClass(class) {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("invalid key class %q: must be one of %s", class, strings.Join(keyClasses, ", "))
+		}
+	}
+
+	storage, err := loadStorageConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s3, err := provisionStorage(ctx, storage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	out := os.Stdout
+	if output := fl.String("output"); output != "-" {
+		out, err = os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer out.Close()
+	}
+
+	// the archive may go to stdout
+	err = s3.Export(ctx, out, filter, func(p Progress) {
+		fmt.Fprintf(os.Stderr, "exported %s (%d/%d)\n", p.Key, p.Done, p.Total)
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if out != os.Stdout {
+		if err := out.Close(); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+func importFlags(fs *flag.FlagSet) {
+	fs.String("input", "-", "Tar archive to read, - for stdin")
+	configFlags(fs)
+}
+
+func cmdImport(fl caddycmd.Flags) (int, error) {
+	storage, err := loadStorageConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s3, err := provisionStorage(ctx, storage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var r io.Reader = os.Stdin
+	if input := fl.String("input"); input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	err = s3.Import(ctx, r, func(p Progress) {
+		fmt.Printf("imported %s (%d)\n", p.Key, p.Done)
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,218 @@
+package certmagic_s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultFailoverProbeInterval = 30 * time.Second
+
+	// failoverProbeTimeout bounds probing a single endpoint.
+	failoverProbeTimeout = 10 * time.Second
+)
+
+// Failover lists more endpoints serving the bucket, like the sites of a
+// replicated MinIO or Ceph cluster. Requests go to the endpoint with the
+// lowest priority that is up; host has priority 0. When an endpoint errors
+// or times out, requests fail over to the next one, and every ProbeInterval
+// the endpoints preferred over the one in use are probed to switch back.
+type Failover struct {
+	Endpoints     []FailoverEndpoint `json:"endpoints,omitempty"`
+	ProbeInterval caddy.Duration     `json:"probe_interval,omitempty"`
+}
+
+// FailoverEndpoint is an endpoint to fail over to. Region defaults to the
+// region of the storage.
+type FailoverEndpoint struct {
+	Host     string `json:"host"`
+	Region   string `json:"region"`
+	Priority int    `json:"priority"`
+}
+
+type failover struct {
+	endpoints     []FailoverEndpoint
+	probeInterval time.Duration
+
+	mu   sync.Mutex
+	down map[string]time.Time
+}
+
+func newFailover(config *Failover, host string) (*failover, error) {
+	endpoints := append([]FailoverEndpoint{{Host: host}}, config.Endpoints...)
+
+	seen := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		if endpoint.Host == "" {
+			return nil, errors.New("failover endpoints require a host")
+		}
+		if seen[endpoint.Host] {
+			return nil, fmt.Errorf("failover endpoint %s is listed twice", endpoint.Host)
+		}
+		seen[endpoint.Host] = true
+	}
+
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].Priority < endpoints[j].Priority
+	})
+
+	f := &failover{
+		endpoints:     endpoints,
+		probeInterval: time.Duration(config.ProbeInterval),
+		down:          make(map[string]time.Time),
+	}
+	if f.probeInterval <= 0 {
+		f.probeInterval = defaultFailoverProbeInterval
+	}
+	return f, nil
+}
+
+// regionFor returns the region to sign requests to host for.
+func (s3 S3) regionFor(host string) string {
+	if s3.failover != nil {
+		for _, endpoint := range s3.failover.endpoints {
+			if endpoint.Host == host && endpoint.Region != "" {
+				return endpoint.Region
+			}
+		}
+	}
+	return s3.Region
+}
+
+// endpointDown reports whether err means the endpoint is down, as opposed
+// to refusing or throttling the request.
+func endpointDown(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	resp := minio.ToErrorResponse(err)
+	switch resp.StatusCode {
+	case 500, 502, 504:
+		return true
+	case 503:
+		return resp.Code != "SlowDown"
+	}
+	return false
+}
+
+// failOver switches from the endpoint of the failed client to the next one
+// that is not known to be down, unless another request did so already. It
+// reports whether the request should be sent again.
+func (s3 S3) failOver(failed *minio.Client, err error) bool {
+	if s3.failover == nil || !endpointDown(err) {
+		return false
+	}
+
+	s3.current.mu.Lock()
+	defer s3.current.mu.Unlock()
+
+	if s3.current.client != failed {
+		return true
+	}
+
+	f := s3.failover
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.down[s3.current.host] = time.Now()
+
+	for _, endpoint := range f.endpoints {
+		if endpoint.Host == s3.current.host {
+			continue
+		}
+		if since, ok := f.down[endpoint.Host]; ok && time.Since(since) < f.probeInterval {
+			continue
+		}
+
+		client, clientErr := s3.newClient(endpoint.Host)
+		if clientErr != nil {
+			s3.log(logRequests).Error("failing over", zap.String("endpoint", endpoint.Host), zap.Error(clientErr))
+			continue
+		}
+
+		s3.log(logRequests).Warn("endpoint failed, failing over", zap.String("failed", s3.current.host), zap.String("endpoint", endpoint.Host), zap.Error(err))
+
+		s3.current.host = endpoint.Host
+		s3.current.client = client
+
+		return true
+	}
+
+	return false
+}
+
+// probeEndpoints switches back to the endpoints preferred over the one in
+// use once they are up again, until ctx is done.
+func (s3 S3) probeEndpoints(ctx context.Context) {
+	ticker := time.NewTicker(s3.failover.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, _ := s3.current.get()
+
+		for _, endpoint := range s3.failover.endpoints {
+			if endpoint.Host == current {
+				break
+			}
+			if s3.probeEndpoint(ctx, endpoint.Host) {
+				break
+			}
+		}
+	}
+}
+
+// probeEndpoint checks that host serves the bucket, and if so, switches to
+// it.
+func (s3 S3) probeEndpoint(ctx context.Context, host string) bool {
+	client, err := s3.newClient(host)
+	if err != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, failoverProbeTimeout)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, s3.Bucket)
+
+	f := s3.failover
+	f.mu.Lock()
+	if err != nil || !exists {
+		f.down[host] = time.Now()
+		f.mu.Unlock()
+		return false
+	}
+	delete(f.down, host)
+	f.mu.Unlock()
+
+	s3.log(logRequests).Info("endpoint is up again, switching back to it", zap.String("endpoint", host))
+
+	s3.current.set(host, client)
+
+	return true
+}
@@ -0,0 +1,213 @@
+package certmagic_s3
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultGCInterval = 24 * time.Hour
+	defaultGCGrace    = 30 * 24 * time.Hour
+
+	// gcRunTime is how long a single run may take.
+	gcRunTime = 30 * time.Minute
+)
+
+// GarbageCollection periodically deletes what nobody uses anymore:
+// certificates expired for longer than Grace, with their private keys and
+// metadata, OCSP staples of sites without certificates, and locks no
+// instance refreshed or took over for a whole Interval. With DryRun, what
+// would be deleted is only logged.
+type GarbageCollection struct {
+	Interval caddy.Duration `json:"interval,omitempty"`
+	Grace    caddy.Duration `json:"grace,omitempty"`
+	DryRun   bool           `json:"dry_run,omitempty"`
+}
+
+func (gc GarbageCollection) interval() time.Duration {
+	if gc.Interval <= 0 {
+		return defaultGCInterval
+	}
+	return time.Duration(gc.Interval)
+}
+
+func (gc GarbageCollection) grace() time.Duration {
+	if gc.Grace <= 0 {
+		return defaultGCGrace
+	}
+	return time.Duration(gc.Grace)
+}
+
+// collected counts what a garbage collection run deleted, by key class.
+type collected map[string]int
+
+func (c collected) total() int {
+	var total int
+	for _, n := range c {
+		total += n
+	}
+	return total
+}
+
+// collectGarbage runs the garbage collection every interval until ctx is
+// done.
+func (s3 S3) collectGarbage(ctx context.Context) {
+	ticker := time.NewTicker(s3.GarbageCollection.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		runCtx, cancel := context.WithTimeout(ctx, gcRunTime)
+		deleted, err := s3.collectGarbageOnce(runCtx)
+		cancel()
+		if err != nil {
+			s3.logger.Error("collecting garbage", append(s3.errorFields(err), zap.Error(err))...)
+		}
+
+		fields := []zap.Field{zap.Bool("dry_run", s3.GarbageCollection.DryRun), zap.Int("objects", deleted.total())}
+		for class, n := range deleted {
+			fields = append(fields, zap.Int(class, n))
+		}
+		switch {
+		case s3.GarbageCollection.DryRun:
+			s3.logger.Info("garbage collection would delete objects", fields...)
+		case deleted.total() > 0:
+			s3.logger.Info("garbage collection deleted objects", fields...)
+		}
+	}
+}
+
+func (s3 S3) collectGarbageOnce(ctx context.Context) (collected, error) {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	deleted := make(collected)
+
+	prefix := s3.listPrefix("")
+
+	// the keys of each site directory, to delete along with its certificate
+	sites := make(map[string][]string)
+	var certificates, staples, locks []string
+
+	for object := range s3.listBucket(ctx, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return deleted, object.Err
+		}
+
+		key := s3.CutKeyPrefix(object.Key)
+		switch keyClass(key) {
+		case ClassCertificate:
+			certificates = append(certificates, key)
+			sites[path.Dir(key)] = append(sites[path.Dir(key)], key)
+		case ClassPrivateKey, ClassMetadata:
+			sites[path.Dir(key)] = append(sites[path.Dir(key)], key)
+		case ClassOCSP:
+			staples = append(staples, key)
+		case ClassLock:
+			locks = append(locks, key)
+		}
+	}
+
+	// names of the certificates in use, whose staples are kept
+	domains := make(map[string]bool)
+
+	for _, key := range certificates {
+		leaf, err := s3.loadLeaf(ctx, key)
+		if s3.staleListing(err) {
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("checking %s: %v", s3.logKey(key), err)
+		}
+		if time.Since(leaf.NotAfter) <= s3.GarbageCollection.grace() {
+			domains[keyDomain(key)] = true
+			for _, name := range certNames(leaf) {
+				domains[strings.ToLower(name)] = true
+			}
+			continue
+		}
+
+		for _, siteKey := range sites[path.Dir(key)] {
+			if err := s3.collect(ctx, siteKey, deleted); err != nil {
+				return deleted, err
+			}
+		}
+	}
+
+	for _, key := range staples {
+		if domains[keyDomain(key)] {
+			continue
+		}
+		if err := s3.collect(ctx, key, deleted); err != nil {
+			return deleted, err
+		}
+	}
+
+	for _, key := range locks {
+		meta, err := s3.loadLockMeta(ctx, s3.KeyPrefix(key))
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("checking %s: %v", s3.logKey(key), err)
+		}
+		if !meta.stale() || time.Since(meta.lastUpdate()) < s3.GarbageCollection.interval() {
+			continue
+		}
+		if err := s3.collect(ctx, key, deleted); err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// loadLeaf loads the leaf of the certificate chain at key.
+func (s3 S3) loadLeaf(ctx context.Context, key string) (*x509.Certificate, error) {
+	value, err := s3.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(value)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// collect deletes key, unless it's a dry run, and counts it.
+func (s3 S3) collect(ctx context.Context, key string, deleted collected) error {
+	class := keyClass(key)
+
+	if s3.GarbageCollection.DryRun {
+		s3.log(logOperations).Info("garbage collection would delete", s3.keyField(key), zap.String("class", class))
+		deleted[class]++
+		return nil
+	}
+
+	if err := s3.Delete(ctx, key); err != nil {
+		return err
+	}
+
+	s3.log(logOperations).Debug("garbage collection deleted", s3.keyField(key), zap.String("class", class))
+	deleted[class]++
+	if s3.meter != nil {
+		s3.meter.countCollected(class)
+	}
+
+	return nil
+}
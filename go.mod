@@ -3,8 +3,13 @@ module github.com/ss098/certmagic-s3
 go 1.16
 
 require (
+	filippo.io/age v1.0.0
 	github.com/caddyserver/caddy/v2 v2.5.1
 	github.com/caddyserver/certmagic v0.16.1
 	github.com/minio/minio-go/v7 v7.0.27
+	github.com/prometheus/client_golang v1.12.1
+	go.opentelemetry.io/otel v1.4.0
+	go.opentelemetry.io/otel/trace v1.4.0
 	go.uber.org/zap v1.21.0
+	golang.org/x/net v0.0.0-20220127200216-cd36cc0744dd
 )
@@ -0,0 +1,113 @@
+package certmagic_s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// instances are the storages provisioned in this process, by the location
+// of their data, so two of them writing the same data differently are
+// caught at provision.
+var instances = struct {
+	sync.Mutex
+	byLocation map[string][]*instance
+}{byLocation: make(map[string][]*instance)}
+
+type instance struct {
+	// config is the context of the Caddy config the storage belongs to.
+	// Storages of the config being replaced on a reload may differ.
+	config   context.Context
+	settings string
+}
+
+// location identifies where the storage keeps its data.
+func (s3 S3) location() string {
+	endpoint := s3.Host
+	if s3.Discovery != nil {
+		endpoint = s3.Discovery.SRV + s3.Discovery.URL
+	}
+	return fmt.Sprintf("%s/%s/%s", endpoint, s3.Bucket, cleanPrefix(s3.Prefix))
+}
+
+// dataSettings describes the settings that change how data is written,
+// without giving away keys.
+func (s3 S3) dataSettings() string {
+	var settings []string
+
+	if s3.Encryption != nil {
+		recipients := append([]string(nil), s3.Encryption.AgeRecipients...)
+		sort.Strings(recipients)
+		patterns := append([]string(nil), s3.Encryption.Patterns...)
+		sort.Strings(patterns)
+		settings = append(settings, fmt.Sprintf("age encryption of [%s] to [%s]", strings.Join(patterns, " "), strings.Join(recipients, " ")))
+	}
+
+	if s3.SSECustomerKey != "" {
+		sum := sha256.Sum256([]byte(s3.SSECustomerKey))
+		settings = append(settings, fmt.Sprintf("sse-c key %x", sum[:6]))
+	}
+
+	if s3.KeyEncoding != "" {
+		settings = append(settings, fmt.Sprintf("%s key encoding", s3.KeyEncoding))
+	}
+
+	if !s3.hierarchical() {
+		settings = append(settings, fmt.Sprintf("%s layout", s3.Layout))
+	}
+
+	if len(settings) == 0 {
+		return "no encryption"
+	}
+	return strings.Join(settings, ", ")
+}
+
+// register fails if another storage of the same config keeps its data at
+// the same location with different settings. The storage is unregistered
+// once config is done.
+func (s3 S3) register(config context.Context) error {
+	inst := &instance{config: config, settings: s3.dataSettings()}
+	location := s3.location()
+
+	instances.Lock()
+	defer instances.Unlock()
+
+	for _, other := range instances.byLocation[location] {
+		if other.config == config && other.settings != inst.settings {
+			return fmt.Errorf("another s3 storage of this config uses bucket %s with prefix %q, but with %s instead of %s; they would corrupt each other's data", s3.Bucket, s3.Prefix, other.settings, inst.settings)
+		}
+	}
+
+	instances.byLocation[location] = append(instances.byLocation[location], inst)
+
+	go func() {
+		<-config.Done()
+		s3.unregister(inst)
+	}()
+
+	return nil
+}
+
+func (s3 S3) unregister(inst *instance) {
+	location := s3.location()
+
+	instances.Lock()
+	defer instances.Unlock()
+
+	registered := instances.byLocation[location]
+	for i, other := range registered {
+		if other == inst {
+			registered = append(registered[:i], registered[i+1:]...)
+			break
+		}
+	}
+
+	if len(registered) == 0 {
+		delete(instances.byLocation, location)
+	} else {
+		instances.byLocation[location] = registered
+	}
+}
@@ -0,0 +1,199 @@
+package certmagic_s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHealthInterval        = 30 * time.Second
+	defaultHealthDegradedLatency = time.Second
+	defaultHealthFailures        = 3
+)
+
+// Health states.
+const (
+	HealthUnknown  = "unknown"
+	HealthHealthy  = "healthy"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+)
+
+// HealthCheck checks every Interval that the bucket can be reached with a
+// HEAD request. The storage is degraded while the check takes longer than
+// DegradedLatency or failed fewer than Failures times in a row, and down
+// once it failed Failures times in a row.
+type HealthCheck struct {
+	Interval        caddy.Duration `json:"interval,omitempty"`
+	DegradedLatency caddy.Duration `json:"degraded_latency,omitempty"`
+	Failures        int            `json:"failures,omitempty"`
+}
+
+// HealthStatus is the result of the last health check. Since is when the
+// storage entered State.
+type HealthStatus struct {
+	State          string    `json:"state"`
+	LastError      string    `json:"last_error,omitempty"`
+	LatencySeconds float64   `json:"latency_seconds"`
+	Checked        time.Time `json:"checked"`
+	Since          time.Time `json:"since"`
+}
+
+type health struct {
+	interval        time.Duration
+	degradedLatency time.Duration
+	failures        int
+
+	mu     sync.Mutex
+	status HealthStatus
+	failed int
+}
+
+func newHealth(config *HealthCheck) *health {
+	h := &health{
+		interval:        time.Duration(config.Interval),
+		degradedLatency: time.Duration(config.DegradedLatency),
+		failures:        config.Failures,
+		status:          HealthStatus{State: HealthUnknown, Since: time.Now()},
+	}
+	if h.interval <= 0 {
+		h.interval = defaultHealthInterval
+	}
+	if h.degradedLatency <= 0 {
+		h.degradedLatency = defaultHealthDegradedLatency
+	}
+	if h.failures <= 0 {
+		h.failures = defaultHealthFailures
+	}
+	return h
+}
+
+// Health returns the result of the last health check.
+func (s3 S3) Health() (HealthStatus, bool) {
+	if s3.health == nil {
+		return HealthStatus{}, false
+	}
+	s3.health.mu.Lock()
+	defer s3.health.mu.Unlock()
+	return s3.health.status, true
+}
+
+// checkHealth checks the health every interval until ctx is done.
+func (s3 S3) checkHealth(ctx context.Context) {
+	ticker := time.NewTicker(s3.health.interval)
+	defer ticker.Stop()
+
+	for {
+		s3.checkHealthOnce(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s3 S3) checkHealthOnce(ctx context.Context) {
+	h := s3.health
+
+	ctx, cancel := context.WithTimeout(ctx, h.interval)
+	defer cancel()
+
+	start := time.Now()
+	exists, err := s3.client().BucketExists(ctx, s3.Bucket)
+	latency := time.Since(start)
+	if err == nil && !exists {
+		err = fmt.Errorf("bucket %s: %w", s3.Bucket, ErrBucketMissing)
+	}
+	// shutting down
+	if ctx.Err() == context.Canceled {
+		return
+	}
+
+	h.mu.Lock()
+
+	state := HealthHealthy
+	if err != nil {
+		h.failed++
+		state = HealthDegraded
+		if h.failed >= h.failures {
+			state = HealthDown
+		}
+	} else {
+		h.failed = 0
+		if latency > h.degradedLatency {
+			state = HealthDegraded
+		}
+	}
+
+	previous := h.status.State
+	h.status.Checked = start
+	h.status.LatencySeconds = latency.Seconds()
+	if err != nil {
+		h.status.LastError = s3.explainError(err).Error()
+	}
+	if state != previous {
+		h.status.State = state
+		h.status.Since = start
+	}
+
+	h.mu.Unlock()
+
+	if state == previous {
+		return
+	}
+
+	switch state {
+	case HealthHealthy:
+		s3.logger.Info("storage is healthy", zap.String("bucket", s3.Bucket), zap.Duration("latency", latency))
+	case HealthDegraded:
+		if err != nil {
+			s3.logger.Warn("storage is degraded, health check failed", append(s3.errorFields(err), zap.Error(err))...)
+		} else {
+			s3.logger.Warn("storage is degraded, slow to answer", zap.String("bucket", s3.Bucket), zap.Duration("latency", latency))
+		}
+	case HealthDown:
+		s3.logger.Error("storage is down, health check failed", append(s3.errorFields(err), zap.Int("failures", h.failures), zap.Error(err))...)
+	}
+}
+
+// handleHealth serves the health of the storage, with status 503 while it
+// is down, for load balancer probes.
+func (a *ReconcileAPI) handleHealth(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	s3, ok := a.ctx.Storage().(S3)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("storage is not s3"),
+		}
+	}
+
+	status, ok := s3.Health()
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("health_check is not configured"),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.State == HealthDown {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	return json.NewEncoder(w).Encode(status)
+}
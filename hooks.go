@@ -0,0 +1,202 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The events hooks are called for.
+const (
+	hookStored      = "stored"
+	hookDeleted     = "deleted"
+	hookStoreFailed = "store_failed"
+)
+
+var hookEvents = []string{hookStored, hookDeleted, hookStoreFailed}
+
+const (
+	// hookTimeout bounds a single call of a hook.
+	hookTimeout = 10 * time.Second
+
+	// hookAttempts is how often a hook is called before the event is
+	// dropped.
+	hookAttempts = 3
+)
+
+// Hook posts events to URL as JSON, with Headers, when an object matching
+// Keys is stored, deleted or fails to store, such as to warm CDN caches
+// when a certificate is renewed. Events are all of them by default, and
+// Keys patterns like those of storage classes, certificate keys by default.
+// Hooks are called in the background, so they don't hold up the storage.
+type Hook struct {
+	URL     string            `json:"url"`
+	Events  []string          `json:"events,omitempty"`
+	Keys    []string          `json:"keys,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// HookEvent is what hooks are posted. NotAfter is the expiry of stored
+// certificates.
+type HookEvent struct {
+	Event    string     `json:"event"`
+	Key      string     `json:"key"`
+	Class    string     `json:"class"`
+	Site     string     `json:"site,omitempty"`
+	Size     int        `json:"size"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+	Error    string     `json:"error,omitempty"`
+	Instance string     `json:"instance"`
+	Time     time.Time  `json:"time"`
+}
+
+type hooks struct {
+	client  *http.Client
+	pending *inflight
+}
+
+func validHookEvent(event string) bool {
+	for _, known := range hookEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (h Hook) matches(event, key string) bool {
+	if len(h.Events) > 0 {
+		var found bool
+		for _, e := range h.Events {
+			found = found || e == event
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(h.Keys) == 0 {
+		return isCertificateKey(key)
+	}
+	for _, pattern := range h.Keys {
+		if matchKey(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// storeEvent is the event of a Store that returned err.
+func storeEvent(err error) string {
+	if err != nil {
+		return hookStoreFailed
+	}
+	return hookStored
+}
+
+// notifyHooks calls the hooks of event on key in the background. value is
+// what was stored, if anything.
+func (s3 S3) notifyHooks(event, key string, value []byte, err error) {
+	if s3.hooks == nil {
+		return
+	}
+
+	var matched []Hook
+	for _, hook := range s3.Hooks {
+		if hook.matches(event, key) {
+			matched = append(matched, hook)
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+
+	e := HookEvent{
+		Event:    event,
+		Key:      key,
+		Class:    keyClass(key),
+		Site:     keyDomain(key),
+		Size:     len(value),
+		Instance: s3.instanceID,
+		Time:     time.Now().UTC(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if event == hookStored && path.Ext(key) == ".crt" {
+		if block, _ := pem.Decode(value); block != nil {
+			if leaf, err := x509.ParseCertificate(block.Bytes); err == nil {
+				e.NotAfter = &leaf.NotAfter
+			}
+		}
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	for _, hook := range matched {
+		hook := hook
+		s3.hooks.pending.start()
+		go func() {
+			defer s3.hooks.pending.done()
+			if err := s3.hooks.call(hook, body); err != nil {
+				s3.logger.Warn("calling hook", zap.String("url", hook.URL), zap.String("event", event), s3.keyField(key), zap.Error(err))
+			}
+		}()
+	}
+}
+
+// call posts body to the hook, trying again a few times if that fails.
+func (h *hooks) call(hook Hook, body []byte) error {
+	var err error
+	for attempt := 0; attempt < hookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = h.post(hook, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (h *hooks) post(hook Hook, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	return postJSON(ctx, h.client, hook.URL, hook.Headers, body)
+}
+
+// postJSON posts body to url with headers, and fails unless the response
+// is a success.
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package certmagic_s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// checksumMetadata is the user metadata holding the SHA-256 of an object
+// as written by Store, as returned by minio without the X-Amz-Meta- prefix.
+const checksumMetadata = "Sha256"
+
+// Actions for OnChecksumMismatch.
+const (
+	mismatchError  = "error"
+	mismatchWarn   = "warn"
+	mismatchMirror = "mirror"
+)
+
+func validMismatchAction(action string) bool {
+	return action == mismatchError || action == mismatchWarn || action == mismatchMirror
+}
+
+// validMismatchClass reports whether class can be configured in
+// OnChecksumMismatch: a key class or "default".
+func validMismatchClass(class string) bool {
+	return class == "default" || validKeyClass(class)
+}
+
+type checksumMismatchError struct {
+	key       string
+	algorithm string
+	expected  string
+	actual    string
+}
+
+func (e checksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected %s %s, got %s, the object is corrupted", e.key, e.algorithm, e.expected, e.actual)
+}
+
+// md5ETag matches the ETags that are the MD5 of the object, as for objects
+// uploaded in a single part. Those of multipart uploads have a part count.
+var md5ETag = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// verifyChecksum compares value to the SHA-256 stored with it, or for
+// objects written without, like by other tools, to the MD5 its ETag is.
+// ETags of objects encrypted with SSE-C or SSE-KMS are no MD5, nor those
+// encrypted at rest by other providers than AWS, nor any with providers like
+// B2, and objects without either checksum always pass.
+func (s3 S3) verifyChecksum(key string, value []byte, info minio.ObjectInfo) error {
+	if expected := info.UserMetadata[checksumMetadata]; expected != "" {
+		actual := sha256Hex(value)
+		if actual != expected {
+			return checksumMismatchError{key: key, algorithm: "sha256", expected: expected, actual: actual}
+		}
+		return nil
+	}
+
+	etag := strings.ToLower(strings.Trim(info.ETag, `"`))
+	if s3.sse != nil || !s3.trustsETags() || !md5ETag.MatchString(etag) {
+		return nil
+	}
+	if encryption := info.Metadata.Get("X-Amz-Server-Side-Encryption"); encryption == "aws:kms" || encryption != "" && !strings.HasSuffix(s3.endpoint(), "amazonaws.com") {
+		return nil
+	}
+
+	sum := md5.Sum(value)
+	if actual := hex.EncodeToString(sum[:]); actual != etag {
+		return checksumMismatchError{key: key, algorithm: "md5", expected: etag, actual: actual}
+	}
+
+	return nil
+}
+
+// mismatchAction returns what to do when the checksum of key doesn't match,
+// looked up by key class, then "default", defaulting to a hard error.
+func (s3 S3) mismatchAction(key string) string {
+	if action, ok := s3.OnChecksumMismatch[keyClass(key)]; ok {
+		return action
+	}
+	if action, ok := s3.OnChecksumMismatch["default"]; ok {
+		return action
+	}
+	return mismatchError
+}
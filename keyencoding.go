@@ -0,0 +1,256 @@
+package certmagic_s3
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Key encodings, for providers and IAM policies that handle characters
+// like * and + in object keys badly.
+const (
+	keyEncodingPercent = "percent"
+	keyEncodingBase32  = "base32"
+)
+
+// base32Key encodes segments with the extended hex alphabet, lowercased,
+// which sorts like the segments themselves.
+var base32Key = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func validKeyEncoding(encoding string) bool {
+	switch encoding {
+	case "", keyEncodingPercent, keyEncodingBase32:
+		return true
+	}
+	return false
+}
+
+// encodeKey encodes each path segment of key, so the slashes still make
+// up directories. With base32, segments starting with a dot, which are the
+// module's own, are left as they are.
+func encodeKey(encoding, key string) string {
+	if encoding == "" || key == "" {
+		return key
+	}
+
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+		case encoding == keyEncodingPercent:
+			segments[i] = percentEncode(segment)
+		case encoding == keyEncodingBase32 && !strings.HasPrefix(segment, "."):
+			segments[i] = strings.ToLower(base32Key.EncodeToString([]byte(segment)))
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// decodeKey reverses encodeKey. Objects written before the encoding was set
+// can't be told apart, as a plain segment like "acme" decodes as base32
+// too, so they have to be renamed with EncodeKeys before switching it on.
+func decodeKey(encoding, key string) string {
+	if encoding == "" || key == "" {
+		return key
+	}
+
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		switch {
+		case segment == "":
+		case encoding == keyEncodingPercent:
+			if decoded, err := url.PathUnescape(segment); err == nil {
+				segments[i] = decoded
+			}
+		case encoding == keyEncodingBase32 && !strings.HasPrefix(segment, "."):
+			if decoded, err := base32Key.DecodeString(strings.ToUpper(segment)); err == nil {
+				segments[i] = string(decoded)
+			}
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// percentEncode escapes every byte but letters, digits and -._~.
+func percentEncode(segment string) string {
+	var b strings.Builder
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func keyEncodingName(encoding string) string {
+	if encoding == "" {
+		return "none"
+	}
+	return encoding
+}
+
+func (s3 S3) encodeKey(key string) string {
+	return encodeKey(s3.KeyEncoding, key)
+}
+
+func (s3 S3) decodeKey(key string) string {
+	return decodeKey(s3.KeyEncoding, key)
+}
+
+// EncodeKeys renames the objects under the prefix, stored with the key
+// encoding from ("" for none), to the key encoding of s3. Objects are
+// copied on the server and the originals deleted. The renamed objects are
+// recorded in a manifest, so an interrupted run resumes where it stopped,
+// and a finished one isn't repeated. Caddy instances using the bucket
+// should be stopped meanwhile.
+func (s3 S3) EncodeKeys(ctx context.Context, from string, progress ProgressFunc) error {
+	if !validKeyEncoding(from) {
+		return fmt.Errorf("invalid key encoding %q: must be one of percent, base32 or empty", from)
+	}
+	if from == s3.KeyEncoding {
+		return fmt.Errorf("keys are stored with key encoding %q already", from)
+	}
+	if err := s3.ready(); err != nil {
+		return err
+	}
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	// the manifest is under the prefix as it is, whatever the encoding
+	manifestKey := path.Join(cleanPrefix(s3.Prefix), copyManifestPrefix+fmt.Sprintf("key-encoding-%s-%s.json", keyEncodingName(from), keyEncodingName(s3.KeyEncoding)))
+
+	manifest, err := s3.loadCopyManifest(ctx, manifestKey)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		manifest = copyManifest{Source: keyEncodingName(from), Started: time.Now()}
+	case err != nil:
+		return fmt.Errorf("loading key encoding manifest: %v", err)
+	case !manifest.Finished.IsZero():
+		return fmt.Errorf("keys were encoded already on %s", manifest.Finished.Format(time.RFC3339))
+	}
+	if manifest.Copied == nil {
+		manifest.Copied = make(map[string]string)
+	}
+
+	prefix := s3.listPrefix("")
+
+	// the storage as the objects are stored, so tenant prefixes, which
+	// aren't encoded, are cut before decoding
+	source := s3
+	source.KeyEncoding = from
+
+	// list first, as renamed objects would be listed again
+	renames := make(map[string]string)
+	var objectKeys []string
+	for object := range s3.listBucket(ctx, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return s3.explainError(object.Err)
+		}
+		if _, renamed := manifest.Copied[object.Key]; renamed {
+			continue
+		}
+
+		key := source.relKey(strings.TrimPrefix(object.Key, prefix))
+		if strings.HasPrefix(key, copyManifestPrefix) {
+			continue
+		}
+		if objectKey := s3.KeyPrefix(key); objectKey != object.Key {
+			renames[object.Key] = objectKey
+			objectKeys = append(objectKeys, object.Key)
+		}
+	}
+
+	for i, objectKey := range objectKeys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := s3.renameObject(ctx, objectKey, renames[objectKey]); err != nil {
+			return fmt.Errorf("renaming %s: %v", s3.logKey(objectKey), err)
+		}
+		manifest.Copied[renames[objectKey]] = objectKey
+
+		// saved after every rename, as a renamed object left out of the
+		// manifest would be encoded twice when resuming
+		if err := s3.storeCopyManifest(ctx, manifestKey, manifest); err != nil {
+			return fmt.Errorf("saving key encoding manifest: %v", err)
+		}
+
+		report(progress, objectKey, i+1, len(objectKeys))
+	}
+
+	manifest.Finished = time.Now()
+	if err := s3.storeCopyManifest(ctx, manifestKey, manifest); err != nil {
+		return fmt.Errorf("saving key encoding manifest: %v", err)
+	}
+
+	return nil
+}
+
+// renameObject copies the object at src to dst on the server, with its
+// metadata and tags, and deletes src.
+func (s3 S3) renameObject(ctx context.Context, src, dst string) error {
+	return s3.do(ctx, "rename", func() error {
+		return s3.copyAndRemove(ctx, src, dst)
+	})
+}
+
+// copyAndRemove is a single attempt of renameObject.
+func (s3 S3) copyAndRemove(ctx context.Context, src, dst string) error {
+	source := minio.CopySrcOptions{Bucket: s3.Bucket, Object: src}
+	dest := minio.CopyDestOptions{Bucket: s3.Bucket, Object: dst}
+	if s3.sse != nil {
+		source.Encryption = encrypt.SSECopy(s3.sse)
+		dest.Encryption = s3.sse
+	}
+
+	if _, err := s3.client().CopyObject(ctx, dest, source); err != nil {
+		return err
+	}
+	return s3.client().RemoveObject(ctx, s3.Bucket, src, minio.RemoveObjectOptions{})
+}
+
+func encodeKeysFlags(fs *flag.FlagSet) {
+	fs.String("from", "", "Key encoding the objects are stored with now: percent, base32 or empty for none")
+	configFlags(fs)
+}
+
+func cmdEncodeKeys(fl caddycmd.Flags) (int, error) {
+	storage, err := loadStorageConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s3, err := provisionStorage(ctx, storage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	err = s3.EncodeKeys(ctx, fl.String("from"), func(p Progress) {
+		fmt.Printf("renamed %s (%d/%d)\n", p.Key, p.Done, p.Total)
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
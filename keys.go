@@ -0,0 +1,209 @@
+package certmagic_s3
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Key classes, telling apart the kinds of data certmagic keeps in storage.
+const (
+	ClassCertificate = "certificate"
+	ClassPrivateKey  = "private_key"
+	ClassMetadata    = "metadata"
+	ClassAccount     = "account"
+	ClassOCSP        = "ocsp"
+	ClassLock        = "lock"
+	ClassTrash       = "trash"
+	ClassArchive     = "archive"
+	ClassOther       = "other"
+)
+
+// Key prefixes of the module's own data classes.
+const (
+	trashPrefix   = ".trash/"
+	archivePrefix = ".archive/"
+	uploadPrefix  = ".uploads/"
+
+	copyManifestPrefix = ".copies/"
+)
+
+var keyClasses = []string{ClassCertificate, ClassPrivateKey, ClassMetadata, ClassAccount, ClassOCSP, ClassLock, ClassTrash, ClassArchive, ClassOther}
+
+func validKeyClass(class string) bool {
+	for _, c := range keyClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// keyClass returns the class of a certmagic key.
+func keyClass(key string) string {
+	switch {
+	case isCertificateKey(key):
+		switch path.Ext(key) {
+		case ".crt":
+			return ClassCertificate
+		case ".key":
+			return ClassPrivateKey
+		default:
+			return ClassMetadata
+		}
+	case isAccountKey(key):
+		return ClassAccount
+	case strings.HasPrefix(key, "ocsp/"):
+		return ClassOCSP
+	case strings.HasPrefix(key, "locks/"):
+		return ClassLock
+	case strings.HasPrefix(key, trashPrefix):
+		return ClassTrash
+	case strings.HasPrefix(key, archivePrefix):
+		return ClassArchive
+	}
+	return ClassOther
+}
+
+// matchKey reports whether key matches pattern. A pattern without a slash
+// matches the file name, one with a slash matches the key or any of its
+// parent directories.
+func matchKey(pattern, key string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(key))
+		return ok
+	}
+
+	for k := key; k != "." && k != "/"; k = path.Dir(k) {
+		if ok, _ := path.Match(pattern, k); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKey rejects keys that could reach outside the prefix once joined
+// with it, or that no object can be named after: empty keys, keys with a
+// leading slash, with . or .. segments, or with control characters.
+func (s3 S3) checkKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidKey)
+	}
+	return s3.checkPrefix(key)
+}
+
+// checkPrefix is checkKey for the prefixes of listings, which may be
+// empty.
+func (s3 S3) checkPrefix(prefix string) error {
+	var problem string
+
+	switch {
+	case prefix == "":
+		return nil
+	case strings.HasPrefix(prefix, "/"):
+		problem = "leading slash"
+	case !utf8.ValidString(prefix):
+		problem = "not UTF-8"
+	}
+	for _, segment := range strings.Split(prefix, "/") {
+		if segment == "." || segment == ".." {
+			problem = segment + " segment"
+		}
+	}
+	for _, r := range prefix {
+		if unicode.IsControl(r) {
+			problem = "control character"
+		}
+	}
+
+	if problem != "" {
+		return fmt.Errorf("%w %q: %s", ErrInvalidKey, s3.logKey(prefix), problem)
+	}
+	return nil
+}
+
+// keyDomain returns the domain name a key belongs to, if any. Wildcard
+// names are stored as "wildcard_.example.com" and returned as "*.example.com".
+func keyDomain(key string) string {
+	var name string
+
+	switch {
+	case isCertificateKey(key):
+		name = strings.Split(key, "/")[2]
+	case strings.HasPrefix(key, "ocsp/"):
+		// ocsp/<name>-<hash>
+		name = strings.TrimPrefix(key, "ocsp/")
+		i := strings.LastIndex(name, "-")
+		if i < 0 {
+			return ""
+		}
+		name = name[:i]
+	default:
+		return ""
+	}
+
+	if strings.HasPrefix(name, "wildcard_") {
+		name = "*" + strings.TrimPrefix(name, "wildcard_")
+	}
+
+	return name
+}
+
+// KeyFilter selects keys by the domain they belong to and their class.
+// Domains are globs such as "*.example.com"; keys that don't belong to a
+// domain, like accounts, never match a domain filter. An empty filter
+// matches every key.
+type KeyFilter struct {
+	Domains []string `json:"domains,omitempty"`
+	Classes []string `json:"classes,omitempty"`
+}
+
+// Match reports whether key is selected by the filter.
+func (f KeyFilter) Match(key string) bool {
+	if len(f.Classes) > 0 {
+		class := keyClass(key)
+
+		var ok bool
+		for _, c := range f.Classes {
+			if c == class {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(f.Domains) > 0 {
+		domain := keyDomain(key)
+		if domain == "" {
+			return false
+		}
+
+		for _, glob := range f.Domains {
+			if ok, _ := path.Match(strings.ToLower(glob), domain); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// isCertificateKey reports whether key is a site asset,
+// i.e. certificates/<issuer>/<site>/<file>.
+func isCertificateKey(key string) bool {
+	parts := strings.Split(key, "/")
+	return len(parts) == 4 && parts[0] == "certificates"
+}
+
+// isAccountKey reports whether key belongs to an ACME account,
+// i.e. acme/<ca>/users/<email>/<file>.
+func isAccountKey(key string) bool {
+	parts := strings.Split(key, "/")
+	return len(parts) == 5 && parts[0] == "acme" && parts[2] == "users"
+}
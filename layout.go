@@ -0,0 +1,105 @@
+package certmagic_s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// Object layouts, i.e. where the object of a key is under the prefix.
+const (
+	// layoutHierarchical keeps the key as the object key, the default.
+	layoutHierarchical = "hierarchical"
+
+	// layoutFlat keeps all objects right below the prefix, named after a
+	// hash of the key followed by the escaped key, so writes spread over
+	// the partitions of the bucket.
+	layoutFlat = "flat"
+
+	// layoutSharded keeps the key below two levels of directories named
+	// after a hash of it, for buckets with a huge number of keys.
+	layoutSharded = "sharded"
+)
+
+// layoutHashLen is how many hex digits of the hash name flat objects.
+const layoutHashLen = 16
+
+func validLayout(layout string) bool {
+	switch layout {
+	case "", layoutHierarchical, layoutFlat, layoutSharded:
+		return true
+	}
+	return false
+}
+
+func (s3 S3) hierarchical() bool {
+	return s3.Layout == "" || s3.Layout == layoutHierarchical
+}
+
+// layoutExempt reports whether key is kept hierarchically in any layout,
+// like the module's own data, which is listed by directory.
+func layoutExempt(key string) bool {
+	return key != "" && (strings.HasPrefix(key, ".") || isInternalKey(key))
+}
+
+// scans reports whether listing the directory dir means listing every
+// object under the prefix and picking the keys below dir, as the layout
+// doesn't keep the keys of a directory together.
+func (s3 S3) scans(dir string) bool {
+	return !s3.hierarchical() && !layoutExempt(dir)
+}
+
+// physicalKey returns the object key of key relative to the prefix, with
+// the key encoding and layout applied.
+func (s3 S3) physicalKey(key string) string {
+	encoded := s3.encodeKey(key)
+	if key == "" || s3.hierarchical() || layoutExempt(key) {
+		return encoded
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+
+	switch s3.Layout {
+	case layoutFlat:
+		return hash[:layoutHashLen] + "-" + url.PathEscape(encoded)
+	case layoutSharded:
+		return hash[:2] + "/" + hash[2:4] + "/" + encoded
+	}
+	return encoded
+}
+
+// logicalKey reverses physicalKey.
+func (s3 S3) logicalKey(rel string) string {
+	return s3.decodeKey(s3.unlayoutKey(rel))
+}
+
+// unlayoutKey returns the encoded key of the object key rel. Object keys
+// not in the layout, like those exempt from it, are returned as they are.
+func (s3 S3) unlayoutKey(rel string) string {
+	switch s3.Layout {
+	case layoutFlat:
+		if len(rel) > layoutHashLen && rel[layoutHashLen] == '-' && isHex(rel[:layoutHashLen]) && !strings.Contains(rel, "/") {
+			if key, err := url.PathUnescape(rel[layoutHashLen+1:]); err == nil {
+				return key
+			}
+		}
+	case layoutSharded:
+		parts := strings.SplitN(rel, "/", 3)
+		if len(parts) == 3 && len(parts[0]) == 2 && len(parts[1]) == 2 && isHex(parts[0]+parts[1]) {
+			return parts[2]
+		}
+	}
+	return rel
+}
+
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,72 @@
+package certmagic_s3
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// lazyRetry is how often connecting is retried in the background while the
+// endpoint can't be reached.
+var lazyRetry = Retry{
+	Base:   caddy.Duration(time.Second),
+	Max:    caddy.Duration(time.Minute),
+	Jitter: jitterEqual,
+}
+
+// lazyConnect defers connecting to the endpoint, for lazy_provision, until
+// the first storage call or a background attempt succeeds.
+type lazyConnect struct {
+	mu        sync.Mutex
+	connected bool
+	connect   func() error
+}
+
+func (l *lazyConnect) ensure() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.connected {
+		return nil
+	}
+	if err := l.connect(); err != nil {
+		return fmt.Errorf("connecting to S3: %v", err)
+	}
+	l.connected = true
+
+	return nil
+}
+
+// ready connects to the endpoint if that was deferred and hasn't succeeded
+// yet. Everything using the client must call it first.
+func (s3 S3) ready() error {
+	if s3.lazy == nil {
+		return nil
+	}
+	return s3.lazy.ensure()
+}
+
+// connectInBackground tries to connect until it succeeds or ctx is done, so
+// the first storage call doesn't have to wait for it.
+func (s3 S3) connectInBackground(ctx context.Context) {
+	for attempt := 1; ; attempt++ {
+		err := s3.lazy.ensure()
+		if err == nil {
+			return
+		}
+
+		delay := lazyRetry.backoff(attempt)
+
+		s3.logger.Warn("connecting failed, retrying", zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package certmagic_s3
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"go.uber.org/zap"
+)
+
+// lifecycleRulePrefix starts the IDs of the lifecycle rules the module
+// manages, which are replaced on every start. Other rules are kept.
+const lifecycleRulePrefix = "caddy-s3-storage-"
+
+// Lifecycle installs bucket lifecycle rules under the prefix, so S3 expires
+// what the module would otherwise have to clean up itself, even while no
+// Caddy runs: the trash after TrashDays, by default the retention of the
+// trash class rounded up to days, lock objects left behind by crashed
+// instances after LockDays, and incomplete multipart uploads after
+// UploadDays, both 1 by default.
+type Lifecycle struct {
+	TrashDays  int `json:"trash_days"`
+	LockDays   int `json:"lock_days"`
+	UploadDays int `json:"upload_days"`
+}
+
+func (config Lifecycle) validate() error {
+	if config.TrashDays < 0 || config.LockDays < 0 || config.UploadDays < 0 {
+		return fmt.Errorf("lifecycle trash_days, lock_days and upload_days can't be negative")
+	}
+	return nil
+}
+
+// lifecycleRules returns the rules to install.
+func (s3 S3) lifecycleRules() []lifecycle.Rule {
+	root := s3.listPrefix("")
+	ruleID := func(kind string) string {
+		if root == "" {
+			return lifecycleRulePrefix + kind
+		}
+		return lifecycleRulePrefix + kind + "-" + strings.TrimSuffix(root, "/")
+	}
+
+	days := func(configured, fallback int) lifecycle.ExpirationDays {
+		if configured > 0 {
+			return lifecycle.ExpirationDays(configured)
+		}
+		return lifecycle.ExpirationDays(fallback)
+	}
+
+	rules := []lifecycle.Rule{
+		{
+			ID:         ruleID("locks"),
+			Status:     "Enabled",
+			RuleFilter: lifecycle.Filter{Prefix: s3.KeyPrefix("locks") + "/"},
+			Expiration: lifecycle.Expiration{Days: days(s3.Lifecycle.LockDays, 1)},
+		},
+		{
+			ID:                             ruleID("uploads"),
+			Status:                         "Enabled",
+			RuleFilter:                     lifecycle.Filter{Prefix: root},
+			AbortIncompleteMultipartUpload: lifecycle.AbortIncompleteMultipartUpload{DaysAfterInitiation: days(s3.Lifecycle.UploadDays, 1)},
+		},
+	}
+
+	trashDays := s3.Lifecycle.TrashDays
+	if trashDays == 0 {
+		if retention := s3.retentionFor(ClassTrash); retention > 0 {
+			trashDays = int((retention + 24*time.Hour - 1) / (24 * time.Hour))
+		}
+	}
+	if trashDays > 0 {
+		rules = append(rules, lifecycle.Rule{
+			ID:         ruleID("trash"),
+			Status:     "Enabled",
+			RuleFilter: lifecycle.Filter{Prefix: s3.KeyPrefix(strings.TrimSuffix(trashPrefix, "/")) + "/"},
+			Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(trashDays)},
+		})
+	}
+
+	return rules
+}
+
+// installLifecycle replaces the lifecycle rules of the module in the
+// bucket's lifecycle configuration, keeping the other rules. Failing to is
+// logged, as providers without lifecycle support can still store.
+func (s3 S3) installLifecycle(ctx context.Context) {
+	err := s3.do(ctx, "lifecycle", func() error {
+		config, err := s3.client().GetBucketLifecycle(ctx, s3.Bucket)
+		switch {
+		case minio.ToErrorResponse(err).Code == "NoSuchLifecycleConfiguration":
+			config = lifecycle.NewConfiguration()
+		case err != nil:
+			return err
+		}
+
+		rules := s3.lifecycleRules()
+		replaced := make(map[string]bool, len(rules))
+		for _, rule := range rules {
+			replaced[rule.ID] = true
+		}
+
+		kept := config.Rules[:0]
+		for _, rule := range config.Rules {
+			if !replaced[rule.ID] {
+				kept = append(kept, rule)
+			}
+		}
+		config.Rules = append(kept, rules...)
+
+		return s3.client().SetBucketLifecycle(ctx, s3.Bucket, config)
+	})
+	if err != nil {
+		s3.logger.Warn("unable to install lifecycle rules", zap.String("bucket", s3.Bucket), zap.Error(s3.explainError(err)))
+		return
+	}
+
+	s3.logger.Info("installed lifecycle rules", zap.String("bucket", s3.Bucket))
+}
@@ -0,0 +1,400 @@
+package certmagic_s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// listDeadlineMargin is how much time before the deadline a partial listing
+// stops, leaving the caller time to use what it got.
+const listDeadlineMargin = 5 * time.Second
+
+// keyLister turns listed objects into keys the way certmagic's file system
+// storage lists them: without trailing slashes, right below prefix unless
+// recursive, and with every directory on the way when recursive.
+// Directories are the common prefixes S3 returns, and the key prefixes of
+// the objects.
+type keyLister struct {
+	prefix       string
+	objectPrefix string
+	recursive    bool
+
+	// lastDir is the directory of the previous object. Listings are sorted,
+	// so the directories it is in were listed already.
+	lastDir string
+
+	// decode turns object keys back into keys, if they are encoded
+	decode func(key string) string
+
+	// skip drops objects listed by the listers of tenants instead
+	skip func(objectKey string) bool
+
+	// scan is set when every object under the prefix is listed, as the
+	// layout doesn't keep directories together, and only the keys within
+	// are picked. Keys come unsorted then, and directories repeatedly.
+	scan   bool
+	within string
+}
+
+func newKeyLister(prefix, objectPrefix string, recursive bool) *keyLister {
+	return &keyLister{prefix: prefix, objectPrefix: objectPrefix, recursive: recursive}
+}
+
+// listPrefix is the object key prefix of the directory key, or of all
+// objects if the layout doesn't keep the directory together.
+func (s3 S3) listPrefix(key string) string {
+	if s3.scans(key) {
+		key = ""
+	}
+	prefix := s3.KeyPrefix(key)
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+func (s3 S3) newKeyLister(prefix string, recursive bool) *keyLister {
+	lister := newKeyLister(prefix, s3.listPrefix(prefix), recursive)
+	lister.decode = s3.logicalKey
+	if lister.objectPrefix == s3.listPrefix("") {
+		// the root holds the objects of tenants too
+		lister.decode = s3.relKey
+	}
+	if s3.scans(prefix) {
+		lister.scan = true
+		if prefix != "" {
+			lister.within = prefix + "/"
+		}
+	}
+	return lister
+}
+
+func (l *keyLister) options() minio.ListObjectsOptions {
+	return minio.ListObjectsOptions{
+		Prefix:    l.objectPrefix,
+		Recursive: l.recursive || l.scan,
+	}
+}
+
+// keys returns the keys to list for the object or common prefix.
+func (l *keyLister) keys(objectKey string) []string {
+	if l.skip != nil && l.skip(objectKey) {
+		return nil
+	}
+	isDir := strings.HasSuffix(objectKey, "/")
+	rel := strings.TrimSuffix(strings.TrimPrefix(objectKey, l.objectPrefix), "/")
+	if rel == "" {
+		return nil
+	}
+	if l.decode != nil {
+		rel = l.decode(rel)
+	}
+	if l.scan {
+		if !strings.HasPrefix(rel, l.within) {
+			return nil
+		}
+		rel = strings.TrimPrefix(rel, l.within)
+	}
+
+	if !l.recursive {
+		if i := strings.Index(rel, "/"); i >= 0 {
+			rel = rel[:i]
+		}
+		return []string{path.Join(l.prefix, rel)}
+	}
+
+	dir, file := rel, ""
+	if !isDir {
+		dir, file = path.Dir(rel), rel
+	}
+	if dir == "." {
+		dir = ""
+	}
+
+	var keys []string
+	if dir != "" {
+		parts := strings.Split(dir, "/")
+		for i := range parts {
+			parent := strings.Join(parts[:i+1], "/")
+			if parent == l.lastDir || strings.HasPrefix(l.lastDir, parent+"/") {
+				continue
+			}
+			keys = append(keys, path.Join(l.prefix, parent))
+		}
+	}
+	l.lastDir = dir
+
+	if file != "" {
+		keys = append(keys, path.Join(l.prefix, file))
+	}
+	return keys
+}
+
+// keyListers returns the listers of the directory prefix: that of the
+// directory itself, followed by those of the directory in every tenant.
+func (s3 S3) keyListers(prefix string, recursive bool) []*keyLister {
+	lister := s3.newKeyLister(prefix, recursive)
+	listers := []*keyLister{lister}
+	for _, objectPrefix := range s3.tenantListPrefixes(prefix) {
+		tenantLister := newKeyLister(prefix, objectPrefix, recursive)
+		tenantLister.decode = s3.logicalKey
+		listers = append(listers, tenantLister)
+		lister.skip = s3.inTenant
+	}
+	return listers
+}
+
+// Walk calls fn for the keys List would return, as the listing streams in
+// page by page, so the keys of huge buckets don't have to be held in memory.
+// Listing stops at the first error, which is returned, be it of S3, of fn or
+// of ctx.
+func (s3 S3) Walk(ctx context.Context, prefix string, recursive bool, fn func(key string) error) error {
+	if err := s3.checkPrefix(prefix); err != nil {
+		return err
+	}
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutList)
+	defer cancel()
+
+	listers := s3.keyListers(prefix, recursive)
+
+	// a scan, or a listing in several parts, collects the keys to sort them
+	// and drop repeated directories
+	collect := listers[0].scan || len(listers) > 1
+	emit := fn
+	scanned := make(map[string]bool)
+	if collect {
+		emit = func(key string) error {
+			scanned[key] = true
+			return nil
+		}
+	}
+
+	var fnErr error
+	var listed bool
+
+	for _, lister := range listers {
+		lister := lister
+		opts := lister.options()
+
+		err := s3.do(ctx, "list", func() error {
+			listCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			for object := range s3.listBucket(listCtx, opts) {
+				if object.Err != nil {
+					return object.Err
+				}
+				// a retry resumes after the keys passed to fn already
+				if object.Key == opts.StartAfter {
+					continue
+				}
+				opts.StartAfter = object.Key
+
+				keys := lister.keys(object.Key)
+				if len(keys) > 0 || !lister.scan && lister.skip == nil {
+					listed = true
+				}
+
+				for _, key := range keys {
+					if fnErr = emit(key); fnErr != nil {
+						return nil
+					}
+				}
+			}
+
+			// minio ends the listing without an error when ctx is done
+			return ctx.Err()
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		if err != nil {
+			return s3.storageError("list", prefix, err)
+		}
+	}
+
+	if collect {
+		keys := make([]string, 0, len(scanned))
+		for key := range scanned {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	// like listing a directory that doesn't exist
+	if !listed && prefix != "" && !s3.Exists(ctx, prefix) {
+		return fs.ErrNotExist
+	}
+
+	return nil
+}
+
+// isDirectory reports whether there are objects below key, in the storage
+// or in a tenant.
+func (s3 S3) isDirectory(ctx context.Context, key string) (bool, error) {
+	var found bool
+
+	for _, prefix := range append([]string{s3.listPrefix(key)}, s3.tenantListPrefixes(key)...) {
+		prefix := prefix
+		err := s3.do(ctx, "list", func() error {
+			listCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			for object := range s3.listBucket(listCtx, minio.ListObjectsOptions{
+				Prefix:  prefix,
+				MaxKeys: 1,
+			}) {
+				if object.Err != nil {
+					return object.Err
+				}
+				found = true
+				break
+			}
+			return nil
+		})
+		if found || err != nil {
+			return found, err
+		}
+	}
+
+	return false, nil
+}
+
+// ListPage is like List, but starts after the position continueAfter and,
+// as the deadline of ctx approaches, returns the keys listed so far and the
+// position to continue after instead of failing. next is empty once the
+// listing is complete. Sweeps over huge buckets make progress this way, one
+// deadline at a time. The keys of the tenants follow those of the directory
+// itself, and a directory may be listed again on the next page.
+func (s3 S3) ListPage(ctx context.Context, prefix string, recursive bool, continueAfter string) (keys []string, next string, err error) {
+	if err := s3.checkPrefix(prefix); err != nil {
+		return nil, "", err
+	}
+	if err := s3.ready(); err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := s3.withTimeout(withPriority(ctx, priorityMaintenance), timeoutList)
+	defer cancel()
+
+	// positions are object keys below the storage prefix, so that they
+	// can tell directories from files. With the tenants listed too, they
+	// start with the number of the lister, as the listing of the directory
+	// itself passes the objects of the tenants below it.
+	root := s3.listPrefix("")
+
+	listers := s3.keyListers(prefix, recursive)
+
+	start, startAfter := 0, ""
+	if continueAfter != "" {
+		startAfter = root + continueAfter
+		if len(listers) > 1 {
+			parts := strings.SplitN(continueAfter, ":", 2)
+			n, err := strconv.Atoi(parts[0])
+			if len(parts) != 2 || err != nil || n < 0 || n >= len(listers) {
+				return nil, "", fmt.Errorf("invalid position %q to continue the listing of %s after", continueAfter, s3.logKey(prefix))
+			}
+			start, startAfter = n, root+parts[1]
+		}
+	}
+
+	dedupe := listers[0].scan || len(listers) > 1
+	seen := make(map[string]bool)
+
+	for i := start; i < len(listers); i++ {
+		lister := listers[i]
+		opts := lister.options()
+		if i == start && startAfter != "" {
+			opts.StartAfter = listStartAfter(startAfter, opts.Recursive)
+			lister.keys(startAfter)
+		}
+
+		err = s3.do(ctx, "list", func() error {
+			var err error
+			next, err = s3.listPage(ctx, opts, func(object minio.ObjectInfo) error {
+				// a retry resumes after the keys listed already
+				opts.StartAfter = listStartAfter(object.Key, opts.Recursive)
+
+				for _, key := range lister.keys(object.Key) {
+					if dedupe && seen[key] {
+						continue
+					}
+					seen[key] = true
+					keys = append(keys, key)
+				}
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			return keys, "", s3.storageError("list", prefix, err)
+		}
+		if next != "" {
+			next = strings.TrimPrefix(next, root)
+			if len(listers) > 1 {
+				next = strconv.Itoa(i) + ":" + next
+			}
+			return keys, next, nil
+		}
+	}
+
+	return keys, "", nil
+}
+
+// listStartAfter is where a listing continues after objectKey. Listings
+// that aren't recursive would list a common prefix again after itself, so
+// they continue after every key below it.
+func listStartAfter(objectKey string, recursive bool) string {
+	if !recursive && strings.HasSuffix(objectKey, "/") {
+		return objectKey + string(utf8.MaxRune)
+	}
+	return objectKey
+}
+
+// listPage calls fn for the objects listed with opts. When the deadline of
+// ctx approaches, it stops and returns the object key to continue after.
+func (s3 S3) listPage(ctx context.Context, opts minio.ListObjectsOptions, fn func(minio.ObjectInfo) error) (string, error) {
+	deadline, hasDeadline := ctx.Deadline()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var last string
+
+	for object := range s3.listBucket(ctx, opts) {
+		if object.Err != nil {
+			if last != "" && errors.Is(object.Err, context.DeadlineExceeded) {
+				return last, nil
+			}
+			return "", object.Err
+		}
+
+		if err := fn(object); err != nil {
+			return "", err
+		}
+		last = object.Key
+
+		if hasDeadline && time.Until(deadline) < listDeadlineMargin {
+			return last, nil
+		}
+	}
+
+	return "", nil
+}
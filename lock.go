@@ -0,0 +1,557 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+const (
+	lockPollInterval      = 1 * time.Second
+	lockFreshnessInterval = 5 * time.Second
+	lockSettleDelay       = 500 * time.Millisecond
+
+	// How long Unlock waits for the writes of an issuance to be readable.
+	issuanceVerifyTimeout = 10 * time.Second
+)
+
+type lockMeta struct {
+	Owner   string    `json:"owner"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+
+	// of the lock object it was read from
+	etag string
+}
+
+func (meta lockMeta) stale() bool {
+	return time.Since(meta.lastUpdate()) > lockFreshnessInterval*2
+}
+
+func (meta lockMeta) lastUpdate() time.Time {
+	if meta.Updated.IsZero() {
+		return meta.Created
+	}
+	return meta.Updated
+}
+
+// lockSet keeps track of the locks this instance holds, keyed by lock name.
+type lockSet struct {
+	mu    sync.Mutex
+	locks map[string]*heldLock
+}
+
+type heldLock struct {
+	owner string
+	done  chan struct{}
+
+	// keys written under the lock, with the SHA-256 of the objects, if
+	// verify_issuance is on
+	mu      sync.Mutex
+	written map[string]string
+}
+
+func (lock *heldLock) recordWrite(key, sum string) {
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+	if lock.written == nil {
+		lock.written = make(map[string]string)
+	}
+	lock.written[key] = sum
+}
+
+func (lock *heldLock) writes() map[string]string {
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+	written := make(map[string]string, len(lock.written))
+	for key, sum := range lock.written {
+		written[key] = sum
+	}
+	return written
+}
+
+func newLockSet() *lockSet {
+	return &lockSet{locks: make(map[string]*heldLock)}
+}
+
+func (set *lockSet) add(name string, lock *heldLock) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.locks[name] = lock
+}
+
+func (set *lockSet) get(name string) *heldLock {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return set.locks[name]
+}
+
+func (set *lockSet) remove(name string) *heldLock {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	lock := set.locks[name]
+	delete(set.locks, name)
+	return lock
+}
+
+// drop removes lock if it's still the one held as name.
+func (set *lockSet) drop(name string, lock *heldLock) bool {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if set.locks[name] != lock {
+		return false
+	}
+	delete(set.locks, name)
+	return true
+}
+
+func (set *lockSet) snapshot() map[string]*heldLock {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	locks := make(map[string]*heldLock, len(set.locks))
+	for name, lock := range set.locks {
+		locks[name] = lock
+	}
+	return locks
+}
+
+func (s3 S3) Lock(ctx context.Context, key string) (err error) {
+	ctx, span := s3.startSpan(ctx, "lock", "locks/"+key)
+	defer func() { endSpan(span, err) }()
+
+	for {
+		acquired, err := s3.TryLock(ctx, key)
+		if err != nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// TryLock acquires the lock for key if it is free or stale, but does not
+// wait for another instance to release it.
+func (s3 S3) TryLock(ctx context.Context, key string) (acquired bool, err error) {
+	ctx, span := s3.startSpan(ctx, "try_lock", "locks/"+key)
+	defer func() { endSpan(span, err) }()
+
+	if err := s3.checkKey(key); err != nil {
+		return false, err
+	}
+	defer func() {
+		// waiting for a held lock isn't worth a record
+		if acquired || err != nil {
+			s3.audit("lock", key, 0, err)
+		}
+	}()
+	if err := s3.ready(); err != nil {
+		return false, err
+	}
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutLock)
+	defer cancel()
+
+	objectKey := s3.lockObjectKey(key)
+
+	meta, err := s3.loadLockMeta(ctx, objectKey)
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return false, fmt.Errorf("accessing lock %s: %v", s3.logKey("locks/"+key), err)
+	case meta.stale():
+		s3.log(logLocks).Info("taking over stale lock", s3.keyField(objectKey), zap.Time("created", meta.Created), zap.Time("updated", meta.Updated))
+	default:
+		return false, nil
+	}
+
+	acquire := s3.tryAcquireLock
+	if !s3.conditionalWrites() {
+		acquire = s3.tryAcquireCandidateLock
+	}
+	owner, err := acquire(ctx, objectKey, meta.etag)
+	if err != nil {
+		return false, fmt.Errorf("creating lock %s: %v", s3.logKey("locks/"+key), err)
+	}
+	if owner == "" {
+		// another instance won the race
+		return false, nil
+	}
+
+	lock := &heldLock{owner: owner, done: make(chan struct{})}
+	s3.locks.add(key, lock)
+	go s3.keepLockFresh(objectKey, lock)
+
+	s3.log(logLocks).Debug("lock", s3.keyField(objectKey))
+
+	return true, nil
+}
+
+func (s3 S3) Unlock(ctx context.Context, key string) (err error) {
+	ctx, span := s3.startSpan(ctx, "unlock", "locks/"+key)
+	defer func() { endSpan(span, err) }()
+	defer func() { s3.audit("unlock", key, 0, err) }()
+
+	if err := s3.ready(); err != nil {
+		return err
+	}
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutLock)
+	defer cancel()
+
+	lock := s3.locks.get(key)
+	if lock == nil {
+		return fmt.Errorf("lock %s is not held by this instance", s3.logKey("locks/"+key))
+	}
+
+	// verify while the lock is still held and kept fresh, but release it
+	// either way
+	verifyErr := s3.verifyWrites(ctx, lock)
+
+	s3.locks.remove(key)
+	close(lock.done)
+
+	objectKey := s3.lockObjectKey(key)
+
+	meta, err := s3.loadLockMeta(ctx, objectKey)
+	if err != nil {
+		return fmt.Errorf("accessing lock %s: %v", s3.logKey("locks/"+key), err)
+	}
+	if meta.Owner != lock.owner {
+		return fmt.Errorf("lock %s was taken over by another instance", s3.logKey("locks/"+key))
+	}
+
+	s3.log(logLocks).Debug("unlock", s3.keyField(objectKey))
+
+	err = s3.do(ctx, "lock_delete", func() error {
+		return s3.client().RemoveObject(ctx, s3.Bucket, objectKey, minio.RemoveObjectOptions{})
+	})
+	if err != nil {
+		return err
+	}
+
+	return verifyErr
+}
+
+// verifyWrites reads back the keys written under lock until they all have
+// the content written, and makes sure no certificate is left without its
+// private key. With a sync mirror, the mirrored copies are read back too;
+// an async mirror may not have taken them yet, so they aren't. It gives up
+// after issuanceVerifyTimeout.
+func (s3 S3) verifyWrites(ctx context.Context, lock *heldLock) error {
+	written := lock.writes()
+	if len(written) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, issuanceVerifyTimeout)
+	defer cancel()
+
+	for key, sum := range written {
+		if strings.HasSuffix(key, ".crt") {
+			privateKey := strings.TrimSuffix(key, ".crt") + ".key"
+			if _, ok := written[privateKey]; !ok {
+				err := s3.do(ctx, "stat", func() error {
+					_, err := s3.client().StatObject(ctx, s3.Bucket, s3.KeyPrefix(privateKey), s3.getObjectOptions())
+					return err
+				})
+				if err != nil {
+					return fmt.Errorf("verifying issuance: %s has no private key: %v", s3.logKey(key), err)
+				}
+			}
+		}
+
+		if err := retryVerify(ctx, func() error { return s3.verifyWrite(ctx, key, sum) }); err != nil {
+			return fmt.Errorf("verifying issuance: %s is not readable: %v", s3.logKey(key), err)
+		}
+
+		if s3.mirror != nil && s3.mirror.sync {
+			if err := retryVerify(ctx, func() error { return s3.mirror.verify(ctx, key, sum) }); err != nil {
+				return fmt.Errorf("verifying issuance: %s is not readable from the mirror: %v", s3.logKey(key), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// retryVerify calls verify every lockPollInterval until it succeeds or ctx
+// is done, and returns its last error then.
+func retryVerify(ctx context.Context, verify func() error) error {
+	for {
+		err := verify()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (s3 S3) verifyWrite(ctx context.Context, key, sum string) error {
+	var contents []byte
+	err := s3.do(ctx, "load", func() error {
+		object, err := s3.client().GetObject(ctx, s3.Bucket, s3.KeyPrefix(key), s3.getObjectOptions())
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		contents, err = ioutil.ReadAll(object)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if sha256Hex(contents) != sum {
+		return errors.New("content differs from what was written")
+	}
+
+	return nil
+}
+
+// RenewLockLease refreshes a lock held by this instance right away. Locks
+// are kept fresh in the background anyway, so the lease duration is not
+// needed.
+func (s3 S3) RenewLockLease(ctx context.Context, key string, leaseDuration time.Duration) error {
+	if err := s3.ready(); err != nil {
+		return err
+	}
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutLock)
+	defer cancel()
+
+	lock := s3.locks.get(key)
+	if lock == nil {
+		return fmt.Errorf("lock %s is not held by this instance", s3.logKey("locks/"+key))
+	}
+
+	objectKey := s3.lockObjectKey(key)
+
+	meta, err := s3.loadLockMeta(ctx, objectKey)
+	if err != nil {
+		return fmt.Errorf("accessing lock %s: %v", s3.logKey("locks/"+key), err)
+	}
+	if meta.Owner != lock.owner {
+		return fmt.Errorf("lock %s was taken over by another instance", s3.logKey("locks/"+key))
+	}
+
+	meta.Updated = time.Now()
+
+	return s3.storeLockMeta(ctx, objectKey, meta, meta.etag)
+}
+
+// tryAcquireLock writes a new lock object over the stale one with etag, or
+// where there is none if etag is empty, and reads it back after a short
+// delay. It returns an empty owner if a concurrent writer got there first
+// or replaced it. The write is conditional, reading back covers endpoints
+// that ignore the condition.
+func (s3 S3) tryAcquireLock(ctx context.Context, objectKey, etag string) (string, error) {
+	owner, err := newLockOwner()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = s3.storeLockMeta(ctx, objectKey, lockMeta{Owner: owner, Created: now, Updated: now}, etag)
+	if errorKind(err) == ErrPreconditionFailed {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case <-time.After(lockSettleDelay):
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	meta, err := s3.loadLockMeta(ctx, objectKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if meta.Owner != owner {
+		return "", nil
+	}
+
+	return owner, nil
+}
+
+// keepLockFresh updates the lock object every lockFreshnessInterval until
+// the lock is released or it is no longer owned by this instance.
+func (s3 S3) keepLockFresh(objectKey string, lock *heldLock) {
+	ticker := time.NewTicker(lockFreshnessInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := s3.withTimeout(context.Background(), timeoutLock)
+
+		meta, err := s3.loadLockMeta(ctx, objectKey)
+		if err == nil && meta.Owner != lock.owner {
+			err = errors.New("lock was taken over by another instance")
+		}
+		if err == nil {
+			meta.Updated = time.Now()
+			err = s3.storeLockMeta(ctx, objectKey, meta, meta.etag)
+		}
+		cancel()
+		if err != nil {
+			s3.log(logLocks).Error("keeping lock fresh failed, terminating lock maintenance", append(s3.errorFields(err), s3.keyField(objectKey), zap.Error(err))...)
+			return
+		}
+	}
+}
+
+// checkFence verifies that this instance still owns the locks covering a
+// critical write. Writes that are not covered by a lock held here pass.
+func (s3 S3) checkFence(ctx context.Context, key string) error {
+	var names []string
+
+	held := s3.locks.snapshot()
+
+	switch {
+	case isCertificateKey(key):
+		names = issuanceLocks(held, key)
+	case isAccountKey(key):
+		// account keys are written from within an issuance, but we can't
+		// tell which one, so every lock held here must still be ours
+		for name := range held {
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range names {
+		meta, err := s3.loadLockMeta(ctx, s3.lockObjectKey(name))
+		if err != nil {
+			return fmt.Errorf("refusing to write %s, unable to verify lock %s: %v", s3.logKey(key), s3.logKey("locks/"+name), err)
+		}
+		if meta.Owner != held[name].owner {
+			return fmt.Errorf("refusing to write %s, lock %s is no longer held by this instance", s3.logKey(key), s3.logKey("locks/"+name))
+		}
+	}
+
+	return nil
+}
+
+// issuanceLocks returns the names of the locks in held that cover the
+// issuance of the certificate key belongs to.
+func issuanceLocks(held map[string]*heldLock, key string) []string {
+	var names []string
+
+	site := strings.Split(key, "/")[2]
+	for name := range held {
+		domain := strings.TrimPrefix(name, "issue_cert_")
+		if strings.HasPrefix(name, "issue_cert_") && certmagic.StorageKeys.Safe(domain) == site {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func (s3 S3) lockObjectKey(key string) string {
+	return s3.KeyPrefix(path.Join("locks", certmagic.StorageKeys.Safe(key)+".lock"))
+}
+
+func (s3 S3) loadLockMeta(ctx context.Context, objectKey string) (lockMeta, error) {
+	var meta lockMeta
+	var info minio.ObjectInfo
+	var contents []byte
+
+	err := s3.do(ctx, "lock_load", func() error {
+		object, err := s3.client().GetObject(ctx, s3.Bucket, objectKey, s3.getObjectOptions())
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		info, err = object.Stat()
+		if err != nil {
+			if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+				return fs.ErrNotExist
+			}
+			return err
+		}
+
+		contents, err = ioutil.ReadAll(object)
+		return err
+	})
+	if err != nil {
+		return meta, err
+	}
+
+	err = json.Unmarshal(contents, &meta)
+	if err != nil {
+		return meta, fmt.Errorf("decoding lock contents: %v", err)
+	}
+	meta.etag = info.ETag
+
+	return meta, nil
+}
+
+// storeLockMeta writes the lock object, if it still has etag, or doesn't
+// exist if etag is empty. Without conditional writes, it writes it anyway.
+func (s3 S3) storeLockMeta(ctx context.Context, objectKey string, meta lockMeta, etag string) error {
+	contents, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	opts := s3.putObjectOptions()
+	opts.ContentType = "application/json"
+	opts.DisableMultipart = true
+	opts.UserTags = s3.objectTags("locks/")
+
+	putCtx := ctx
+	if s3.conditionalWrites() {
+		putCtx = withCondition(ctx, ifMatch(etag))
+	}
+
+	return s3.do(ctx, "lock_store", func() error {
+		_, err := s3.client().PutObject(putCtx, s3.Bucket, objectKey, bytes.NewReader(contents), int64(len(contents)), opts)
+		return err
+	})
+}
+
+func newLockOwner() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
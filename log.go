@@ -0,0 +1,123 @@
+package certmagic_s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Modes for LogKeys.
+const (
+	logKeysFull     = "full"
+	logKeysHash     = "hash"
+	logKeysTruncate = "truncate"
+)
+
+func validLogKeys(mode string) bool {
+	switch mode {
+	case "", logKeysFull, logKeysHash, logKeysTruncate:
+		return true
+	}
+	return false
+}
+
+// logKey renders an object key for logging. Keys embed domain names and
+// account emails, so they can be hashed or truncated to their key class.
+func (s3 S3) logKey(key string) string {
+	switch s3.LogKeys {
+	case logKeysHash:
+		sum := sha256.Sum256([]byte(key))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	case logKeysTruncate:
+		return s3.truncateKey(key)
+	}
+	return key
+}
+
+// truncateKey keeps the prefix and the key class (plus the issuer for
+// certificates and accounts) and drops everything that names a site.
+func (s3 S3) truncateKey(key string) string {
+	prefix := cleanPrefix(s3.Prefix)
+
+	rest := strings.TrimPrefix(key, prefix)
+	rest = strings.TrimPrefix(rest, "/")
+
+	parts := strings.Split(rest, "/")
+
+	keep := 1
+	if parts[0] == "certificates" || parts[0] == "acme" {
+		keep = 2
+	}
+	if len(parts) <= keep {
+		return key
+	}
+
+	return strings.TrimSuffix(key, rest) + strings.Join(parts[:keep], "/") + "/..."
+}
+
+// Log categories, with loggers of their own named after them, whose levels
+// can be raised with LogLevels.
+const (
+	// the per-key debug output of the storage operations
+	logOperations = "operations"
+	// acquiring, refreshing and releasing locks
+	logLocks = "locks"
+	// cache invalidations by bucket notifications
+	logCache = "cache"
+	// failed S3 requests, retries, throttling, failover and the circuit
+	// breaker
+	logRequests = "requests"
+)
+
+var logCategories = []string{logOperations, logLocks, logCache, logRequests}
+
+// provisionLoggers sets up the loggers of the categories. Their levels can
+// only be raised above the level of the Caddy log.
+func (s3 *S3) provisionLoggers() error {
+	for category := range s3.LogLevels {
+		if !validLogCategory(category) {
+			return fmt.Errorf("invalid log_levels category %q: must be one of %s", category, strings.Join(logCategories, ", "))
+		}
+	}
+
+	s3.loggers = make(map[string]*zap.Logger, len(logCategories))
+	for _, category := range logCategories {
+		logger := s3.logger.Named(category).With(zap.String("bucket", s3.Bucket))
+		if value, ok := s3.LogLevels[category]; ok {
+			var level zapcore.Level
+			if err := level.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("invalid log_levels level %q of %s: %v", value, category, err)
+			}
+			logger = logger.WithOptions(zap.IncreaseLevel(level))
+		}
+		s3.loggers[category] = logger
+	}
+
+	return nil
+}
+
+func validLogCategory(category string) bool {
+	for _, c := range logCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// log returns the logger of category.
+func (s3 S3) log(category string) *zap.Logger {
+	if logger, ok := s3.loggers[category]; ok {
+		return logger
+	}
+	return s3.logger
+}
+
+// keyField is the log field of an object key, rendered by logKey.
+func (s3 S3) keyField(key string) zap.Field {
+	return zap.String("key", s3.logKey(key))
+}
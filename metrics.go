@@ -0,0 +1,156 @@
+package certmagic_s3
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	metricsPrometheus = "prometheus"
+	metricsStatsD     = "statsd"
+	metricsOTLP       = "otlp"
+)
+
+// metricsBackend receives the measurements of the storage.
+type metricsBackend interface {
+	// observeDuration records the duration of an operation. traceID is
+	// empty unless it ran within a sampled trace.
+	observeDuration(operation, result string, seconds float64, traceID string)
+	setCircuitState(state circuitState)
+	// setMirrorLag records how long the oldest write waits for the mirror.
+	setMirrorLag(seconds float64)
+	countMirrorError(operation string)
+	// countCollected counts an object of class garbage collection deleted.
+	countCollected(class string)
+}
+
+func validMetricsBackend(backend string) bool {
+	switch backend {
+	case "", metricsPrometheus, metricsStatsD, metricsOTLP:
+		return true
+	}
+	return false
+}
+
+func newMetricsBackend(ctx context.Context, backend, endpoint string, logger *zap.Logger) (metricsBackend, error) {
+	switch backend {
+	case metricsStatsD:
+		return newStatsDBackend(endpoint)
+	case metricsOTLP:
+		b := newOTLPBackend(endpoint, logger)
+		go b.run(ctx)
+		return b, nil
+	}
+	if endpoint != "" {
+		return nil, fmt.Errorf("metrics_endpoint is not used with the prometheus metrics backend, Caddy serves the metrics")
+	}
+	return prometheusBackend{}, nil
+}
+
+// define and register the metrics used in this package.
+func init() {
+	const ns, sub = "caddy", "storage_s3"
+
+	s3Metrics.operationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "operation_duration_seconds",
+		Help:      "Histogram of the duration of S3 storage operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+
+	s3Metrics.circuitState = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "circuit_breaker_state",
+		Help:      "State of the circuit breaker: 0 closed, 1 open, 2 probing.",
+	})
+
+	s3Metrics.mirrorLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "mirror_lag_seconds",
+		Help:      "How long the oldest write has been waiting for the mirror bucket.",
+	})
+
+	s3Metrics.mirrorErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "mirror_errors_total",
+		Help:      "Counter of writes the mirror bucket failed or that found the queue full.",
+	}, []string{"operation"})
+
+	s3Metrics.gcDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "gc_deleted_total",
+		Help:      "Counter of objects garbage collection deleted, by key class.",
+	}, []string{"class"})
+}
+
+var s3Metrics = struct {
+	operationDuration *prometheus.HistogramVec
+	circuitState      prometheus.Gauge
+	mirrorLag         prometheus.Gauge
+	mirrorErrors      *prometheus.CounterVec
+	gcDeleted         *prometheus.CounterVec
+}{}
+
+// prometheusBackend records the metrics in the registry Caddy serves.
+type prometheusBackend struct{}
+
+func (prometheusBackend) observeDuration(operation, result string, seconds float64, traceID string) {
+	observer := s3Metrics.operationDuration.WithLabelValues(operation, result)
+
+	if traceID != "" {
+		if exemplarObserver, ok := observer.(prometheus.ExemplarObserver); ok {
+			exemplarObserver.ObserveWithExemplar(seconds, prometheus.Labels{"trace_id": traceID})
+			return
+		}
+	}
+
+	observer.Observe(seconds)
+}
+
+func (prometheusBackend) setCircuitState(state circuitState) {
+	s3Metrics.circuitState.Set(float64(state))
+}
+
+func (prometheusBackend) setMirrorLag(seconds float64) {
+	s3Metrics.mirrorLag.Set(seconds)
+}
+
+func (prometheusBackend) countMirrorError(operation string) {
+	s3Metrics.mirrorErrors.WithLabelValues(operation).Inc()
+}
+
+func (prometheusBackend) countCollected(class string) {
+	s3Metrics.gcDeleted.WithLabelValues(class).Inc()
+}
+
+// observe records the duration of an operation. If the context carries a
+// sampled trace, the trace ID is attached as exemplar so a slow operation
+// can be looked up in the tracing backend.
+func (s3 S3) observe(ctx context.Context, operation string, start time.Time, err error) {
+	if s3.meter == nil {
+		return
+	}
+
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	var traceID string
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsSampled() {
+		traceID = spanContext.TraceID().String()
+	}
+
+	s3.meter.observeDuration(operation, result, time.Since(start).Seconds(), traceID)
+}
@@ -0,0 +1,345 @@
+package certmagic_s3
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/certmagic"
+	"github.com/minio/minio-go/v7"
+)
+
+// Progress describes how far a bulk operation got. Total is zero when the
+// number of keys is not known up front, as when importing from a stream.
+type Progress struct {
+	Key   string
+	Done  int
+	Total int
+}
+
+// ProgressFunc is called after each key a bulk operation has handled.
+type ProgressFunc func(Progress)
+
+// Export writes every key under the prefix selected by filter to w as a
+// tar archive.
+func (s3 S3) Export(ctx context.Context, w io.Writer, filter KeyFilter, progress ProgressFunc) error {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	all, err := s3.objectKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, key := range all {
+		if filter.Match(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		info, err := s3.Stat(ctx, key)
+		if s3.staleListing(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("exporting %s: %v", key, err)
+		}
+
+		value, err := s3.Load(ctx, key)
+		if s3.staleListing(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("exporting %s: %v", key, err)
+		}
+
+		err = tw.WriteHeader(&tar.Header{
+			Name:    key,
+			Mode:    0600,
+			Size:    int64(len(value)),
+			ModTime: info.Modified,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(value); err != nil {
+			return err
+		}
+
+		report(progress, key, i+1, len(keys))
+	}
+
+	return tw.Close()
+}
+
+// Import stores every file of the tar archive read from r.
+func (s3 S3) Import(ctx context.Context, r io.Reader, progress ProgressFunc) error {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	tr := tar.NewReader(r)
+
+	for done := 0; ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		value, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("importing %s: %v", header.Name, err)
+		}
+
+		if err := s3.Store(ctx, header.Name, value); err != nil {
+			return fmt.Errorf("importing %s: %v", header.Name, err)
+		}
+
+		done++
+		report(progress, header.Name, done, 0)
+	}
+}
+
+// instanceIDKey is where Caddy keeps the ID of the instance in its data
+// directory. It belongs to the instance, so it isn't migrated.
+const instanceIDKey = "instance.uuid"
+
+// Migrate copies every key of src, e.g. a certmagic.FileStorage, into s3.
+// Each key is read back from the bucket and compared with the original by
+// its SHA-256, so a migration that returns no error is complete.
+func (s3 S3) Migrate(ctx context.Context, src certmagic.Storage, progress ProgressFunc) error {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	keys, err := listKeys(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if key == instanceIDKey {
+			continue
+		}
+
+		value, err := src.Load(ctx, key)
+		if err != nil {
+			return fmt.Errorf("migrating %s: %v", key, err)
+		}
+
+		if err := s3.Store(ctx, key, value); err != nil {
+			return fmt.Errorf("migrating %s: %v", key, err)
+		}
+
+		// past the read cache, which holds what was just stored
+		stored, _, err := s3.loadObject(ctx, key)
+		if err != nil {
+			return fmt.Errorf("verifying %s: %v", key, err)
+		}
+		if sha256.Sum256(stored) != sha256.Sum256(value) {
+			return fmt.Errorf("verifying %s: the stored value differs from the original", key)
+		}
+
+		report(progress, key, i+1, len(keys))
+	}
+
+	return nil
+}
+
+// CleanupMigrated deletes the keys of src that have been migrated, i.e.
+// that are present in s3 with the same value. Anything else is left in
+// place.
+func (s3 S3) CleanupMigrated(ctx context.Context, src certmagic.Storage, progress ProgressFunc) error {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	keys, err := listKeys(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		value, err := src.Load(ctx, key)
+		if err != nil {
+			return fmt.Errorf("cleaning up %s: %v", key, err)
+		}
+
+		migrated, err := s3.Load(ctx, key)
+		if err == nil && string(migrated) == string(value) {
+			if err := src.Delete(ctx, key); err != nil {
+				return fmt.Errorf("cleaning up %s: %v", key, err)
+			}
+		}
+
+		report(progress, key, i+1, len(keys))
+	}
+
+	return nil
+}
+
+// objectKeys lists the keys of all objects under the prefix, leaving out
+// locks and other objects internal to this module.
+func (s3 S3) objectKeys(ctx context.Context) ([]string, error) {
+	var keys []string
+
+	err := s3.listObjects(ctx, func(key string, object minio.ObjectInfo) {
+		keys = append(keys, key)
+	})
+
+	return keys, err
+}
+
+// objectETags is like objectKeys, but maps the keys to their ETags.
+func (s3 S3) objectETags(ctx context.Context) (map[string]string, error) {
+	etags := make(map[string]string)
+
+	err := s3.listObjects(ctx, func(key string, object minio.ObjectInfo) {
+		etags[key] = object.ETag
+	})
+
+	return etags, err
+}
+
+func (s3 S3) listObjects(ctx context.Context, fn func(key string, object minio.ObjectInfo)) error {
+	if err := s3.ready(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	prefix := s3.listPrefix("")
+
+	for object := range s3.listBucket(ctx, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			return object.Err
+		}
+
+		key := s3.CutKeyPrefix(object.Key)
+		if isInternalKey(key) {
+			continue
+		}
+
+		fn(key, object)
+	}
+
+	return nil
+}
+
+// listKeys lists every terminal key of storage, leaving out locks.
+func listKeys(ctx context.Context, storage certmagic.Storage) ([]string, error) {
+	list, err := storage.List(ctx, "", true)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+
+	for _, key := range list {
+		if isInternalKey(key) {
+			continue
+		}
+
+		info, err := storage.Stat(ctx, key)
+		if s3, ok := storage.(S3); ok && s3.staleListing(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsTerminal {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func isInternalKey(key string) bool {
+	return key == "" || key == sseCheckKey || key == "locks" || strings.HasPrefix(key, "locks/") ||
+		strings.HasPrefix(key, budgetPrefix+"/") || strings.HasPrefix(key, copyManifestPrefix) ||
+		strings.HasPrefix(key, auditPrefix)
+}
+
+func report(progress ProgressFunc, key string, done, total int) {
+	if progress != nil {
+		progress(Progress{Key: key, Done: done, Total: total})
+	}
+}
+
+func migrateFlags(fs *flag.FlagSet) {
+	fs.String("from", caddy.AppDataDir(), "Caddy data directory of the file_system storage to migrate")
+	fs.Bool("cleanup", false, "Delete the migrated keys from the data directory afterwards")
+	configFlags(fs)
+}
+
+func cmdMigrate(fl caddycmd.Flags) (int, error) {
+	from := fl.String("from")
+
+	storage, err := loadStorageConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s3, err := provisionStorage(ctx, storage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	src := &certmagic.FileStorage{Path: from}
+
+	err = s3.Migrate(ctx, src, func(p Progress) {
+		fmt.Printf("migrated %s (%d/%d)\n", p.Key, p.Done, p.Total)
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if !fl.Bool("cleanup") {
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	err = s3.CleanupMigrated(ctx, src, func(p Progress) {
+		fmt.Printf("cleaned up %s (%d/%d)\n", p.Key, p.Done, p.Total)
+	})
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
@@ -0,0 +1,387 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+const (
+	mirrorSync  = "sync"
+	mirrorAsync = "async"
+
+	defaultMirrorQueueSize = 1000
+)
+
+// Mirror is a second bucket every Store and Delete is repeated in, for
+// disaster recovery. Its connection fields are those of the primary, so
+// the promote command can swap them. In sync mode, Store and Delete fail
+// when the mirror fails; in async mode, the default, writes are queued and
+// retried until the mirror takes them. Once QueueSize writes are queued,
+// Store and Delete wait for room in the queue.
+type Mirror struct {
+	Host           string `json:"host"`
+	Bucket         string `json:"bucket"`
+	Region         string `json:"region"`
+	AccessID       string `json:"access_id"`
+	SecretKey      string `json:"secret_key"`
+	AccessIDFile   string `json:"access_id_file"`
+	SecretKeyFile  string `json:"secret_key_file"`
+	SessionToken   string `json:"session_token"`
+	Prefix         string `json:"prefix"`
+	Insecure       bool   `json:"insecure"`
+	UseIamProvider bool   `json:"use_iam_provider"`
+
+	Mode      string `json:"mode"`
+	QueueSize int    `json:"queue_size,omitempty"`
+}
+
+// mirrorWrite is a write waiting for the mirror. value is nil for deletes,
+// and directory is set for deletes of keys that weren't objects, which
+// delete the keys below them too. seq numbers the writes in the order they
+// are queued.
+type mirrorWrite struct {
+	seq       uint64
+	key       string
+	value     []byte
+	checksum  string
+	delete    bool
+	directory bool
+	queued    time.Time
+}
+
+type mirror struct {
+	client *minio.Client
+	bucket string
+	// layout has the prefix of the mirror along with the key encoding,
+	// layout and tenants of the primary, so its object keys are those the
+	// primary has below the prefix
+	layout    S3
+	sync      bool
+	queueSize int
+	logger    *zap.Logger
+	logKey    func(key string) string
+	meter     metricsBackend
+
+	mu    sync.Mutex
+	queue []mirrorWrite
+	seq   uint64
+	wake  chan struct{}
+	room  chan struct{} // closed when a write leaves the queue
+}
+
+func (s3 S3) newMirror() (*mirror, error) {
+	config := s3.Mirror
+
+	switch config.Mode {
+	case "", mirrorSync, mirrorAsync:
+	default:
+		return nil, fmt.Errorf("invalid mirror mode %q: must be sync or async", config.Mode)
+	}
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("mirror requires a bucket")
+	}
+	if config.Host == "" {
+		config.Host = s3.Host
+	}
+	if config.Host == s3.Host && config.Bucket == s3.Bucket && cleanPrefix(config.Prefix) == cleanPrefix(s3.Prefix) {
+		return nil, fmt.Errorf("mirror must be a different bucket or prefix than the primary")
+	}
+
+	connection := S3{
+		Host:           config.Host,
+		Bucket:         config.Bucket,
+		Region:         config.Region,
+		AccessID:       config.AccessID,
+		SecretKey:      config.SecretKey,
+		AccessIDFile:   config.AccessIDFile,
+		SecretKeyFile:  config.SecretKeyFile,
+		SessionToken:   config.SessionToken,
+		Insecure:       config.Insecure,
+		UseIamProvider: config.UseIamProvider,
+		logger:         s3.logger.Named("mirror"),
+	}
+
+	creds, err := connection.newCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("mirror: %v", err)
+	}
+
+	// a transport of its own, as the TLS and proxy settings of the primary
+	// are those of its endpoint
+	transport, err := connection.newTransport()
+	if err != nil {
+		return nil, fmt.Errorf("mirror: %v", err)
+	}
+
+	client, err := minio.New(config.Host, &minio.Options{
+		Creds:     creds,
+		Secure:    !config.Insecure,
+		Region:    config.Region,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("mirror: %v", err)
+	}
+
+	m := &mirror{
+		client:    client,
+		bucket:    config.Bucket,
+		layout:    S3{Prefix: cleanPrefix(config.Prefix), KeyEncoding: s3.KeyEncoding, Layout: s3.Layout, Tenants: s3.Tenants},
+		sync:      config.Mode == mirrorSync,
+		queueSize: config.QueueSize,
+		logger:    connection.logger,
+		logKey:    s3.logKey,
+		meter:     s3.meter,
+		wake:      make(chan struct{}, 1),
+		room:      make(chan struct{}),
+	}
+	if m.queueSize <= 0 {
+		m.queueSize = defaultMirrorQueueSize
+	}
+
+	return m, nil
+}
+
+// store repeats the write of value to key in the mirror. A nil mirror has
+// nothing to do.
+func (m *mirror) store(ctx context.Context, key string, value []byte, checksum string) error {
+	if m == nil {
+		return nil
+	}
+	return m.submit(ctx, mirrorWrite{key: key, value: value, checksum: checksum, queued: time.Now()})
+}
+
+// delete repeats the deletion of key in the mirror, and of the keys below
+// it if it was a directory in the primary.
+func (m *mirror) delete(ctx context.Context, key string, directory bool) error {
+	if m == nil {
+		return nil
+	}
+	return m.submit(ctx, mirrorWrite{key: key, delete: true, directory: directory, queued: time.Now()})
+}
+
+// load reads key from the mirror, verified by the SHA-256 it was written
+// with. A nil mirror has nothing to read.
+func (m *mirror) load(ctx context.Context, key string) ([]byte, error) {
+	if m == nil {
+		return nil, errors.New("no mirror is configured")
+	}
+
+	object, err := m.client.GetObject(ctx, m.bucket, m.layout.KeyPrefix(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+
+	info, err := object.Stat()
+	if err != nil {
+		return nil, err
+	}
+	value, err := ioutil.ReadAll(object)
+	if err != nil {
+		return nil, err
+	}
+
+	if expected := info.UserMetadata[checksumMetadata]; expected != "" && sha256Hex(value) != expected {
+		return nil, checksumMismatchError{key: m.logKey(key), algorithm: "sha256", expected: expected, actual: sha256Hex(value)}
+	}
+
+	return value, nil
+}
+
+// verify makes sure the mirror holds key with the SHA-256 sum.
+func (m *mirror) verify(ctx context.Context, key, sum string) error {
+	value, err := m.load(ctx, key)
+	if err != nil {
+		return err
+	}
+	if sha256Hex(value) != sum {
+		return errors.New("content differs from what was written")
+	}
+	return nil
+}
+
+func (m *mirror) submit(ctx context.Context, write mirrorWrite) error {
+	if m.sync {
+		if err := m.write(ctx, write); err != nil {
+			m.countError(write)
+			return fmt.Errorf("mirroring %s: %v", m.logKey(write.key), err)
+		}
+		return nil
+	}
+
+	m.mu.Lock()
+	for len(m.queue) >= m.queueSize {
+		room := m.room
+		m.mu.Unlock()
+
+		select {
+		case <-room:
+		case <-ctx.Done():
+			m.countError(write)
+			m.logger.Error("mirror queue is full", zap.String("key", m.logKey(write.key)), zap.Int("queued", m.queued()))
+			return fmt.Errorf("mirroring %s: queue is full: %v", m.logKey(write.key), ctx.Err())
+		}
+
+		m.mu.Lock()
+	}
+	m.seq++
+	write.seq = m.seq
+	m.queue = append(m.queue, write)
+	m.mu.Unlock()
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// queued returns how many writes wait for the mirror.
+func (m *mirror) queued() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queue)
+}
+
+// dequeued makes room for the writes waiting for the queue. m.mu must be
+// held.
+func (m *mirror) dequeued() {
+	close(m.room)
+	m.room = make(chan struct{})
+}
+
+func (m *mirror) write(ctx context.Context, write mirrorWrite) error {
+	key := m.layout.KeyPrefix(write.key)
+
+	if write.delete {
+		if err := m.client.RemoveObject(ctx, m.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return err
+		}
+		if !write.directory || path.Clean("/"+write.key) == "/" {
+			return nil
+		}
+		return m.deleteDirectory(ctx, write.key)
+	}
+
+	opts := minio.PutObjectOptions{UserMetadata: map[string]string{checksumMetadata: write.checksum}, SendContentMd5: true}
+	_, err := m.client.PutObject(ctx, m.bucket, key, bytes.NewReader(write.value), int64(len(write.value)), opts)
+	return err
+}
+
+// deleteDirectory deletes the keys below key in the mirror, in every
+// tenant, like the primary does.
+func (m *mirror) deleteDirectory(ctx context.Context, key string) error {
+	prefix := m.layout.listPrefix(key)
+
+	var match func(objectKey string) bool
+	if m.layout.scans(key) {
+		match = func(objectKey string) bool {
+			return strings.HasPrefix(m.layout.relKey(strings.TrimPrefix(objectKey, prefix)), key+"/")
+		}
+	}
+
+	for _, prefix := range append([]string{prefix}, m.layout.tenantListPrefixes(key)...) {
+		if err := removePrefix(ctx, m.client, m.bucket, prefix, defaultCapabilities, match, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mirror) countError(write mirrorWrite) {
+	if m.meter == nil {
+		return
+	}
+	operation := "store"
+	if write.delete {
+		operation = "delete"
+	}
+	m.meter.countMirrorError(operation)
+}
+
+// run writes the queued writes to the mirror in order until ctx is done,
+// retrying each until the mirror takes it.
+func (m *mirror) run(ctx context.Context) {
+	for {
+		m.mu.Lock()
+		if len(m.queue) == 0 {
+			m.mu.Unlock()
+			m.setLag(0)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.wake:
+			}
+			continue
+		}
+		write := m.queue[0]
+		m.mu.Unlock()
+
+		for attempt := 1; ; attempt++ {
+			m.setLag(time.Since(write.queued))
+
+			writeCtx, cancel := context.WithTimeout(ctx, defaultTimeouts[timeoutWrite])
+			err := m.write(writeCtx, write)
+			cancel()
+			if err == nil {
+				break
+			}
+
+			m.countError(write)
+			m.logger.Error("mirroring", append(errorFields(m.client.EndpointURL().Host, err), zap.String("key", m.logKey(write.key)), zap.Int("attempt", attempt), zap.Error(err))...)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(lazyRetry.backoff(attempt)):
+			}
+		}
+
+		m.mu.Lock()
+		if len(m.queue) > 0 && m.queue[0].seq == write.seq {
+			// unless flush took the queue meanwhile
+			m.queue = m.queue[1:]
+			m.dequeued()
+		}
+		m.mu.Unlock()
+	}
+}
+
+// flush writes the queued writes to the mirror once each, in order, until
+// one fails or ctx is done, and returns how many were left unwritten.
+func (m *mirror) flush(ctx context.Context) int {
+	m.mu.Lock()
+	queue := m.queue
+	m.queue = nil
+	m.dequeued()
+	m.mu.Unlock()
+
+	for i, write := range queue {
+		if err := m.write(ctx, write); err != nil {
+			m.countError(write)
+			m.logger.Error("mirroring", append(errorFields(m.client.EndpointURL().Host, err), zap.String("key", m.logKey(write.key)), zap.Error(err))...)
+			return len(queue) - i
+		}
+	}
+	m.setLag(0)
+	return 0
+}
+
+func (m *mirror) setLag(lag time.Duration) {
+	if m.meter != nil {
+		m.meter.setMirrorLag(lag.Seconds())
+	}
+}
@@ -0,0 +1,216 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+const (
+	multipartPartSize = 16 << 20
+
+	// Multipart uploads left incomplete for longer than this are aborted,
+	// so their parts stop accruing storage charges.
+	abandonedUploadAge      = 24 * time.Hour
+	abandonedUploadInterval = time.Hour
+)
+
+// ExportObject writes the tar archive of Export to the object key under the
+// prefix, e.g. "snapshots/2022-06-01.tar". Pick a key certmagic doesn't use.
+// Like Export, keys encrypted at rest are written decrypted.
+//
+// The archive is uploaded in parts. If the upload is interrupted, calling
+// ExportObject again resumes it and only uploads the parts that changed.
+func (s3 S3) ExportObject(ctx context.Context, key string, filter KeyFilter, progress ProgressFunc) error {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	f, err := ioutil.TempFile("", "certmagic-s3-export-*.tar")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := s3.Export(ctx, f, filter, progress); err != nil {
+		return err
+	}
+
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	return s3.putMultipart(ctx, s3.KeyPrefix(key), f, size)
+}
+
+// putMultipart uploads r to object in parts. The upload ID is kept nowhere
+// but in the bucket: an interrupted upload of object is found again by
+// listing its incomplete uploads, and parts already there with the same MD5
+// are skipped. With SSE-C the part ETags aren't MD5 sums, so every part is
+// uploaded again. Providers without multipart uploads take r in one PUT.
+func (s3 S3) putMultipart(ctx context.Context, object string, r io.ReaderAt, size int64) error {
+	if err := s3.ready(); err != nil {
+		return err
+	}
+
+	if !s3.multipartUploads() {
+		err := s3.do(ctx, "store", func() error {
+			_, err := s3.client().PutObject(ctx, s3.Bucket, object, io.NewSectionReader(r, 0, size), size, s3.putObjectOptions())
+			return err
+		})
+		return s3.explainError(err)
+	}
+
+	uploadID, uploaded, err := s3.pendingUpload(ctx, object)
+	if err != nil {
+		return err
+	}
+
+	if uploadID == "" {
+		err = s3.do(ctx, "upload_start", func() error {
+			var err error
+			uploadID, err = s3.core().NewMultipartUpload(ctx, s3.Bucket, object, s3.putObjectOptions())
+			return err
+		})
+		if err != nil {
+			return s3.explainError(err)
+		}
+	} else {
+		s3.logger.Info("resuming upload", s3.keyField(object), zap.Int("parts", len(uploaded)))
+	}
+
+	var parts []minio.CompletePart
+	buf := make([]byte, multipartPartSize)
+
+	for number, offset := 1, int64(0); offset < size || number == 1; number, offset = number+1, offset+multipartPartSize {
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		data := buf[:n]
+
+		sum := md5.Sum(data)
+		etag := hex.EncodeToString(sum[:])
+
+		if part, ok := uploaded[number]; ok && part.Size == int64(n) && strings.Trim(part.ETag, `"`) == etag {
+			parts = append(parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+			continue
+		}
+
+		var part minio.ObjectPart
+		err = s3.do(ctx, "upload_part", func() error {
+			var err error
+			part, err = s3.core().PutObjectPart(ctx, s3.Bucket, object, uploadID, number, bytes.NewReader(data), int64(n), base64.StdEncoding.EncodeToString(sum[:]), "", s3.sse)
+			return err
+		})
+		if err != nil {
+			return s3.explainError(err)
+		}
+
+		parts = append(parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+	}
+
+	err = s3.do(ctx, "upload_complete", func() error {
+		_, err := s3.core().CompleteMultipartUpload(ctx, s3.Bucket, object, uploadID, parts, s3.putObjectOptions())
+		return err
+	})
+
+	return s3.explainError(err)
+}
+
+// pendingUpload returns the most recent incomplete upload of object and its
+// parts, or an empty upload ID if there is none.
+func (s3 S3) pendingUpload(ctx context.Context, object string) (string, map[int]minio.ObjectPart, error) {
+	core := s3.core()
+
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var latest minio.ObjectMultipartInfo
+
+	for upload := range core.ListIncompleteUploads(listCtx, s3.Bucket, object, false) {
+		if upload.Err != nil {
+			return "", nil, upload.Err
+		}
+		if upload.Key == object && upload.Initiated.After(latest.Initiated) {
+			latest = upload
+		}
+	}
+
+	if latest.UploadID == "" {
+		return "", nil, nil
+	}
+
+	parts := make(map[int]minio.ObjectPart)
+
+	for marker := 0; ; {
+		result, err := core.ListObjectParts(ctx, s3.Bucket, object, latest.UploadID, marker, 1000)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, part := range result.ObjectParts {
+			parts[part.PartNumber] = part
+		}
+		if !result.IsTruncated {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+
+	return latest.UploadID, parts, nil
+}
+
+// abortAbandonedUploads periodically aborts the multipart uploads under the
+// prefix that were started long ago and never completed, until ctx is done.
+func (s3 S3) abortAbandonedUploads(ctx context.Context) {
+	ticker := time.NewTicker(abandonedUploadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s3.abortAbandoned(ctx); err != nil {
+			s3.logger.Error("aborting abandoned uploads", append(s3.errorFields(err), zap.Error(err))...)
+		}
+	}
+}
+
+func (s3 S3) abortAbandoned(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	prefix := s3.listPrefix("")
+
+	core := s3.core()
+
+	for upload := range core.ListIncompleteUploads(ctx, s3.Bucket, prefix, true) {
+		if upload.Err != nil {
+			return upload.Err
+		}
+		if time.Since(upload.Initiated) < abandonedUploadAge {
+			continue
+		}
+
+		if err := core.AbortMultipartUpload(ctx, s3.Bucket, upload.Key, upload.UploadID); err != nil {
+			return err
+		}
+
+		s3.logger.Info("aborted abandoned upload", s3.keyField(upload.Key), zap.Time("initiated", upload.Initiated))
+	}
+
+	return nil
+}
@@ -0,0 +1,234 @@
+package certmagic_s3
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"go.uber.org/zap"
+)
+
+// notificationEvents are the bucket events that invalidate cached keys.
+var notificationEvents = []string{"s3:ObjectCreated:*", "s3:ObjectRemoved:*"}
+
+// invalidateObject drops the key of an object another instance wrote or
+// deleted from the read cache.
+func (s3 S3) invalidateObject(objectKey string) {
+	if !strings.HasPrefix(objectKey, s3.listPrefix("")) {
+		return
+	}
+
+	s3.cache.invalidate(s3.CutKeyPrefix(objectKey))
+}
+
+// listenNotifications invalidates the cached keys of the objects written
+// or deleted in the bucket, as MinIO reports them, until ctx is done. The
+// listener reconnects after errors.
+func (s3 S3) listenNotifications(ctx context.Context) {
+	prefix := s3.listPrefix("")
+
+	for attempt := 1; ; attempt++ {
+		for info := range s3.client().ListenBucketNotification(ctx, s3.Bucket, prefix, "", notificationEvents) {
+			if info.Err != nil {
+				s3.log(logCache).Error("listening for bucket notifications", append(s3.errorFields(info.Err), zap.Error(info.Err))...)
+				break
+			}
+			attempt = 1
+
+			for _, record := range info.Records {
+				s3.invalidateEvent(record)
+			}
+		}
+
+		delay := lazyRetry.backoff(attempt)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (s3 S3) invalidateEvent(event notification.Event) {
+	if event.S3.Bucket.Name != s3.Bucket {
+		return
+	}
+
+	// keys in events are URL encoded
+	objectKey, err := url.QueryUnescape(event.S3.Object.Key)
+	if err != nil {
+		return
+	}
+
+	s3.log(logCache).Debug("notification", zap.String("event", event.EventName), s3.keyField(objectKey))
+
+	s3.invalidateObject(objectKey)
+}
+
+// NotificationHandler receives bucket notifications over HTTP, to
+// invalidate the read cache of the storage of this Caddy instance when
+// other instances write. It takes S3 events delivered through an SNS HTTP
+// subscription, confirming the subscription, as well as events posted by
+// MinIO webhook targets. Requests must carry the token as token query
+// parameter, which SNS can't send as header.
+type NotificationHandler struct {
+	Token string `json:"token,omitempty"`
+
+	storage S3
+	client  *http.Client
+	logger  *zap.Logger
+}
+
+func init() {
+	caddy.RegisterModule(NotificationHandler{})
+	httpcaddyfile.RegisterHandlerDirective("s3_storage_notifications", parseNotificationHandler)
+}
+
+func (NotificationHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.s3_storage_notifications",
+		New: func() caddy.Module {
+			return new(NotificationHandler)
+		},
+	}
+}
+
+func (h *NotificationHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "token":
+				if !d.AllArgs(&h.Token) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("Invalid usage of s3_storage_notifications: unrecognized option %s", d.Val())
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseNotificationHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	handler := new(NotificationHandler)
+	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	return handler, err
+}
+
+func (h *NotificationHandler) Provision(ctx caddy.Context) error {
+	if h.Token == "" {
+		h.Token = os.Getenv("S3_NOTIFICATIONS_TOKEN")
+	}
+	if h.Token == "" {
+		return errors.New("s3_storage_notifications requires a token")
+	}
+
+	storage, ok := ctx.Storage().(S3)
+	if !ok {
+		return errors.New("s3_storage_notifications requires the s3 storage")
+	}
+	if storage.cache == nil {
+		return errors.New("s3_storage_notifications requires the s3 storage to have a cache")
+	}
+
+	h.storage = storage
+	h.client = &http.Client{Timeout: 10 * time.Second}
+	h.logger = ctx.Logger(h)
+
+	return nil
+}
+
+// snsMessage is the envelope SNS posts to HTTP subscriptions.
+type snsMessage struct {
+	Type         string
+	Message      string
+	SubscribeURL string
+	TopicArn     string
+}
+
+func (h NotificationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(h.Token)) != 1 {
+		return caddyhttp.Error(http.StatusUnauthorized, errors.New("invalid notification token"))
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	var message snsMessage
+	if err := json.Unmarshal(body, &message); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	switch message.Type {
+	case "SubscriptionConfirmation":
+		if err := h.confirm(message); err != nil {
+			return caddyhttp.Error(http.StatusBadGateway, err)
+		}
+	case "Notification":
+		body = []byte(message.Message)
+		fallthrough
+	case "":
+		var events struct {
+			Records []notification.Event
+		}
+		if err := json.Unmarshal(body, &events); err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+		for _, event := range events.Records {
+			h.storage.invalidateEvent(event)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// confirm confirms an SNS subscription by visiting its SubscribeURL, which
+// must be one of SNS.
+func (h NotificationHandler) confirm(message snsMessage) error {
+	subscribeURL, err := url.Parse(message.SubscribeURL)
+	if err != nil {
+		return err
+	}
+	if subscribeURL.Scheme != "https" || !strings.HasPrefix(subscribeURL.Hostname(), "sns.") || !strings.HasSuffix(subscribeURL.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("refusing to confirm subscription at %s", subscribeURL.Hostname())
+	}
+
+	resp, err := h.client.Get(subscribeURL.String())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("confirming subscription: %s", resp.Status)
+	}
+
+	h.logger.Info("confirmed subscription", zap.String("topic_arn", message.TopicArn))
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*NotificationHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*NotificationHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*NotificationHandler)(nil)
+)
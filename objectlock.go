@@ -0,0 +1,66 @@
+package certmagic_s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// ObjectLock makes the storage work on buckets with S3 Object Lock, which
+// keep every version of an object until its retention ends. Stored objects
+// are retained in Mode ("governance" or "compliance") for Retain, or by the
+// default retention of the bucket if not set. Deletes never remove versions,
+// they leave delete markers, so deleted keys are gone while their versions
+// are kept.
+type ObjectLock struct {
+	Mode   string         `json:"mode"`
+	Retain caddy.Duration `json:"retain,omitempty"`
+}
+
+func (config ObjectLock) validate() error {
+	switch {
+	case config.Mode == "" && config.Retain == 0:
+		return nil
+	case !config.retentionMode().IsValid():
+		return fmt.Errorf("invalid object_lock mode %q: must be governance or compliance", config.Mode)
+	case config.Retain <= 0:
+		return errors.New("object_lock mode requires retain")
+	}
+	return nil
+}
+
+func (config ObjectLock) retentionMode() minio.RetentionMode {
+	return minio.RetentionMode(strings.ToUpper(config.Mode))
+}
+
+// retention returns the retention to store objects with, or nothing to
+// leave it to the bucket.
+func (s3 S3) retention() (minio.RetentionMode, time.Time) {
+	if s3.ObjectLock == nil || s3.ObjectLock.Retain <= 0 {
+		return "", time.Time{}
+	}
+	return s3.ObjectLock.retentionMode(), time.Now().Add(time.Duration(s3.ObjectLock.Retain))
+}
+
+// checkObjectLock makes sure the bucket has Object Lock enabled, as S3
+// rejects writes with a retention otherwise.
+func (s3 S3) checkObjectLock(ctx context.Context) error {
+	enabled, _, _, _, err := s3.client().GetObjectLockConfig(ctx, s3.Bucket)
+	if err != nil {
+		if errorKind(err) == ErrPermissionDenied {
+			s3.logger.Warn("unable to check the Object Lock configuration", zap.String("bucket", s3.Bucket), zap.Error(err))
+			return nil
+		}
+		return fmt.Errorf("bucket %s does not have Object Lock enabled: %v", s3.Bucket, err)
+	}
+	if enabled != "Enabled" {
+		return fmt.Errorf("bucket %s does not have Object Lock enabled", s3.Bucket)
+	}
+	return nil
+}
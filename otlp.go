@@ -0,0 +1,319 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultOTLPEndpoint = "http://localhost:4318/v1/metrics"
+
+	// otlpInterval is how often the metrics are pushed to the collector.
+	otlpInterval = 10 * time.Second
+)
+
+// otlpBackend aggregates the metrics and pushes them to an OpenTelemetry
+// collector over OTLP/HTTP with JSON encoding, as cumulative histograms
+// with the bounds of the Prometheus histogram.
+type otlpBackend struct {
+	endpoint string
+	client   *http.Client
+	start    time.Time
+	logger   *zap.Logger
+
+	mu           sync.Mutex
+	durations    map[[2]string]*otlpHistogram
+	circuitState float64
+	hasCircuit   bool
+	mirrorLag    float64
+	hasMirror    bool
+	mirrorErrors map[string]uint64
+	gcDeleted    map[string]uint64
+}
+
+type otlpHistogram struct {
+	count   uint64
+	sum     float64
+	buckets []uint64
+}
+
+func newOTLPBackend(endpoint string, logger *zap.Logger) *otlpBackend {
+	if endpoint == "" {
+		endpoint = defaultOTLPEndpoint
+	}
+
+	return &otlpBackend{
+		endpoint:     endpoint,
+		client:       &http.Client{Timeout: otlpInterval},
+		start:        time.Now(),
+		logger:       logger,
+		durations:    make(map[[2]string]*otlpHistogram),
+		mirrorErrors: make(map[string]uint64),
+		gcDeleted:    make(map[string]uint64),
+	}
+}
+
+func (b *otlpBackend) observeDuration(operation, result string, seconds float64, traceID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.durations[[2]string{operation, result}]
+	if !ok {
+		h = &otlpHistogram{buckets: make([]uint64, len(prometheus.DefBuckets)+1)}
+		b.durations[[2]string{operation, result}] = h
+	}
+
+	h.count++
+	h.sum += seconds
+	h.buckets[sort.SearchFloat64s(prometheus.DefBuckets, seconds)]++
+}
+
+func (b *otlpBackend) setCircuitState(state circuitState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.circuitState = float64(state)
+	b.hasCircuit = true
+}
+
+func (b *otlpBackend) setMirrorLag(seconds float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.mirrorLag = seconds
+	b.hasMirror = true
+}
+
+func (b *otlpBackend) countMirrorError(operation string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.mirrorErrors[operation]++
+	b.hasMirror = true
+}
+
+func (b *otlpBackend) countCollected(class string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.gcDeleted[class]++
+}
+
+// run pushes the metrics every otlpInterval until ctx is done.
+func (b *otlpBackend) run(ctx context.Context) {
+	ticker := time.NewTicker(otlpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := b.push(ctx); err != nil {
+			b.logger.Error("pushing metrics", zap.String("endpoint", b.endpoint), zap.Error(err))
+		}
+	}
+}
+
+func (b *otlpBackend) push(ctx context.Context) error {
+	body, err := json.Marshal(b.export())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// The OTLP JSON encoding, as far as needed here. 64 bit integers are
+// encoded as strings.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name        string             `json:"name"`
+		Description string             `json:"description"`
+		Unit        string             `json:"unit,omitempty"`
+		Histogram   *otlpHistogramData `json:"histogram,omitempty"`
+		Gauge       *otlpGaugeData     `json:"gauge,omitempty"`
+		Sum         *otlpSumData       `json:"sum,omitempty"`
+	}
+	otlpHistogramData struct {
+		AggregationTemporality int                      `json:"aggregationTemporality"`
+		DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	}
+	otlpHistogramDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		BucketCounts      []string        `json:"bucketCounts"`
+		ExplicitBounds    []float64       `json:"explicitBounds"`
+	}
+	otlpGaugeData struct {
+		DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+	}
+	otlpSumData struct {
+		AggregationTemporality int                   `json:"aggregationTemporality"`
+		IsMonotonic            bool                  `json:"isMonotonic"`
+		DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	}
+	otlpNumberDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          float64         `json:"asDouble"`
+	}
+	otlpAttribute struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const aggregationTemporalityCumulative = 2
+
+func (b *otlpBackend) export() otlpRequest {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := strconv.FormatInt(b.start.UnixNano(), 10)
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	histogram := &otlpHistogramData{AggregationTemporality: aggregationTemporalityCumulative}
+	for labels, h := range b.durations {
+		bucketCounts := make([]string, len(h.buckets))
+		for i, count := range h.buckets {
+			bucketCounts[i] = strconv.FormatUint(count, 10)
+		}
+
+		histogram.DataPoints = append(histogram.DataPoints, otlpHistogramDataPoint{
+			Attributes: []otlpAttribute{
+				{Key: "operation", Value: otlpAnyValue{StringValue: labels[0]}},
+				{Key: "result", Value: otlpAnyValue{StringValue: labels[1]}},
+			},
+			StartTimeUnixNano: start,
+			TimeUnixNano:      now,
+			Count:             strconv.FormatUint(h.count, 10),
+			Sum:               h.sum,
+			BucketCounts:      bucketCounts,
+			ExplicitBounds:    prometheus.DefBuckets,
+		})
+	}
+
+	metrics := []otlpMetric{{
+		Name:        "caddy.storage_s3.operation_duration",
+		Description: "Duration of S3 storage operations.",
+		Unit:        "s",
+		Histogram:   histogram,
+	}}
+
+	if b.hasCircuit {
+		metrics = append(metrics, otlpMetric{
+			Name:        "caddy.storage_s3.circuit_breaker_state",
+			Description: "State of the circuit breaker: 0 closed, 1 open, 2 probing.",
+			Gauge: &otlpGaugeData{DataPoints: []otlpNumberDataPoint{
+				{TimeUnixNano: now, AsDouble: b.circuitState},
+			}},
+		})
+	}
+
+	if b.hasMirror {
+		errors := &otlpSumData{AggregationTemporality: aggregationTemporalityCumulative, IsMonotonic: true}
+		for operation, count := range b.mirrorErrors {
+			errors.DataPoints = append(errors.DataPoints, otlpNumberDataPoint{
+				Attributes:        []otlpAttribute{{Key: "operation", Value: otlpAnyValue{StringValue: operation}}},
+				StartTimeUnixNano: start,
+				TimeUnixNano:      now,
+				AsDouble:          float64(count),
+			})
+		}
+
+		metrics = append(metrics, otlpMetric{
+			Name:        "caddy.storage_s3.mirror_lag",
+			Description: "How long the oldest write has been waiting for the mirror bucket.",
+			Unit:        "s",
+			Gauge: &otlpGaugeData{DataPoints: []otlpNumberDataPoint{
+				{TimeUnixNano: now, AsDouble: b.mirrorLag},
+			}},
+		}, otlpMetric{
+			Name:        "caddy.storage_s3.mirror_errors",
+			Description: "Writes the mirror bucket failed or that found the queue full.",
+			Sum:         errors,
+		})
+	}
+
+	if len(b.gcDeleted) > 0 {
+		deleted := &otlpSumData{AggregationTemporality: aggregationTemporalityCumulative, IsMonotonic: true}
+		for class, count := range b.gcDeleted {
+			deleted.DataPoints = append(deleted.DataPoints, otlpNumberDataPoint{
+				Attributes:        []otlpAttribute{{Key: "class", Value: otlpAnyValue{StringValue: class}}},
+				StartTimeUnixNano: start,
+				TimeUnixNano:      now,
+				AsDouble:          float64(count),
+			})
+		}
+
+		metrics = append(metrics, otlpMetric{
+			Name:        "caddy.storage_s3.gc_deleted",
+			Description: "Objects garbage collection deleted, by key class.",
+			Sum:         deleted,
+		})
+	}
+
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: "caddy"}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "github.com/ss098/certmagic-s3"},
+			Metrics: metrics,
+		}},
+	}}}
+}
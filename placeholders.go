@@ -0,0 +1,69 @@
+package certmagic_s3
+
+import "github.com/caddyserver/caddy/v2"
+
+// replacePlaceholders resolves Caddy's global placeholders, like
+// {env.S3_BUCKET} and {system.hostname}, in the config. Unknown placeholders
+// are left as they are, as secrets may contain braces. Fields that end up
+// empty still fall back to their S3_* environment variables.
+func (s3 *S3) replacePlaceholders() {
+	repl := caddy.NewReplacer()
+
+	replace := func(fields ...*string) {
+		for _, field := range fields {
+			*field = repl.ReplaceKnown(*field, "")
+		}
+	}
+
+	replace(
+		&s3.Host, &s3.Bucket, &s3.Region, &s3.Prefix,
+		&s3.AccessID, &s3.SecretKey, &s3.SessionToken,
+		&s3.AccessIDFile, &s3.SecretKeyFile, &s3.Profile, &s3.CredentialsFile,
+		&s3.CAFile, &s3.CAPEM, &s3.TLSServerName, &s3.ClientCertFile, &s3.ClientKeyFile, &s3.ProxyURL,
+		&s3.RoleARN, &s3.ExternalID, &s3.RoleSessionName, &s3.STSEndpoint, &s3.WebIdentityTokenFile,
+		&s3.SSECustomerKey, &s3.Spool, &s3.MetricsEndpoint, &s3.StorageClass,
+	)
+
+	if s3.Mirror != nil {
+		m := s3.Mirror
+		replace(&m.Host, &m.Bucket, &m.Region, &m.Prefix, &m.AccessID, &m.SecretKey, &m.SessionToken, &m.AccessIDFile, &m.SecretKeyFile)
+	}
+	if s3.Vault != nil {
+		v := s3.Vault
+		replace(&v.Address, &v.SecretPath, &v.Token, &v.RoleID, &v.SecretID, &v.Role, &v.TokenFile)
+	}
+	if s3.Discovery != nil {
+		replace(&s3.Discovery.SRV, &s3.Discovery.URL)
+	}
+	if s3.Failover != nil {
+		for i := range s3.Failover.Endpoints {
+			replace(&s3.Failover.Endpoints[i].Host, &s3.Failover.Endpoints[i].Region)
+		}
+	}
+	if s3.CreateBucket != nil {
+		replace(&s3.CreateBucket.Region)
+	}
+	if s3.Encryption != nil {
+		replace(&s3.Encryption.AgeIdentityFile)
+		for i := range s3.Encryption.AgeRecipients {
+			replace(&s3.Encryption.AgeRecipients[i])
+		}
+	}
+	if s3.Tagging != nil {
+		for name, value := range s3.Tagging.Tags {
+			s3.Tagging.Tags[name] = repl.ReplaceKnown(value, "")
+		}
+	}
+	for i := range s3.Hooks {
+		replace(&s3.Hooks[i].URL)
+		for name, value := range s3.Hooks[i].Headers {
+			s3.Hooks[i].Headers[name] = repl.ReplaceKnown(value, "")
+		}
+	}
+	if s3.Audit != nil {
+		replace(&s3.Audit.Prefix, &s3.Audit.Webhook)
+		for name, value := range s3.Audit.Headers {
+			s3.Audit.Headers[name] = repl.ReplaceKnown(value, "")
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/minio/minio-go/v7"
+)
+
+const preflightPrefix = ".self-test/"
+
+// PreflightCheck is the result of one of the operations the storage needs.
+// Action is the IAM action it requires. Checks that need an object that
+// couldn't be written are skipped.
+type PreflightCheck struct {
+	Operation string `json:"operation"`
+	Action    string `json:"action"`
+	Allowed   bool   `json:"allowed"`
+	Skipped   bool   `json:"skipped,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	err error
+}
+
+// PreflightReport tells which of the operations the storage needs are
+// allowed, whether the endpoint honors conditional writes, which locking
+// relies on, and the minimal IAM policy the storage needs.
+type PreflightReport struct {
+	Bucket            string           `json:"bucket"`
+	Prefix            string           `json:"prefix"`
+	Checks            []PreflightCheck `json:"checks"`
+	ConditionalWrites bool             `json:"conditional_writes"`
+	Policy            json.RawMessage  `json:"policy"`
+}
+
+// Denied returns the IAM actions of the checks that were denied.
+func (r PreflightReport) Denied() []string {
+	var denied []string
+	seen := make(map[string]bool)
+	for _, check := range r.Checks {
+		if check.Allowed || check.Skipped || seen[check.Action] {
+			continue
+		}
+		seen[check.Action] = true
+		denied = append(denied, check.Action)
+	}
+	return denied
+}
+
+// Preflight tries each operation the storage needs on a probe object under
+// .self-test/ in the prefix, and reports which are allowed. It stops early
+// if the bucket doesn't exist or can't be reached.
+func (s3 S3) Preflight(ctx context.Context) PreflightReport {
+	client := s3.client()
+
+	report := PreflightReport{Bucket: s3.Bucket, Prefix: s3.Prefix}
+	report.Policy, _ = s3.MinimalPolicy()
+
+	record := func(operation, action string, err error) bool {
+		check := PreflightCheck{Operation: operation, Action: action, Allowed: err == nil, err: err}
+		if err != nil {
+			check.Error = s3.explainError(err).Error()
+		}
+		report.Checks = append(report.Checks, check)
+		return err == nil
+	}
+	skip := func(operation, action string) {
+		report.Checks = append(report.Checks, PreflightCheck{Operation: operation, Action: action, Skipped: true})
+	}
+
+	exists, err := client.BucketExists(ctx, s3.Bucket)
+	if err == nil && !exists {
+		err = fmt.Errorf("bucket %s: %w", s3.Bucket, ErrBucketMissing)
+	}
+	if !record("head_bucket", "s3:ListBucket", err) && errorKind(err) != ErrPermissionDenied {
+		return report
+	}
+
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		record("put_object", "s3:PutObject", err)
+		return report
+	}
+	key := s3.KeyPrefix(preflightPrefix + hex.EncodeToString(buf))
+	value := []byte("certmagic-s3 preflight")
+
+	opts := s3.putObjectOptions()
+	opts.DisableMultipart = true
+
+	_, err = client.PutObject(ctx, s3.Bucket, key, bytes.NewReader(value), int64(len(value)), opts)
+	written := record("put_object", "s3:PutObject", err)
+
+	if written {
+		_, err = client.StatObject(ctx, s3.Bucket, key, minio.StatObjectOptions{ServerSideEncryption: s3.sse})
+		record("head_object", "s3:GetObject", err)
+
+		record("get_object", "s3:GetObject", s3.preflightRead(ctx, client, key, value))
+
+		// creating the existing object must fail, unless the endpoint
+		// ignores the condition
+		_, err = client.PutObject(withCondition(ctx, ifMatch("")), s3.Bucket, key, bytes.NewReader(value), int64(len(value)), opts)
+		switch {
+		case err == nil:
+			record("conditional_put_object", "s3:PutObject", nil)
+		case errorKind(err) == ErrPreconditionFailed:
+			record("conditional_put_object", "s3:PutObject", nil)
+			report.ConditionalWrites = true
+		default:
+			record("conditional_put_object", "s3:PutObject", err)
+		}
+	} else {
+		skip("head_object", "s3:GetObject")
+		skip("get_object", "s3:GetObject")
+		skip("conditional_put_object", "s3:PutObject")
+	}
+
+	err = nil
+	for object := range client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{Prefix: s3.KeyPrefix(preflightPrefix), MaxKeys: 1, UseV1: !s3.Capabilities().ListV2}) {
+		err = object.Err
+		break
+	}
+	record("list_objects", "s3:ListBucket", err)
+
+	if s3.multipartUploads() {
+		err = nil
+		for upload := range client.ListIncompleteUploads(ctx, s3.Bucket, s3.KeyPrefix(preflightPrefix), false) {
+			err = upload.Err
+			break
+		}
+		record("list_multipart_uploads", "s3:ListBucketMultipartUploads", err)
+	} else {
+		skip("list_multipart_uploads", "s3:ListBucketMultipartUploads")
+	}
+
+	if written {
+		record("delete_object", "s3:DeleteObject", client.RemoveObject(ctx, s3.Bucket, key, minio.RemoveObjectOptions{}))
+	} else {
+		skip("delete_object", "s3:DeleteObject")
+	}
+
+	return report
+}
+
+func (s3 S3) preflightRead(ctx context.Context, client *minio.Client, key string, value []byte) error {
+	object, err := client.GetObject(ctx, s3.Bucket, key, s3.getObjectOptions())
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+
+	contents, err := ioutil.ReadAll(object)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(contents, value) {
+		return fmt.Errorf("read back %d bytes that differ from the %d written", len(contents), len(value))
+	}
+	return nil
+}
+
+type (
+	iamPolicy struct {
+		Version   string         `json:"Version"`
+		Statement []iamStatement `json:"Statement"`
+	}
+	iamStatement struct {
+		Effect   string   `json:"Effect"`
+		Action   []string `json:"Action"`
+		Resource string   `json:"Resource"`
+	}
+)
+
+// MinimalPolicy returns the IAM policy granting what the storage needs with
+// its config, and nothing more.
+func (s3 S3) MinimalPolicy() ([]byte, error) {
+	if s3.Bucket == "" {
+		return nil, errors.New("no bucket configured")
+	}
+
+	bucketActions := []string{"s3:ListBucket", "s3:ListBucketMultipartUploads"}
+	objectActions := []string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject", "s3:AbortMultipartUpload"}
+
+	if s3.CreateBucket != nil {
+		bucketActions = append(bucketActions, "s3:CreateBucket")
+		if s3.CreateBucket.Versioning {
+			bucketActions = append(bucketActions, "s3:PutBucketVersioning")
+		}
+	}
+	if s3.ObjectLock != nil {
+		bucketActions = append(bucketActions, "s3:GetBucketObjectLockConfiguration")
+		if s3.ObjectLock.Retain > 0 {
+			objectActions = append(objectActions, "s3:PutObjectRetention")
+		}
+	}
+	if s3.Lifecycle != nil {
+		bucketActions = append(bucketActions, "s3:GetLifecycleConfiguration", "s3:PutLifecycleConfiguration")
+	}
+	if s3.Tagging != nil {
+		objectActions = append(objectActions, "s3:PutObjectTagging")
+	}
+	if s3.Region == "" {
+		bucketActions = append(bucketActions, "s3:GetBucketLocation")
+	}
+
+	objects := "arn:aws:s3:::" + s3.Bucket + "/" + path.Join(cleanPrefix(s3.Prefix), "*")
+
+	return json.MarshalIndent(iamPolicy{
+		Version: "2012-10-17",
+		Statement: []iamStatement{
+			{Effect: "Allow", Action: bucketActions, Resource: "arn:aws:s3:::" + s3.Bucket},
+			{Effect: "Allow", Action: objectActions, Resource: objects},
+		},
+	}, "", "  ")
+}
+
+func preflightFlags(fs *flag.FlagSet) {
+	fs.Bool("json", false, "Print the report as JSON")
+	configFlags(fs)
+}
+
+func cmdPreflight(fl caddycmd.Flags) (int, error) {
+	storage, err := loadStorageConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	// the report says more than the self-test
+	storage["skip_self_test"] = true
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s3, err := provisionStorage(ctx, storage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	report := s3.Preflight(ctx)
+
+	if fl.Bool("json") {
+		body, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		fmt.Println(string(body))
+	} else {
+		for _, check := range report.Checks {
+			result := "allowed"
+			switch {
+			case check.Skipped:
+				result = "skipped"
+			case !check.Allowed:
+				result = "denied "
+			}
+			fmt.Printf("%s  %-24s %-32s %s\n", result, check.Operation, check.Action, check.Error)
+		}
+		if report.ConditionalWrites {
+			fmt.Println("conditional writes are supported")
+		} else {
+			fmt.Println("conditional writes are not supported, locks rely on reading back, or set lock_strategy candidates")
+		}
+		fmt.Printf("\nMinimal IAM policy:\n%s\n", report.Policy)
+	}
+
+	if denied := report.Denied(); len(denied) > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("denied: %s", strings.Join(denied, ", "))
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
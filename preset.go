@@ -0,0 +1,62 @@
+package certmagic_s3
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// presets are curated defaults for common deployments. They only fill in
+// settings the config and the environment leave unset, so anything can be
+// overridden, except that switches a preset turns on can't be turned off.
+var presets = map[string]func(s3 *S3){
+	// EC2, ECS or EKS with an IAM role, against AWS S3
+	"aws-iam-prod": func(s3 *S3) {
+		if s3.Host == "" {
+			s3.Host = "s3.amazonaws.com"
+		}
+		if s3.AccessID == "" && s3.AccessIDFile == "" && s3.Profile == "" && s3.RoleARN == "" && s3.Vault == nil {
+			s3.UseIamProvider = true
+		}
+		if s3.Retry == nil {
+			s3.Retry = &Retry{MaxAttempts: 5}
+		}
+		if s3.CircuitBreaker == nil {
+			s3.CircuitBreaker = new(CircuitBreaker)
+		}
+		s3.FenceWrites = true
+		s3.VerifyIssuance = true
+	},
+
+	// a MinIO server started with its defaults on the local machine
+	"minio-local-dev": func(s3 *S3) {
+		if s3.Host == "" {
+			s3.Host = "localhost:9000"
+		}
+		if s3.AccessID == "" && s3.SecretKey == "" {
+			s3.AccessID = "minioadmin"
+			s3.SecretKey = "minioadmin"
+		}
+		if s3.Region == "" {
+			s3.Region = "us-east-1"
+		}
+		if s3.BucketWait == 0 {
+			s3.BucketWait = caddy.Duration(30 * time.Second)
+		}
+		if s3.Retry == nil {
+			s3.Retry = &Retry{MaxAttempts: 1}
+		}
+		s3.Insecure = true
+	},
+}
+
+func presetNames() string {
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
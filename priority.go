@@ -0,0 +1,91 @@
+package certmagic_s3
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// priority orders requests competing for the limiters, lower values first.
+type priority int
+
+const (
+	// priorityCritical is for reads a TLS handshake may be waiting on.
+	priorityCritical priority = iota
+	// priorityIssuance is for the writes of certificate issuance.
+	priorityIssuance
+	// priorityMaintenance is for background and bulk work like exports.
+	priorityMaintenance
+)
+
+var priorityNames = map[string]priority{
+	"critical":    priorityCritical,
+	"issuance":    priorityIssuance,
+	"maintenance": priorityMaintenance,
+}
+
+func (p priority) String() string {
+	for name, value := range priorityNames {
+		if value == p {
+			return name
+		}
+	}
+	return fmt.Sprintf("priority(%d)", int(p))
+}
+
+// defaultPriorities assigns the operations to priorities unless configured
+// otherwise. Operations not listed are issuance.
+var defaultPriorities = map[string]priority{
+	"load":   priorityCritical,
+	"exists": priorityCritical,
+	"stat":   priorityCritical,
+	"store":  priorityIssuance,
+	"delete": priorityIssuance,
+	"list":   priorityMaintenance,
+	"upload": priorityMaintenance,
+}
+
+func validPriority(name string) bool {
+	_, ok := priorityNames[name]
+	return ok
+}
+
+type priorityKey struct{}
+
+// withPriority makes every request made with ctx run at p, regardless of
+// its operation. Bulk operations use it to stay out of the way of serving.
+// A priority set further out is kept.
+func withPriority(ctx context.Context, p priority) context.Context {
+	if _, ok := ctx.Value(priorityKey{}).(priority); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priority returns the priority of a request of the named operation, with
+// "upload_part" and the like configured as "upload".
+func (s3 S3) priority(ctx context.Context, operation string) priority {
+	if p, ok := ctx.Value(priorityKey{}).(priority); ok {
+		return p
+	}
+
+	if i := strings.Index(operation, "_"); i >= 0 {
+		operation = operation[:i]
+	}
+
+	if name, ok := s3.Priorities[operation]; ok {
+		return priorityNames[name]
+	}
+	if p, ok := defaultPriorities[operation]; ok {
+		return p
+	}
+	return priorityIssuance
+}
+
+// limiter is implemented by the parts of the module that hold requests
+// back, like concurrency and rate limits. When requests queue, wait must
+// let them through in order of priority. The returned func is called once
+// the request is done.
+type limiter interface {
+	wait(ctx context.Context, operation string, p priority) (func(), error)
+}
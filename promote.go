@@ -0,0 +1,119 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+)
+
+// connectionFields are the config fields that make up a bucket connection.
+// Promoting a mirror swaps them between the primary and the mirror.
+var connectionFields = []string{
+	"host",
+	"bucket",
+	"region",
+	"access_id",
+	"secret_key",
+	"access_id_file",
+	"secret_key_file",
+	"session_token",
+	"prefix",
+	"insecure",
+	"use_iam_provider",
+}
+
+func promoteFlags(fs *flag.FlagSet) {
+	fs.String("target", "", "Bucket to promote to primary")
+	fs.String("host", "", "Endpoint of the target bucket, if different from the primary")
+	adminFlags(fs)
+}
+
+func cmdPromote(fl caddycmd.Flags) (int, error) {
+	target := fl.String("target")
+	if target == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--target is required")
+	}
+
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(fl.String("address"), fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("couldn't determine admin API address: %v", err)
+	}
+
+	resp, err := caddycmd.AdminAPIRequest(adminAddr, http.MethodGet, "/config/storage", nil, nil)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	var storage map[string]interface{}
+	if err := json.Unmarshal(body, &storage); err != nil || storage == nil {
+		return caddy.ExitCodeFailedStartup, errors.New("running config has no storage")
+	}
+	if storage["module"] != "s3" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("running config uses %v storage, not s3", storage["module"])
+	}
+
+	promoted := promoteBucket(storage, target, fl.String("host"))
+
+	body, err = json.Marshal(storage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	resp, err = caddycmd.AdminAPIRequest(adminAddr, http.MethodPatch, "/config/storage", nil, bytes.NewReader(body))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	resp.Body.Close()
+
+	if promoted {
+		fmt.Printf("Promoted mirror bucket %s to primary, the former primary is now the mirror\n", target)
+	} else {
+		fmt.Printf("Promoted bucket %s to primary\n", target)
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// promoteBucket makes target the primary bucket of the storage config. If
+// target is the configured mirror, primary and mirror swap roles so that
+// replication continues in the reverse direction; it reports whether so.
+func promoteBucket(storage map[string]interface{}, target, host string) bool {
+	mirror, _ := storage["mirror"].(map[string]interface{})
+
+	if mirror != nil && mirror["bucket"] == target && (host == "" || mirror["host"] == host) {
+		for _, field := range connectionFields {
+			primaryValue, primaryOk := storage[field]
+			mirrorValue, mirrorOk := mirror[field]
+
+			delete(storage, field)
+			delete(mirror, field)
+
+			if mirrorOk {
+				storage[field] = mirrorValue
+			}
+			if primaryOk {
+				mirror[field] = primaryValue
+			}
+		}
+		return true
+	}
+
+	storage["bucket"] = target
+	if host != "" {
+		storage["host"] = host
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package certmagic_s3
+
+import (
+	"errors"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const (
+	providerB2    = "b2"
+	providerCeph  = "ceph"
+	providerGCS   = "gcs"
+	providerSwift = "swift"
+)
+
+// provider is the profile of an S3-compatible service that behaves unlike
+// AWS S3 in ways the module has to know about.
+type provider struct {
+	// apply fills in the settings the service needs and the config and the
+	// environment leave unset, like presets do
+	apply func(s3 *S3)
+
+	// the ETags of some objects aren't their MD5, even unencrypted
+	opaqueETags bool
+
+	// listings may lag behind stores and deletes
+	eventualListing bool
+
+	// objects are uploaded in a single PUT, multipart uploads aren't
+	// supported well enough
+	noMultipart bool
+
+	// the storage classes of the service, if not those of AWS
+	storageClasses map[string]bool
+}
+
+var providers = map[string]provider{
+	// Backblaze B2 through its S3-compatible API, which caps the requests per
+	// second and answers 503 beyond, tags objects uploaded through the B2
+	// API with SHA-1 ETags and may list keys deleted shortly before
+	providerB2: {
+		apply: func(s3 *S3) {
+			if s3.Host == "" && s3.Region != "" {
+				s3.Host = "s3." + s3.Region + ".backblazeb2.com"
+			}
+			if s3.Retry == nil {
+				s3.Retry = &Retry{
+					MaxAttempts: 6,
+					Base:        caddy.Duration(500 * time.Millisecond),
+					Max:         caddy.Duration(20 * time.Second),
+				}
+			}
+			if s3.RateLimit == nil {
+				s3.RateLimit = &RateLimit{Requests: 20, List: 5}
+			}
+		},
+		opaqueETags:     true,
+		eventualListing: true,
+	},
+
+	// Google Cloud Storage through its XML API with HMAC keys, which has
+	// storage classes of its own and no object tags, Object Lock or S3
+	// lifecycle rules, and whose multipart uploads can't be resumed the way
+	// putMultipart does
+	providerGCS: {
+		apply: func(s3 *S3) {
+			if s3.Host == "" {
+				s3.Host = "storage.googleapis.com"
+			}
+			if s3.Region == "" {
+				s3.Region = "auto"
+			}
+		},
+		noMultipart:    true,
+		storageClasses: gcsStorageClasses,
+	},
+
+	// Ceph RGW, whose older builds reject or ignore conditional PUTs and
+	// don't take ListObjectsV2, so both are probed when connecting
+	providerCeph: {
+		apply: applyCompatProbes,
+	},
+
+	// OpenStack Swift through its s3api middleware, which lacks the same
+	// as older Ceph RGW builds
+	providerSwift: {
+		apply: applyCompatProbes,
+	},
+}
+
+// applyCompatProbes leaves locking and listing to what the endpoint
+// supports, unless configured.
+func applyCompatProbes(s3 *S3) {
+	if s3.LockStrategy == "" {
+		s3.LockStrategy = lockAuto
+	}
+	if s3.ListAPI == "" {
+		s3.ListAPI = listAuto
+	}
+}
+
+func providerNames() string {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// trustsETags reports whether the ETags of unencrypted objects uploaded in
+// a single part are their MD5 with the provider.
+func (s3 S3) trustsETags() bool {
+	return !providers[s3.Provider].opaqueETags && s3.Capabilities().MD5ETags
+}
+
+// multipartUploads reports whether large objects are uploaded in parts.
+func (s3 S3) multipartUploads() bool {
+	return !providers[s3.Provider].noMultipart
+}
+
+// storageClassNames returns the storage classes objects can be stored in.
+func (s3 S3) storageClassNames() map[string]bool {
+	if classes := providers[s3.Provider].storageClasses; classes != nil {
+		return classes
+	}
+	return storageClasses
+}
+
+// staleListing reports whether err means a key that was just listed is gone
+// already, which providers with eventually consistent listings allow for.
+func (s3 S3) staleListing(err error) bool {
+	return providers[s3.Provider].eventualListing && errors.Is(err, fs.ErrNotExist)
+}
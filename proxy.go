@@ -0,0 +1,303 @@
+package certmagic_s3
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// ProxyHandler serves the storage configured for this Caddy instance over
+// HTTP, so other instances can use it through the s3_proxy storage module
+// without S3 credentials or network access of their own. Requests must
+// carry the token as bearer token. Locks taken through the proxy are
+// released unless the client renews them within proxyLockLease.
+type ProxyHandler struct {
+	Token string `json:"token,omitempty"`
+
+	storage certmagic.Storage
+	leases  *proxyLeases
+	logger  *zap.Logger
+}
+
+const (
+	// proxyLockLease is how long a lock taken through the proxy is held
+	// without the client renewing it, so a client that went away can't keep
+	// it forever.
+	proxyLockLease = time.Minute
+
+	// proxyLockWait is how long a single lock request waits for the lock,
+	// after which the client asks again, so no request outlives the
+	// timeout of the client.
+	proxyLockWait = 30 * time.Second
+
+	// proxyMaxValueSize caps the values stored through the proxy.
+	proxyMaxValueSize = 16 << 20
+)
+
+var (
+	// errLeaseLost is answered with 409 Conflict to renewing or releasing a
+	// lock under a lease that expired or is another client's.
+	errLeaseLost = errors.New("the lease of the lock is lost")
+
+	// errLockBusy is answered with 423 Locked when the lock is still held
+	// after proxyLockWait.
+	errLockBusy = errors.New("the lock is held")
+)
+
+// proxyLease is the answer to a lock request. Renewing and releasing the
+// lock take Lease, so only the client holding it can.
+type proxyLease struct {
+	Lease string `json:"lease"`
+}
+
+// proxyLeases releases the locks of clients that stopped renewing them.
+type proxyLeases struct {
+	mu     sync.Mutex
+	leases map[string]*lease
+}
+
+type lease struct {
+	token string
+	timer *time.Timer
+}
+
+func (l *proxyLeases) start(key, token string, expire func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if held, ok := l.leases[key]; ok {
+		held.timer.Stop()
+	}
+	held := &lease{token: token}
+	held.timer = time.AfterFunc(proxyLockLease, func() {
+		l.mu.Lock()
+		if l.leases[key] == held {
+			delete(l.leases, key)
+		}
+		l.mu.Unlock()
+		expire()
+	})
+	l.leases[key] = held
+}
+
+func (l *proxyLeases) renew(key, token string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	held, ok := l.leases[key]
+	if !ok || subtle.ConstantTimeCompare([]byte(held.token), []byte(token)) != 1 || !held.timer.Stop() {
+		// already expired, or not this client's
+		return false
+	}
+	held.timer.Reset(proxyLockLease)
+	return true
+}
+
+func (l *proxyLeases) stop(key, token string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	held, ok := l.leases[key]
+	if !ok || subtle.ConstantTimeCompare([]byte(held.token), []byte(token)) != 1 || !held.timer.Stop() {
+		return false
+	}
+	delete(l.leases, key)
+	return true
+}
+
+func init() {
+	caddy.RegisterModule(ProxyHandler{})
+	httpcaddyfile.RegisterHandlerDirective("s3_storage_proxy", parseProxyHandler)
+}
+
+func (ProxyHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "http.handlers.s3_storage_proxy",
+		New: func() caddy.Module {
+			return new(ProxyHandler)
+		},
+	}
+}
+
+func (h *ProxyHandler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "token":
+				if !d.AllArgs(&h.Token) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("Invalid usage of s3_storage_proxy: unrecognized option %s", d.Val())
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseProxyHandler(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	handler := new(ProxyHandler)
+	err := handler.UnmarshalCaddyfile(h.Dispenser)
+	return handler, err
+}
+
+func (h *ProxyHandler) Provision(ctx caddy.Context) error {
+	if h.Token == "" {
+		h.Token = os.Getenv("S3_PROXY_TOKEN")
+	}
+	if h.Token == "" {
+		return errors.New("s3_storage_proxy requires a token")
+	}
+
+	h.storage = ctx.Storage()
+	h.leases = &proxyLeases{leases: make(map[string]*lease)}
+	h.logger = ctx.Logger(h)
+
+	return nil
+}
+
+// keyField is the log field of key, shortened like the storage logs it.
+func (h ProxyHandler) keyField(key string) zap.Field {
+	if s3, ok := h.storage.(S3); ok {
+		return s3.keyField(key)
+	}
+	return zap.String("key", key)
+}
+
+func (h ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) != 1 {
+		return caddyhttp.Error(http.StatusUnauthorized, errors.New("invalid storage proxy token"))
+	}
+
+	ctx := r.Context()
+	query := r.URL.Query()
+	key := query.Get("key")
+
+	var err error
+
+	switch operation := path.Base(r.URL.Path); operation {
+	case "store":
+		var value []byte
+		value, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, proxyMaxValueSize))
+		if err != nil {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+		}
+		err = h.storage.Store(ctx, key, value)
+	case "load":
+		var value []byte
+		value, err = h.storage.Load(ctx, key)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, err = w.Write(value)
+			return err
+		}
+	case "delete":
+		err = h.storage.Delete(ctx, key)
+	case "exists":
+		if !h.storage.Exists(ctx, key) {
+			err = fs.ErrNotExist
+		}
+	case "list":
+		recursive, _ := strconv.ParseBool(query.Get("recursive"))
+		var keys []string
+		keys, err = h.storage.List(ctx, query.Get("prefix"), recursive)
+		if err == nil {
+			return writeProxyJSON(w, keys)
+		}
+	case "stat":
+		var info certmagic.KeyInfo
+		info, err = h.storage.Stat(ctx, key)
+		if err == nil {
+			return writeProxyJSON(w, info)
+		}
+	case "lock":
+		lockCtx, cancel := context.WithTimeout(ctx, proxyLockWait)
+		err = h.storage.Lock(lockCtx, key)
+		cancel()
+		if err != nil && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+			err = errLockBusy
+			break
+		}
+		if err == nil && ctx.Err() != nil {
+			// the client is gone and will never unlock
+			return h.storage.Unlock(context.Background(), key)
+		}
+		if err != nil {
+			break
+		}
+
+		var token string
+		token, err = newLockOwner()
+		if err != nil {
+			h.storage.Unlock(context.Background(), key)
+			break
+		}
+		h.leases.start(key, token, func() {
+			h.logger.Warn("lease of proxied lock expired, unlocking", h.keyField(key))
+			if err := h.storage.Unlock(context.Background(), key); err != nil {
+				h.logger.Error("unlocking", h.keyField(key), zap.Error(err))
+			}
+		})
+		return writeProxyJSON(w, proxyLease{Lease: token})
+	case "renew":
+		if !h.leases.renew(key, query.Get("lease")) {
+			err = errLeaseLost
+		}
+	case "unlock":
+		if !h.leases.stop(key, query.Get("lease")) {
+			err = errLeaseLost
+			break
+		}
+		err = h.storage.Unlock(ctx, key)
+	default:
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("unknown storage operation %s", operation))
+	}
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	case errors.Is(err, errLeaseLost):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil
+	case errors.Is(err, errLockBusy):
+		http.Error(w, err.Error(), http.StatusLocked)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func writeProxyJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*ProxyHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*ProxyHandler)(nil)
+	_ caddyfile.Unmarshaler       = (*ProxyHandler)(nil)
+)
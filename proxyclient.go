@@ -0,0 +1,298 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// proxyRequestTimeout bounds every request to the proxy. It's longer than
+// proxyLockWait, after which the proxy answers a waiting lock request.
+const proxyRequestTimeout = time.Minute
+
+// Proxy is a storage that forwards every operation to the s3_storage_proxy
+// handler of another Caddy instance, which holds the S3 credentials.
+type Proxy struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+
+	client *http.Client
+	locks  *lockSet
+	logger *zap.Logger
+}
+
+func init() {
+	caddy.RegisterModule(Proxy{})
+}
+
+func (Proxy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "caddy.storage.s3_proxy",
+		New: func() caddy.Module {
+			return new(Proxy)
+		},
+	}
+}
+
+func (p *Proxy) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var value string
+
+			key := d.Val()
+
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+
+			switch key {
+			case "url":
+				p.URL = value
+			case "token":
+				p.Token = value
+			default:
+				return d.Errf("Invalid usage of s3_proxy storage config: unrecognized option %s", key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Proxy) Provision(ctx caddy.Context) error {
+	if p.URL == "" {
+		p.URL = os.Getenv("S3_PROXY_URL")
+	}
+	if p.Token == "" {
+		p.Token = os.Getenv("S3_PROXY_TOKEN")
+	}
+
+	if p.URL == "" {
+		return errors.New("s3_proxy requires url")
+	}
+	if p.Token == "" {
+		return errors.New("s3_proxy requires token")
+	}
+
+	p.client = &http.Client{Transport: http.DefaultTransport, Timeout: proxyRequestTimeout}
+	p.locks = newLockSet()
+	p.logger = ctx.Logger(p)
+
+	return nil
+}
+
+func (p Proxy) CertMagicStorage() (certmagic.Storage, error) {
+	return p, nil
+}
+
+func (p Proxy) Store(ctx context.Context, key string, value []byte) error {
+	resp, err := p.request(ctx, http.MethodPut, "store", url.Values{"key": {key}}, value)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (p Proxy) Load(ctx context.Context, key string) ([]byte, error) {
+	resp, err := p.request(ctx, http.MethodGet, "load", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (p Proxy) Delete(ctx context.Context, key string) error {
+	resp, err := p.request(ctx, http.MethodPost, "delete", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (p Proxy) Exists(ctx context.Context, key string) bool {
+	resp, err := p.request(ctx, http.MethodGet, "exists", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
+
+func (p Proxy) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	resp, err := p.request(ctx, http.MethodGet, "list", url.Values{"prefix": {prefix}, "recursive": {strconv.FormatBool(recursive)}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var keys []string
+	err = json.NewDecoder(resp.Body).Decode(&keys)
+
+	return keys, err
+}
+
+func (p Proxy) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	resp, err := p.request(ctx, http.MethodGet, "stat", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	var info certmagic.KeyInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+
+	return info, err
+}
+
+func (p Proxy) Lock(ctx context.Context, key string) error {
+	for {
+		resp, err := p.request(ctx, http.MethodPost, "lock", url.Values{"key": {key}}, nil)
+		if errors.Is(err, errLockBusy) {
+			// the proxy stopped waiting, ask again
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		var lease proxyLease
+		err = json.NewDecoder(resp.Body).Decode(&lease)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("storage proxy: lock %s: %v", key, err)
+		}
+
+		lock := &heldLock{owner: lease.Lease, done: make(chan struct{})}
+		p.locks.add(key, lock)
+		go p.renewLease(key, lock)
+
+		return nil
+	}
+}
+
+func (p Proxy) Unlock(ctx context.Context, key string) error {
+	lock := p.locks.remove(key)
+	if lock == nil {
+		return fmt.Errorf("storage proxy: lock %s is not held by this instance", key)
+	}
+	close(lock.done)
+
+	resp, err := p.request(ctx, http.MethodPost, "unlock", url.Values{"key": {key}, "lease": {lock.owner}}, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// renewLease renews the lease of a lock taken through the proxy until it is
+// unlocked. If the proxy no longer holds the lock for us, it is dropped.
+func (p Proxy) renewLease(key string, lock *heldLock) {
+	ticker := time.NewTicker(proxyLockLease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lock.done:
+			return
+		case <-ticker.C:
+		}
+
+		err := p.renew(key, lock)
+		if errors.Is(err, errLeaseLost) {
+			p.logger.Error("lease of proxied lock lost, dropping lock", zap.String("key", key), zap.Error(err))
+			return
+		}
+		if err != nil {
+			p.logger.Warn("renewing lease of proxied lock failed", zap.String("key", key), zap.Error(err))
+		}
+	}
+}
+
+// renew renews the lease of lock once. If the lease is lost, lock is
+// dropped and errLeaseLost returned.
+func (p Proxy) renew(key string, lock *heldLock) error {
+	resp, err := p.request(context.Background(), http.MethodPost, "renew", url.Values{"key": {key}, "lease": {lock.owner}}, nil)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = fmt.Errorf("storage proxy: renew %s: %w", key, errLeaseLost)
+	}
+	if errors.Is(err, errLeaseLost) {
+		if p.locks.drop(key, lock) {
+			close(lock.done)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// request calls operation on the proxy. A missing key is returned as
+// fs.ErrNotExist, like certmagic expects.
+func (p Proxy) request(ctx context.Context, method, operation string, query url.Values, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	endpoint := strings.TrimSuffix(p.URL, "/") + "/" + operation + "?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.Token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fs.ErrNotExist
+	case resp.StatusCode == http.StatusConflict:
+		resp.Body.Close()
+		return nil, fmt.Errorf("storage proxy: %s %s: %w", operation, query.Get("key"), errLeaseLost)
+	case resp.StatusCode == http.StatusLocked:
+		resp.Body.Close()
+		return nil, errLockBusy
+	case resp.StatusCode >= 300:
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("storage proxy: %s %s: %s: %s", operation, query.Get("key"), resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return resp, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner      = (*Proxy)(nil)
+	_ caddy.StorageConverter = Proxy{}
+	_ caddyfile.Unmarshaler  = (*Proxy)(nil)
+	_ certmagic.Storage      = Proxy{}
+)
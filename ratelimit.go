@@ -0,0 +1,147 @@
+package certmagic_s3
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit caps the requests per second sent to the endpoint, for
+// providers like Backblaze B2 that enforce a cap. Requests is shared by all
+// operations, List applies to listing only and Objects to reading and
+// writing objects. Each allows bursts of its burst size, which defaults to
+// one second worth of requests.
+type RateLimit struct {
+	Requests     float64 `json:"requests,omitempty"`
+	Burst        int     `json:"burst,omitempty"`
+	List         float64 `json:"list,omitempty"`
+	ListBurst    int     `json:"list_burst,omitempty"`
+	Objects      float64 `json:"objects,omitempty"`
+	ObjectsBurst int     `json:"objects_burst,omitempty"`
+}
+
+// rateLimit is the limiter of a RateLimit. Buckets not configured are nil.
+type rateLimit struct {
+	requests *tokenBucket
+	list     *tokenBucket
+	objects  *tokenBucket
+}
+
+func newRateLimit(config *RateLimit) rateLimit {
+	return rateLimit{
+		requests: newTokenBucket(config.Requests, config.Burst),
+		list:     newTokenBucket(config.List, config.ListBurst),
+		objects:  newTokenBucket(config.Objects, config.ObjectsBurst),
+	}
+}
+
+func (l rateLimit) wait(ctx context.Context, operation string, p priority) (func(), error) {
+	class := l.objects
+	if operation == "list" {
+		class = l.list
+	}
+
+	for _, bucket := range []*tokenBucket{class, l.requests} {
+		if bucket == nil {
+			continue
+		}
+		if err := bucket.take(ctx, p); err != nil {
+			return nil, err
+		}
+	}
+
+	return func() {}, nil
+}
+
+// tokenBucket lets requests through at rate, with bursts of up to burst
+// requests. Requests waiting for a token get it in order of priority.
+type tokenBucket struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+	waiting [priorityMaintenance + 1]int
+}
+
+// newTokenBucket returns nil for a rate of zero, i.e. no limit.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	b := &tokenBucket{rate: rate, burst: float64(burst), last: time.Now()}
+	if b.burst <= 0 {
+		b.burst = math.Max(math.Ceil(rate), 1)
+	}
+	b.tokens = b.burst
+
+	return b
+}
+
+// refill adds the tokens accrued since the last call. b.mu must be held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+}
+
+// mayTake reports whether a request at p may take a token now, which it
+// may not while requests of a higher priority wait. b.mu must be held.
+func (b *tokenBucket) mayTake(p priority) bool {
+	for higher := priorityCritical; higher < p; higher++ {
+		if b.waiting[higher] > 0 {
+			return false
+		}
+	}
+	return b.tokens >= 1
+}
+
+func (b *tokenBucket) take(ctx context.Context, p priority) error {
+	b.mu.Lock()
+	b.waiting[p]++
+	defer func() {
+		b.mu.Lock()
+		b.waiting[p]--
+		b.mu.Unlock()
+	}()
+
+	for {
+		b.refill()
+		if b.mayTake(p) {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration(float64(time.Second) / b.rate)
+		b.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		b.mu.Lock()
+	}
+}
+
+// empty reports whether requests have to wait for a token.
+func (b *tokenBucket) empty() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	return b.tokens < 1
+}
+
+// setRate changes the rate, and the burst to one second worth of requests.
+func (b *tokenBucket) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+	b.rate = rate
+	b.burst = math.Max(math.Ceil(rate), 1)
+}
@@ -0,0 +1,240 @@
+package certmagic_s3
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"github.com/caddyserver/certmagic"
+)
+
+// Reconciliation lists the certificates the certificate cache and the
+// bucket disagree about.
+type Reconciliation struct {
+	// NotStored are served from the cache, but missing from the bucket, so
+	// they are lost on restart and other instances can't use them.
+	NotStored []ReconciledCertificate `json:"not_stored"`
+
+	// NotServed are valid certificates in the bucket the cache doesn't
+	// hold, e.g. because another instance renewed them, or because their
+	// names are no longer configured.
+	NotServed []ReconciledCertificate `json:"not_served"`
+}
+
+// ReconciledCertificate describes a certificate of a Reconciliation. Key is
+// empty for certificates not in the bucket.
+type ReconciledCertificate struct {
+	Names    []string  `json:"names"`
+	NotAfter time.Time `json:"not_after"`
+	Key      string    `json:"key,omitempty"`
+}
+
+// Reconcile compares the certificates in the bucket with the certificates
+// cached returns for their names and for names.
+func (s3 S3) Reconcile(ctx context.Context, cached func(name string) []certmagic.Certificate, names []string) (Reconciliation, error) {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	var result Reconciliation
+
+	keys, err := s3.objectKeys(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	stored := make(map[string]bool)
+	var storedKeys []string
+	var storedLeafs []*x509.Certificate
+
+	for _, key := range keys {
+		if keyClass(key) != ClassCertificate {
+			continue
+		}
+
+		value, err := s3.Load(ctx, key)
+		if err != nil {
+			return result, fmt.Errorf("loading %s: %v", s3.logKey(key), err)
+		}
+
+		block, _ := pem.Decode(value)
+		if block == nil {
+			return result, fmt.Errorf("%s holds no PEM certificate", s3.logKey(key))
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return result, fmt.Errorf("parsing %s: %v", s3.logKey(key), err)
+		}
+
+		stored[string(leaf.Raw)] = true
+		storedKeys = append(storedKeys, key)
+		storedLeafs = append(storedLeafs, leaf)
+		names = append(names, certNames(leaf)...)
+	}
+
+	served := make(map[string]bool)
+	looked := make(map[string]bool)
+
+	for _, name := range names {
+		if looked[name] {
+			continue
+		}
+		looked[name] = true
+
+		for _, cert := range cached(name) {
+			if len(cert.Certificate.Certificate) == 0 || served[string(cert.Certificate.Certificate[0])] {
+				continue
+			}
+			served[string(cert.Certificate.Certificate[0])] = true
+
+			if stored[string(cert.Certificate.Certificate[0])] {
+				continue
+			}
+
+			leaf := cert.Leaf
+			if leaf == nil {
+				leaf, err = x509.ParseCertificate(cert.Certificate.Certificate[0])
+				if err != nil {
+					return result, fmt.Errorf("parsing cached certificate for %s: %v", name, err)
+				}
+			}
+
+			result.NotStored = append(result.NotStored, ReconciledCertificate{
+				Names:    cert.Names,
+				NotAfter: leaf.NotAfter,
+			})
+		}
+	}
+
+	for i, leaf := range storedLeafs {
+		if served[string(leaf.Raw)] || time.Now().After(leaf.NotAfter) {
+			continue
+		}
+
+		result.NotServed = append(result.NotServed, ReconciledCertificate{
+			Names:    certNames(leaf),
+			NotAfter: leaf.NotAfter,
+			Key:      storedKeys[i],
+		})
+	}
+
+	return result, nil
+}
+
+func certNames(leaf *x509.Certificate) []string {
+	names := append([]string(nil), leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// ReconcileAPI serves the reconciliation of the storage of this Caddy
+// instance with its certificate cache at /s3-storage/reconcile of the admin
+// API. Names besides those in the bucket and in the automation policies
+// are given as name query parameters. It also serves the health of the
+// storage at /s3-storage/health, its keys at /s3-storage/keys and their
+// usage at /s3-storage/usage.
+type ReconcileAPI struct {
+	ctx caddy.Context
+}
+
+func init() {
+	caddy.RegisterModule(ReconcileAPI{})
+}
+
+func (ReconcileAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "admin.api.s3_storage",
+		New: func() caddy.Module {
+			return new(ReconcileAPI)
+		},
+	}
+}
+
+func (a *ReconcileAPI) Provision(ctx caddy.Context) error {
+	a.ctx = ctx
+	return nil
+}
+
+func (a *ReconcileAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/s3-storage/reconcile",
+			Handler: caddy.AdminHandlerFunc(a.handleReconcile),
+		},
+		{
+			Pattern: "/s3-storage/health",
+			Handler: caddy.AdminHandlerFunc(a.handleHealth),
+		},
+		{
+			Pattern: "/s3-storage/usage",
+			Handler: caddy.AdminHandlerFunc(a.handleUsage),
+		},
+		{
+			Pattern: browsePath,
+			Handler: caddy.AdminHandlerFunc(a.handleBrowse),
+		},
+		{
+			Pattern: browsePath + "/",
+			Handler: caddy.AdminHandlerFunc(a.handleBrowse),
+		},
+	}
+}
+
+func (a *ReconcileAPI) handleReconcile(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	s3, ok := a.ctx.Storage().(S3)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("storage is not s3"),
+		}
+	}
+
+	if !a.ctx.AppIsConfigured("tls") {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("tls app is not configured"),
+		}
+	}
+	app, err := a.ctx.App("tls")
+	if err != nil {
+		return err
+	}
+	tlsApp := app.(*caddytls.TLS)
+
+	names := r.URL.Query()["name"]
+	if tlsApp.Automation != nil {
+		for _, policy := range tlsApp.Automation.Policies {
+			names = append(names, policy.Subjects...)
+		}
+	}
+
+	result, err := s3.Reconcile(r.Context(), tlsApp.AllMatchingCertificates, names)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(result)
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner = (*ReconcileAPI)(nil)
+	_ caddy.AdminRouter = (*ReconcileAPI)(nil)
+)
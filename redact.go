@@ -0,0 +1,113 @@
+package certmagic_s3
+
+import (
+	"encoding/json"
+	"net/url"
+)
+
+// redacted stands in for secrets in the serialized config of a provisioned
+// storage.
+const redacted = "REDACTED"
+
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactHeaders redacts the values of headers, as those configured for
+// webhooks mostly carry tokens, like Authorization.
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	redactedHeaders := make(map[string]string, len(headers))
+	for name, value := range headers {
+		redactedHeaders[name] = redactSecret(value)
+	}
+	return redactedHeaders
+}
+
+// redactURL redacts the password of a URL like that of a proxy.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); !ok {
+		return rawURL
+	}
+	u.User = url.UserPassword(u.User.Username(), redacted)
+	return u.String()
+}
+
+// MarshalJSON marshals the config with its secrets redacted once the
+// storage is provisioned, as it then holds them resolved from placeholders
+// and the environment. Unprovisioned configs, like those the Caddyfile
+// adapter produces, marshal as they are, since that's what Caddy loads.
+func (s3 S3) MarshalJSON() ([]byte, error) {
+	type config S3
+	c := config(s3)
+
+	if s3.provisioned {
+		c.SecretKey = redactSecret(c.SecretKey)
+		c.SessionToken = redactSecret(c.SessionToken)
+		c.SSECustomerKey = redactSecret(c.SSECustomerKey)
+		c.ProxyURL = redactURL(c.ProxyURL)
+
+		if c.Mirror != nil {
+			mirror := *c.Mirror
+			mirror.SecretKey = redactSecret(mirror.SecretKey)
+			mirror.SessionToken = redactSecret(mirror.SessionToken)
+			c.Mirror = &mirror
+		}
+		if c.Vault != nil {
+			vault := *c.Vault
+			vault.Token = redactSecret(vault.Token)
+			vault.SecretID = redactSecret(vault.SecretID)
+			c.Vault = &vault
+		}
+		if c.Audit != nil {
+			audit := *c.Audit
+			audit.Headers = redactHeaders(audit.Headers)
+			c.Audit = &audit
+		}
+		if c.Hooks != nil {
+			hooks := make([]Hook, len(c.Hooks))
+			for i, hook := range c.Hooks {
+				hook.Headers = redactHeaders(hook.Headers)
+				hooks[i] = hook
+			}
+			c.Hooks = hooks
+		}
+	}
+
+	return json.Marshal(c)
+}
+
+// MarshalJSON marshals the proxy storage with its token redacted once
+// provisioned, like S3.
+func (p Proxy) MarshalJSON() ([]byte, error) {
+	type config Proxy
+	c := config(p)
+
+	if p.client != nil {
+		c.Token = redactSecret(c.Token)
+	}
+
+	return json.Marshal(c)
+}
+
+// MarshalJSON marshals the proxy handler with its token redacted once
+// provisioned, like S3.
+func (h ProxyHandler) MarshalJSON() ([]byte, error) {
+	type config ProxyHandler
+	c := config(h)
+
+	if h.leases != nil {
+		c.Token = redactSecret(c.Token)
+	}
+
+	return json.Marshal(c)
+}
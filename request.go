@@ -0,0 +1,87 @@
+package certmagic_s3
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// do runs a single S3 request of the named operation. Everything that
+// applies to requests as a whole, like limits, retries and metrics, goes
+// here.
+//
+// Requests failing with a retryable error are retried by the retry policy.
+// If the credentials are rejected as expired, they are retrieved again, the
+// client is rebuilt and the request is retried once.
+func (s3 S3) do(ctx context.Context, operation string, request func() error) error {
+	if err := s3.ready(); err != nil {
+		return err
+	}
+
+	p := s3.priority(ctx, operation)
+	policy := s3.retryPolicy()
+
+	start := time.Now()
+
+	err := s3.attempt(ctx, operation, p, request)
+	for attempt := 1; attempt < policy.MaxAttempts && isRetryable(err); attempt++ {
+		delay := policy.backoff(attempt)
+
+		s3.log(logRequests).Debug("retrying", zap.String("operation", operation), zap.Int("attempt", attempt), zap.Duration("delay", delay), zap.Error(err))
+		traceRetry(ctx, operation, attempt, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			s3.observe(ctx, operation, start, err)
+			return err
+		}
+
+		err = s3.attempt(ctx, operation, p, request)
+	}
+
+	s3.observe(ctx, operation, start, err)
+
+	return err
+}
+
+// attempt sends the request once, once the limiters let it through.
+func (s3 S3) attempt(ctx context.Context, operation string, p priority, request func() error) error {
+	for _, l := range s3.limits {
+		done, err := l.wait(ctx, operation, p)
+		if err != nil {
+			return err
+		}
+		defer done()
+	}
+
+	if s3.breaker != nil {
+		if err := s3.breaker.allow(); err != nil {
+			return err
+		}
+	}
+
+	client := s3.client()
+
+	err := request()
+	if isRejectedCredentials(err) {
+		if refreshErr := s3.refreshClient(client); refreshErr != nil {
+			s3.log(logRequests).Error("refreshing credentials", append(s3.errorFields(refreshErr), zap.Error(refreshErr))...)
+		} else {
+			err = request()
+		}
+	}
+
+	// once the deadline passed, switching is all that's left to do
+	for s3.failOver(client, err) && ctx.Err() == nil {
+		client = s3.client()
+		err = request()
+	}
+
+	if s3.breaker != nil {
+		s3.breaker.record(err)
+	}
+
+	return err
+}
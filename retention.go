@@ -0,0 +1,97 @@
+package certmagic_s3
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+const (
+	retentionInterval = time.Hour
+
+	// retentionRunTime is how long a single run may take.
+	retentionRunTime = 10 * time.Minute
+)
+
+// retentionFor returns how long objects of class are kept, or zero if they
+// are kept until certmagic deletes them.
+func (s3 S3) retentionFor(class string) time.Duration {
+	return time.Duration(s3.Retention[class])
+}
+
+// enforceRetention periodically deletes the objects that are older than the
+// retention of their key class, until ctx is done. A run over a huge bucket
+// stops after retentionRunTime and the next one continues where it stopped.
+func (s3 S3) enforceRetention(ctx context.Context) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	var after string
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		runCtx, cancel := context.WithTimeout(ctx, retentionRunTime)
+		deleted, next, err := s3.deleteExpired(runCtx, after)
+		cancel()
+		if err != nil {
+			s3.logger.Error("enforcing retention", append(s3.errorFields(err), zap.Error(err))...)
+		} else {
+			after = next
+		}
+		if deleted > 0 {
+			s3.logger.Info("deleted objects past their retention", zap.Int("objects", deleted))
+		}
+		if after != "" {
+			s3.logger.Info("retention stopped, continuing with the next run", s3.keyField(after))
+		}
+	}
+}
+
+// deleteExpired deletes the expired objects listed after the object key
+// after, and returns the key to continue after if the deadline of ctx
+// stopped it.
+func (s3 S3) deleteExpired(ctx context.Context, after string) (int, string, error) {
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	prefix := s3.listPrefix("")
+
+	var deleted int
+
+	next, err := s3.listPage(ctx, minio.ListObjectsOptions{
+		Prefix:     prefix,
+		Recursive:  true,
+		StartAfter: after,
+	}, func(object minio.ObjectInfo) error {
+		key := s3.CutKeyPrefix(object.Key)
+		if key == sseCheckKey || strings.HasPrefix(key, budgetPrefix+"/") {
+			return nil
+		}
+
+		retention := s3.retentionFor(keyClass(key))
+		if retention <= 0 || time.Since(object.LastModified) < retention {
+			return nil
+		}
+
+		err := s3.do(ctx, "delete", func() error {
+			return s3.client().RemoveObject(ctx, s3.Bucket, object.Key, minio.RemoveObjectOptions{})
+		})
+		if err != nil {
+			return s3.explainError(err)
+		}
+
+		s3.log(logOperations).Debug("retention deleted", s3.keyField(object.Key), zap.Time("last_modified", object.LastModified))
+
+		deleted++
+		return nil
+	})
+
+	return deleted, next, err
+}
@@ -0,0 +1,114 @@
+package certmagic_s3
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryBase     = 100 * time.Millisecond
+	defaultRetryMax      = 5 * time.Second
+
+	jitterFull  = "full"
+	jitterEqual = "equal"
+	jitterNone  = "none"
+)
+
+// Retry is the policy for retrying failed requests. Delays grow
+// exponentially from Base up to Max. Jitter is "full" (the default, a
+// random delay up to the backoff), "equal" (half the backoff plus a random
+// part of the other half) or "none". MaxAttempts 1 disables retries.
+type Retry struct {
+	MaxAttempts int            `json:"max_attempts,omitempty"`
+	Base        caddy.Duration `json:"base,omitempty"`
+	Max         caddy.Duration `json:"max,omitempty"`
+	Jitter      string         `json:"jitter,omitempty"`
+}
+
+func validJitter(jitter string) bool {
+	switch jitter {
+	case "", jitterFull, jitterEqual, jitterNone:
+		return true
+	}
+	return false
+}
+
+// retryPolicy returns the configured policy with defaults filled in.
+func (s3 S3) retryPolicy() Retry {
+	var policy Retry
+	if s3.Retry != nil {
+		policy = *s3.Retry
+	}
+
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultRetryAttempts
+	}
+	if policy.Base <= 0 {
+		policy.Base = caddy.Duration(defaultRetryBase)
+	}
+	if policy.Max <= 0 {
+		policy.Max = caddy.Duration(defaultRetryMax)
+	}
+	if policy.Jitter == "" {
+		policy.Jitter = jitterFull
+	}
+
+	return policy
+}
+
+// backoff returns the delay before the next attempt, after attempt failed.
+func (r Retry) backoff(attempt int) time.Duration {
+	delay := time.Duration(r.Base)
+	for i := 1; i < attempt && delay < time.Duration(r.Max); i++ {
+		delay *= 2
+	}
+	if delay > time.Duration(r.Max) {
+		delay = time.Duration(r.Max)
+	}
+
+	switch r.Jitter {
+	case jitterFull:
+		return time.Duration(rand.Int63n(int64(delay) + 1))
+	case jitterEqual:
+		return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+	return delay
+}
+
+// isRetryable reports whether a request that failed with err may succeed
+// when sent again. All requests made through do are idempotent, so this
+// only depends on the error.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.As(err, new(CircuitOpenError)) {
+		return false
+	}
+
+	resp := minio.ToErrorResponse(err)
+	switch resp.Code {
+	case "InternalError", "ServiceUnavailable", "SlowDown", "RequestTimeout", "Throttling", "ThrottlingException", "RequestLimitExceeded":
+		return true
+	}
+	switch resp.StatusCode {
+	case 429, 500, 502, 503, 504:
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
@@ -3,34 +3,218 @@ package certmagic_s3
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/certmagic"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 	"go.uber.org/zap"
 )
 
 type S3 struct {
 	logger *zap.Logger
 
+	// secrets are redacted when marshaling once set
+	provisioned bool
+
+	// stops the background work of storages created with New
+	stop context.CancelFunc
+
+	// Curated defaults
+	Preset string `json:"preset"`
+
+	// S3-compatible service the bucket is at, if it needs a profile
+	Provider string `json:"provider"`
+
 	// S3
-	Client         *minio.Client
-	Host           string `json:"host"`
-	Bucket         string `json:"bucket"`
-	AccessID       string `json:"access_id"`
-	SecretKey      string `json:"secret_key"`
-	Prefix         string `json:"prefix"`
-	Insecure       bool   `json:"insecure"`
-	UseIamProvider bool   `json:"use_iam_provider"`
+	Client          *minio.Client
+	Host            string `json:"host"`
+	Bucket          string `json:"bucket"`
+	Region          string `json:"region"`
+	AccessID        string `json:"access_id"`
+	SecretKey       string `json:"secret_key"`
+	AccessIDFile    string `json:"access_id_file"`
+	SecretKeyFile   string `json:"secret_key_file"`
+	SessionToken    string `json:"session_token"`
+	Profile         string `json:"profile"`
+	CredentialsFile string `json:"credentials_file"`
+	Prefix          string `json:"prefix"`
+	KeyEncoding     string `json:"key_encoding"`
+	Layout          string `json:"layout"`
+	ListAPI         string `json:"list_api"`
+	Insecure        bool   `json:"insecure"`
+	CAFile          string `json:"ca_file"`
+	CAPEM           string `json:"ca_pem"`
+	TLSMinVersion   string `json:"tls_min_version"`
+	TLSServerName   string `json:"tls_server_name"`
+	ClientCertFile  string `json:"client_cert_file"`
+	ClientKeyFile   string `json:"client_key_file"`
+	ProxyURL        string `json:"proxy_url"`
+	UseIamProvider  bool   `json:"use_iam_provider"`
+	Accelerate      bool   `json:"accelerate"`
+	DualStack       bool   `json:"dual_stack"`
+	FIPS            bool   `json:"fips"`
+	creds           *credentials.Credentials
+	current         *currentClient
+	httpTransport   *http.Transport
+	throttle        *throttle
+	caps            *capabilities
+
+	// Connections to the endpoint
+	Transport *Transport `json:"transport,omitempty"`
+
+	// Wait for a new bucket to become usable
+	BucketWait caddy.Duration `json:"bucket_wait,omitempty"`
+
+	// Create the bucket if it doesn't exist
+	CreateBucket *CreateBucket `json:"create_bucket,omitempty"`
+
+	// Don't check the bucket and permissions at provisioning
+	SkipSelfTest bool `json:"skip_self_test"`
+
+	// Endpoint discovery
+	Discovery *Discovery `json:"discovery,omitempty"`
+
+	// Endpoints to fail over to
+	Failover *Failover `json:"failover,omitempty"`
+	failover *failover
+
+	// Connect on first use
+	LazyProvision bool `json:"lazy_provision"`
+	lazy          *lazyConnect
+
+	// STS AssumeRole
+	RoleARN         string `json:"role_arn"`
+	ExternalID      string `json:"external_id"`
+	RoleSessionName string `json:"role_session_name"`
+	STSEndpoint     string `json:"sts_endpoint"`
+	STSRegion       string `json:"sts_region"`
+
+	// STS AssumeRoleWithWebIdentity
+	WebIdentityTokenFile string `json:"web_identity_token_file"`
+
+	// HashiCorp Vault
+	Vault *Vault `json:"vault,omitempty"`
+
+	// Encryption
+	SSECustomerKey string      `json:"sse_customer_key"`
+	Encryption     *Encryption `json:"encryption,omitempty"`
+	sse            encrypt.ServerSide
+	encryptor      *ageEncryptor
+
+	// Integrity
+	OnChecksumMismatch map[string]string `json:"on_checksum_mismatch,omitempty"`
+
+	// Retention, per key class
+	Retention map[string]caddy.Duration `json:"retention,omitempty"`
+
+	// Move deleted keys to the trash instead
+	SoftDelete bool `json:"soft_delete"`
+
+	// Bucket lifecycle rules expiring the trash, locks and uploads
+	Lifecycle *Lifecycle `json:"lifecycle,omitempty"`
+
+	// Sites kept under prefixes of their own, by tenant name
+	Tenants      map[string]*Tenant `json:"tenants,omitempty"`
+	TenantPrefix string             `json:"tenant_prefix"`
+
+	// Deleting expired certificates, orphaned staples and dead locks
+	GarbageCollection *GarbageCollection `json:"garbage_collection,omitempty"`
+
+	// Logging
+	LogKeys   string            `json:"log_keys"`
+	LogLevels map[string]string `json:"log_levels,omitempty"`
+	loggers   map[string]*zap.Logger
+
+	// Log every HTTP exchange, scrubbed of credentials
+	TraceRequests bool `json:"trace_requests"`
+
+	// Fail on malformed environment variables
+	StrictEnv bool `json:"strict_env"`
+
+	// Metrics
+	Metrics         bool   `json:"metrics"`
+	MetricsBackend  string `json:"metrics_backend"`
+	MetricsEndpoint string `json:"metrics_endpoint"`
+	meter           metricsBackend
+
+	// Locking
+	FenceWrites    bool   `json:"fence_writes"`
+	VerifyIssuance bool   `json:"verify_issuance"`
+	LockStrategy   string `json:"lock_strategy"`
+	locks          *lockSet
+	etags          *etagSet
+	usage          *usageCache
+	writes         *inflight
+
+	// In-memory read cache
+	Cache *Cache `json:"cache,omitempty"`
+	cache *readCache
+
+	// Second bucket for disaster recovery
+	Mirror *Mirror `json:"mirror,omitempty"`
+	mirror *mirror
+
+	// Local directory for writes S3 can't take
+	Spool string `json:"spool"`
+	spool *spool
+
+	// Write through a temporary key and a server-side copy
+	AtomicStore bool `json:"atomic_store"`
+
+	// Storage class, per key pattern
+	StorageClass   string             `json:"storage_class"`
+	StorageClasses []StorageClassRule `json:"storage_classes,omitempty"`
+
+	// Buckets with S3 Object Lock
+	ObjectLock *ObjectLock `json:"object_lock,omitempty"`
+
+	// Object tags
+	Tagging    *Tagging `json:"tagging,omitempty"`
+	instanceID string
+
+	// Record of every mutation
+	Audit     *Audit `json:"audit,omitempty"`
+	auditSink *auditSink
+
+	// Webhooks called on storage events
+	Hooks []Hook `json:"hooks,omitempty"`
+	hooks *hooks
+
+	// Retries
+	Retry *Retry `json:"retry,omitempty"`
+
+	// Deadlines of operations
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+
+	// Periodic health checks
+	HealthCheck *HealthCheck `json:"health_check,omitempty"`
+	health      *health
+
+	// Fail fast while the endpoint is down
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"`
+	breaker        *circuitBreaker
+
+	// Limits
+	Priorities       map[string]string `json:"priorities,omitempty"`
+	RateLimit        *RateLimit        `json:"rate_limit,omitempty"`
+	ClusterRateLimit float64           `json:"cluster_rate_limit"`
+	MaxConcurrent    int               `json:"max_concurrent_requests"`
+	limits           []limiter
+
+	pressure []pressureSource
 }
 
 func init() {
@@ -39,48 +223,968 @@ func init() {
 
 func (s3 *S3) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
-		var value string
-
-		key := d.Val()
-
-		if !d.Args(&value) {
-			continue
-		}
-
-		switch key {
-		case "host":
-			s3.Host = value
-		case "bucket":
-			s3.Bucket = value
-		case "access_id":
-			s3.AccessID = value
-		case "secret_key":
-			s3.SecretKey = value
-		case "prefix":
-			s3.Prefix = value
-		case "insecure":
-			insecure, err := strconv.ParseBool(value)
-			if err != nil {
-				return d.Err("Invalid usage of insecure in s3-storage config: " + err.Error())
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var value string
+
+			key := d.Val()
+
+			switch key {
+			case "encryption":
+				if s3.Encryption == nil {
+					s3.Encryption = new(Encryption)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "age_identity_file":
+						if !d.AllArgs(&s3.Encryption.AgeIdentityFile) {
+							return d.ArgErr()
+						}
+					case "age_recipients":
+						s3.Encryption.AgeRecipients = append(s3.Encryption.AgeRecipients, d.RemainingArgs()...)
+					case "patterns":
+						s3.Encryption.Patterns = append(s3.Encryption.Patterns, d.RemainingArgs()...)
+					default:
+						return d.Errf("Invalid usage of encryption in s3-storage config: unrecognized option %s", d.Val())
+					}
+				}
+				continue
+			case "discovery":
+				if s3.Discovery == nil {
+					s3.Discovery = new(Discovery)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "srv":
+						if !d.AllArgs(&s3.Discovery.SRV) {
+							return d.ArgErr()
+						}
+					case "url":
+						if !d.AllArgs(&s3.Discovery.URL) {
+							return d.ArgErr()
+						}
+					case "interval":
+						var interval string
+						if !d.AllArgs(&interval) {
+							return d.ArgErr()
+						}
+						duration, err := caddy.ParseDuration(interval)
+						if err != nil {
+							return d.Err("Invalid usage of discovery interval in s3-storage config: " + err.Error())
+						}
+						s3.Discovery.Interval = caddy.Duration(duration)
+					default:
+						return d.Errf("Invalid usage of discovery in s3-storage config: unrecognized option %s", d.Val())
+					}
+				}
+				continue
+			case "transport":
+				if s3.Transport == nil {
+					s3.Transport = new(Transport)
+				}
+				durations := map[string]*caddy.Duration{
+					"dial_timeout":            &s3.Transport.DialTimeout,
+					"keep_alive":              &s3.Transport.KeepAlive,
+					"tls_handshake_timeout":   &s3.Transport.TLSHandshakeTimeout,
+					"response_header_timeout": &s3.Transport.ResponseHeaderTimeout,
+					"idle_conn_timeout":       &s3.Transport.IdleConnTimeout,
+				}
+				counts := map[string]*int{
+					"max_idle_conns":          &s3.Transport.MaxIdleConns,
+					"max_idle_conns_per_host": &s3.Transport.MaxIdleConnsPerHost,
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					if duration, ok := durations[option]; ok {
+						parsed, err := caddy.ParseDuration(value)
+						if err != nil {
+							return d.Errf("Invalid usage of transport %s in s3-storage config: %v", option, err)
+						}
+						*duration = caddy.Duration(parsed)
+					} else if count, ok := counts[option]; ok {
+						parsed, err := strconv.Atoi(value)
+						if err != nil {
+							return d.Errf("Invalid usage of transport %s in s3-storage config: %v", option, err)
+						}
+						*count = parsed
+					} else {
+						return d.Errf("Invalid usage of transport in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "retry":
+				if s3.Retry == nil {
+					s3.Retry = new(Retry)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					switch option {
+					case "max_attempts":
+						attempts, err := strconv.Atoi(value)
+						if err != nil {
+							return d.Err("Invalid usage of retry max_attempts in s3-storage config: " + err.Error())
+						}
+						s3.Retry.MaxAttempts = attempts
+					case "base", "max":
+						duration, err := caddy.ParseDuration(value)
+						if err != nil {
+							return d.Errf("Invalid usage of retry %s in s3-storage config: %v", option, err)
+						}
+						if option == "base" {
+							s3.Retry.Base = caddy.Duration(duration)
+						} else {
+							s3.Retry.Max = caddy.Duration(duration)
+						}
+					case "jitter":
+						if !validJitter(value) {
+							return d.Err("Invalid usage of retry jitter in s3-storage config: must be one of full, equal, none")
+						}
+						s3.Retry.Jitter = value
+					default:
+						return d.Errf("Invalid usage of retry in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "cache":
+				if s3.Cache == nil {
+					s3.Cache = new(Cache)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					switch option {
+					case "ttl":
+						duration, err := caddy.ParseDuration(value)
+						if err != nil {
+							return d.Err("Invalid usage of cache ttl in s3-storage config: " + err.Error())
+						}
+						s3.Cache.TTL = caddy.Duration(duration)
+					case "max_entries":
+						max, err := strconv.Atoi(value)
+						if err != nil {
+							return d.Err("Invalid usage of cache max_entries in s3-storage config: " + err.Error())
+						}
+						s3.Cache.MaxEntries = max
+					case "listen_notifications":
+						listen, err := strconv.ParseBool(value)
+						if err != nil {
+							return d.Err("Invalid usage of cache listen_notifications in s3-storage config: " + err.Error())
+						}
+						s3.Cache.ListenNotifications = listen
+					default:
+						return d.Errf("Invalid usage of cache in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "rate_limit":
+				if s3.RateLimit == nil {
+					s3.RateLimit = new(RateLimit)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					switch option {
+					case "requests", "list", "objects":
+						rate, err := strconv.ParseFloat(value, 64)
+						if err != nil {
+							return d.Errf("Invalid usage of rate_limit %s in s3-storage config: %v", option, err)
+						}
+						switch option {
+						case "requests":
+							s3.RateLimit.Requests = rate
+						case "list":
+							s3.RateLimit.List = rate
+						case "objects":
+							s3.RateLimit.Objects = rate
+						}
+					case "burst", "list_burst", "objects_burst":
+						burst, err := strconv.Atoi(value)
+						if err != nil {
+							return d.Errf("Invalid usage of rate_limit %s in s3-storage config: %v", option, err)
+						}
+						switch option {
+						case "burst":
+							s3.RateLimit.Burst = burst
+						case "list_burst":
+							s3.RateLimit.ListBurst = burst
+						case "objects_burst":
+							s3.RateLimit.ObjectsBurst = burst
+						}
+					default:
+						return d.Errf("Invalid usage of rate_limit in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "timeouts":
+				if s3.Timeouts == nil {
+					s3.Timeouts = new(Timeouts)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					kind := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					if _, ok := defaultTimeouts[kind]; !ok {
+						return d.Errf("Invalid usage of timeouts in s3-storage config: unrecognized operation type %s", kind)
+					}
+					duration, err := caddy.ParseDuration(value)
+					if err != nil {
+						return d.Errf("Invalid usage of timeouts %s in s3-storage config: %v", kind, err)
+					}
+					s3.Timeouts.set(kind, caddy.Duration(duration))
+				}
+				continue
+			case "circuit_breaker":
+				if s3.CircuitBreaker == nil {
+					s3.CircuitBreaker = new(CircuitBreaker)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					switch option {
+					case "failures":
+						failures, err := strconv.Atoi(value)
+						if err != nil {
+							return d.Err("Invalid usage of circuit_breaker failures in s3-storage config: " + err.Error())
+						}
+						s3.CircuitBreaker.Failures = failures
+					case "probe_interval":
+						duration, err := caddy.ParseDuration(value)
+						if err != nil {
+							return d.Err("Invalid usage of circuit_breaker probe_interval in s3-storage config: " + err.Error())
+						}
+						s3.CircuitBreaker.ProbeInterval = caddy.Duration(duration)
+					default:
+						return d.Errf("Invalid usage of circuit_breaker in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "vault":
+				if s3.Vault == nil {
+					s3.Vault = new(Vault)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					switch option {
+					case "address":
+						s3.Vault.Address = value
+					case "secret_path":
+						s3.Vault.SecretPath = value
+					case "auth":
+						s3.Vault.Auth = value
+					case "auth_mount":
+						s3.Vault.AuthMount = value
+					case "token":
+						s3.Vault.Token = value
+					case "role_id":
+						s3.Vault.RoleID = value
+					case "secret_id":
+						s3.Vault.SecretID = value
+					case "role":
+						s3.Vault.Role = value
+					case "token_file":
+						s3.Vault.TokenFile = value
+					default:
+						return d.Errf("Invalid usage of vault in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "priorities":
+				if s3.Priorities == nil {
+					s3.Priorities = make(map[string]string)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					operation := d.Val()
+					var name string
+					if !d.AllArgs(&name) {
+						return d.ArgErr()
+					}
+					if !validPriority(name) {
+						return d.Errf("Invalid usage of priorities in s3-storage config: unrecognized priority %s", name)
+					}
+					s3.Priorities[operation] = name
+				}
+				continue
+			case "failover":
+				if s3.Failover == nil {
+					s3.Failover = new(Failover)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "endpoint":
+						args := d.RemainingArgs()
+						if len(args) < 1 || len(args) > 3 {
+							return d.ArgErr()
+						}
+						endpoint := FailoverEndpoint{Host: args[0]}
+						if len(args) > 1 {
+							priority, err := strconv.Atoi(args[1])
+							if err != nil {
+								return d.Err("Invalid usage of failover endpoint priority in s3-storage config: " + err.Error())
+							}
+							endpoint.Priority = priority
+						}
+						if len(args) > 2 {
+							endpoint.Region = args[2]
+						}
+						s3.Failover.Endpoints = append(s3.Failover.Endpoints, endpoint)
+					case "probe_interval":
+						var value string
+						if !d.AllArgs(&value) {
+							return d.ArgErr()
+						}
+						duration, err := caddy.ParseDuration(value)
+						if err != nil {
+							return d.Err("Invalid usage of failover probe_interval in s3-storage config: " + err.Error())
+						}
+						s3.Failover.ProbeInterval = caddy.Duration(duration)
+					default:
+						return d.Errf("Invalid usage of failover in s3-storage config: unrecognized option %s", d.Val())
+					}
+				}
+				continue
+			case "mirror":
+				if s3.Mirror == nil {
+					s3.Mirror = new(Mirror)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					switch option {
+					case "host":
+						s3.Mirror.Host = value
+					case "bucket":
+						s3.Mirror.Bucket = value
+					case "region":
+						s3.Mirror.Region = value
+					case "access_id":
+						s3.Mirror.AccessID = value
+					case "secret_key":
+						s3.Mirror.SecretKey = value
+					case "access_id_file":
+						s3.Mirror.AccessIDFile = value
+					case "secret_key_file":
+						s3.Mirror.SecretKeyFile = value
+					case "session_token":
+						s3.Mirror.SessionToken = value
+					case "prefix":
+						s3.Mirror.Prefix = value
+					case "insecure", "use_iam_provider":
+						enabled, err := strconv.ParseBool(value)
+						if err != nil {
+							return d.Errf("Invalid usage of mirror %s in s3-storage config: %v", option, err)
+						}
+						if option == "insecure" {
+							s3.Mirror.Insecure = enabled
+						} else {
+							s3.Mirror.UseIamProvider = enabled
+						}
+					case "mode":
+						s3.Mirror.Mode = value
+					case "queue_size":
+						size, err := strconv.Atoi(value)
+						if err != nil {
+							return d.Err("Invalid usage of mirror queue_size in s3-storage config: " + err.Error())
+						}
+						s3.Mirror.QueueSize = size
+					default:
+						return d.Errf("Invalid usage of mirror in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "garbage_collection":
+				if s3.GarbageCollection == nil {
+					s3.GarbageCollection = new(GarbageCollection)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "interval", "grace":
+						option := d.Val()
+						var value string
+						if !d.AllArgs(&value) {
+							return d.ArgErr()
+						}
+						duration, err := caddy.ParseDuration(value)
+						if err != nil {
+							return d.Err("Invalid usage of garbage_collection " + option + " in s3-storage config: " + err.Error())
+						}
+						if option == "interval" {
+							s3.GarbageCollection.Interval = caddy.Duration(duration)
+						} else {
+							s3.GarbageCollection.Grace = caddy.Duration(duration)
+						}
+					case "dry_run":
+						s3.GarbageCollection.DryRun = true
+					default:
+						return d.Errf("Invalid usage of garbage_collection in s3-storage config: unrecognized option %s", d.Val())
+					}
+				}
+				continue
+			case "retention":
+				if s3.Retention == nil {
+					s3.Retention = make(map[string]caddy.Duration)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					class := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					if !validKeyClass(class) {
+						return d.Errf("Invalid usage of retention in s3-storage config: unrecognized key class %s", class)
+					}
+					duration, err := caddy.ParseDuration(value)
+					if err != nil {
+						return d.Errf("Invalid usage of retention in s3-storage config: %v", err)
+					}
+					s3.Retention[class] = caddy.Duration(duration)
+				}
+				continue
+			case "tenant":
+				var name string
+				if !d.Args(&name) {
+					return d.ArgErr()
+				}
+				if s3.Tenants == nil {
+					s3.Tenants = make(map[string]*Tenant)
+				}
+				tenant := s3.Tenants[name]
+				if tenant == nil {
+					tenant = new(Tenant)
+					s3.Tenants[name] = tenant
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "domains":
+						domains := d.RemainingArgs()
+						if len(domains) == 0 {
+							return d.ArgErr()
+						}
+						tenant.Domains = append(tenant.Domains, domains...)
+					case "prefix":
+						if !d.AllArgs(&tenant.Prefix) {
+							return d.ArgErr()
+						}
+					case "max_objects":
+						var value string
+						if !d.AllArgs(&value) {
+							return d.ArgErr()
+						}
+						maxObjects, err := strconv.Atoi(value)
+						if err != nil {
+							return d.Err("Invalid usage of tenant max_objects in s3-storage config: " + err.Error())
+						}
+						tenant.MaxObjects = maxObjects
+					case "max_bytes":
+						var value string
+						if !d.AllArgs(&value) {
+							return d.ArgErr()
+						}
+						maxBytes, err := strconv.ParseInt(value, 10, 64)
+						if err != nil {
+							return d.Err("Invalid usage of tenant max_bytes in s3-storage config: " + err.Error())
+						}
+						tenant.MaxBytes = maxBytes
+					default:
+						return d.Errf("Invalid usage of tenant in s3-storage config: unrecognized option %s", d.Val())
+					}
+				}
+				continue
+			case "create_bucket":
+				if s3.CreateBucket == nil {
+					s3.CreateBucket = new(CreateBucket)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					switch option {
+					case "region":
+						s3.CreateBucket.Region = value
+					case "versioning":
+						versioning, err := strconv.ParseBool(value)
+						if err != nil {
+							return d.Err("Invalid usage of create_bucket versioning in s3-storage config: " + err.Error())
+						}
+						s3.CreateBucket.Versioning = versioning
+					default:
+						return d.Errf("Invalid usage of create_bucket in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "health_check":
+				if s3.HealthCheck == nil {
+					s3.HealthCheck = new(HealthCheck)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					switch option {
+					case "interval", "degraded_latency":
+						duration, err := caddy.ParseDuration(value)
+						if err != nil {
+							return d.Errf("Invalid usage of health_check %s in s3-storage config: %v", option, err)
+						}
+						if option == "interval" {
+							s3.HealthCheck.Interval = caddy.Duration(duration)
+						} else {
+							s3.HealthCheck.DegradedLatency = caddy.Duration(duration)
+						}
+					case "failures":
+						failures, err := strconv.Atoi(value)
+						if err != nil {
+							return d.Err("Invalid usage of health_check failures in s3-storage config: " + err.Error())
+						}
+						s3.HealthCheck.Failures = failures
+					default:
+						return d.Errf("Invalid usage of health_check in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "log_levels":
+				if s3.LogLevels == nil {
+					s3.LogLevels = make(map[string]string)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					category := d.Val()
+					var level string
+					if !d.AllArgs(&level) {
+						return d.ArgErr()
+					}
+					if !validLogCategory(category) {
+						return d.Errf("Invalid usage of log_levels in s3-storage config: unrecognized category %s", category)
+					}
+					s3.LogLevels[category] = level
+				}
+				continue
+			case "storage_classes":
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					pattern := d.Val()
+					var class string
+					if !d.AllArgs(&class) {
+						return d.ArgErr()
+					}
+					s3.StorageClasses = append(s3.StorageClasses, StorageClassRule{Pattern: pattern, StorageClass: class})
+				}
+				continue
+			case "object_lock":
+				if s3.ObjectLock == nil {
+					s3.ObjectLock = new(ObjectLock)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					switch option {
+					case "mode":
+						s3.ObjectLock.Mode = value
+					case "retain":
+						duration, err := caddy.ParseDuration(value)
+						if err != nil {
+							return d.Err("Invalid usage of object_lock retain in s3-storage config: " + err.Error())
+						}
+						s3.ObjectLock.Retain = caddy.Duration(duration)
+					default:
+						return d.Errf("Invalid usage of object_lock in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "tagging":
+				if s3.Tagging == nil {
+					s3.Tagging = new(Tagging)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					name := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					if s3.Tagging.Tags == nil {
+						s3.Tagging.Tags = make(map[string]string)
+					}
+					s3.Tagging.Tags[name] = value
+				}
+				continue
+			case "audit":
+				if s3.Audit == nil {
+					s3.Audit = new(Audit)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "prefix":
+						if !d.AllArgs(&s3.Audit.Prefix) {
+							return d.ArgErr()
+						}
+					case "webhook":
+						if !d.AllArgs(&s3.Audit.Webhook) {
+							return d.ArgErr()
+						}
+					case "header":
+						var name, value string
+						if !d.AllArgs(&name, &value) {
+							return d.ArgErr()
+						}
+						if s3.Audit.Headers == nil {
+							s3.Audit.Headers = make(map[string]string)
+						}
+						s3.Audit.Headers[name] = value
+					default:
+						return d.Errf("Invalid usage of audit in s3-storage config: unrecognized option %s", d.Val())
+					}
+				}
+				continue
+			case "lifecycle":
+				if s3.Lifecycle == nil {
+					s3.Lifecycle = new(Lifecycle)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					option := d.Val()
+					var value string
+					if !d.AllArgs(&value) {
+						return d.ArgErr()
+					}
+					days, err := strconv.Atoi(value)
+					if err != nil {
+						return d.Errf("Invalid usage of lifecycle %s in s3-storage config: %v", option, err)
+					}
+					switch option {
+					case "trash_days":
+						s3.Lifecycle.TrashDays = days
+					case "lock_days":
+						s3.Lifecycle.LockDays = days
+					case "upload_days":
+						s3.Lifecycle.UploadDays = days
+					default:
+						return d.Errf("Invalid usage of lifecycle in s3-storage config: unrecognized option %s", option)
+					}
+				}
+				continue
+			case "hook":
+				hook := Hook{}
+				if !d.Args(&hook.URL) {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "events":
+						events := d.RemainingArgs()
+						if len(events) == 0 {
+							return d.ArgErr()
+						}
+						for _, event := range events {
+							if !validHookEvent(event) {
+								return d.Errf("Invalid usage of hook in s3-storage config: unrecognized event %s", event)
+							}
+						}
+						hook.Events = append(hook.Events, events...)
+					case "keys":
+						keys := d.RemainingArgs()
+						if len(keys) == 0 {
+							return d.ArgErr()
+						}
+						hook.Keys = append(hook.Keys, keys...)
+					case "header":
+						var name, value string
+						if !d.AllArgs(&name, &value) {
+							return d.ArgErr()
+						}
+						if hook.Headers == nil {
+							hook.Headers = make(map[string]string)
+						}
+						hook.Headers[name] = value
+					default:
+						return d.Errf("Invalid usage of hook in s3-storage config: unrecognized option %s", d.Val())
+					}
+				}
+				s3.Hooks = append(s3.Hooks, hook)
+				continue
+			case "on_checksum_mismatch":
+				if s3.OnChecksumMismatch == nil {
+					s3.OnChecksumMismatch = make(map[string]string)
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					class := d.Val()
+					var action string
+					if !d.AllArgs(&action) {
+						return d.ArgErr()
+					}
+					if !validMismatchClass(class) {
+						return d.Errf("Invalid usage of on_checksum_mismatch in s3-storage config: unrecognized key class %s", class)
+					}
+					if !validMismatchAction(action) {
+						return d.Errf("Invalid usage of on_checksum_mismatch in s3-storage config: unrecognized action %s", action)
+					}
+					s3.OnChecksumMismatch[class] = action
+				}
+				continue
 			}
-			s3.Insecure = insecure
-		case "use_iam_provider":
-			boolValue, err := strconv.ParseBool(value)
-			if err != nil {
-				return d.Err("Invalid usage of use_iam_provider in s3-storage config: " + err.Error())
+
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
 			}
-			s3.UseIamProvider = boolValue
-		}
 
+			switch key {
+			case "preset":
+				if _, ok := presets[value]; !ok {
+					return d.Errf("Invalid usage of preset in s3-storage config: must be one of %s", presetNames())
+				}
+				s3.Preset = value
+			case "provider":
+				if _, ok := providers[value]; !ok {
+					return d.Errf("Invalid usage of provider in s3-storage config: must be one of %s", providerNames())
+				}
+				s3.Provider = value
+			case "host":
+				s3.Host = value
+			case "bucket":
+				s3.Bucket = value
+			case "bucket_wait":
+				duration, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Err("Invalid usage of bucket_wait in s3-storage config: " + err.Error())
+				}
+				s3.BucketWait = caddy.Duration(duration)
+			case "region":
+				s3.Region = value
+			case "lazy_provision":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of lazy_provision in s3-storage config: " + err.Error())
+				}
+				s3.LazyProvision = boolValue
+			case "access_id":
+				s3.AccessID = value
+			case "secret_key":
+				s3.SecretKey = value
+			case "access_id_file":
+				s3.AccessIDFile = value
+			case "secret_key_file":
+				s3.SecretKeyFile = value
+			case "session_token":
+				s3.SessionToken = value
+			case "profile":
+				s3.Profile = value
+			case "credentials_file":
+				s3.CredentialsFile = value
+			case "prefix":
+				s3.Prefix = value
+			case "key_encoding":
+				s3.KeyEncoding = value
+			case "layout":
+				s3.Layout = value
+			case "list_api":
+				if !validListAPI(value) {
+					return d.Err("Invalid usage of list_api in s3-storage config: must be one of v1, v2, auto")
+				}
+				s3.ListAPI = value
+			case "lock_strategy":
+				if !validLockStrategy(value) {
+					return d.Err("Invalid usage of lock_strategy in s3-storage config: must be one of conditional, candidates, auto")
+				}
+				s3.LockStrategy = value
+			case "tenant_prefix":
+				s3.TenantPrefix = value
+			case "spool":
+				s3.Spool = value
+			case "insecure":
+				insecure, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of insecure in s3-storage config: " + err.Error())
+				}
+				s3.Insecure = insecure
+			case "ca_file":
+				s3.CAFile = value
+			case "ca_pem":
+				s3.CAPEM = value
+			case "tls_min_version":
+				s3.TLSMinVersion = value
+			case "tls_server_name":
+				s3.TLSServerName = value
+			case "client_cert_file":
+				s3.ClientCertFile = value
+			case "client_key_file":
+				s3.ClientKeyFile = value
+			case "proxy_url":
+				s3.ProxyURL = value
+			case "use_iam_provider":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of use_iam_provider in s3-storage config: " + err.Error())
+				}
+				s3.UseIamProvider = boolValue
+			case "role_arn":
+				s3.RoleARN = value
+			case "external_id":
+				s3.ExternalID = value
+			case "role_session_name":
+				s3.RoleSessionName = value
+			case "sts_endpoint":
+				s3.STSEndpoint = value
+			case "sts_region":
+				s3.STSRegion = value
+			case "web_identity_token_file":
+				s3.WebIdentityTokenFile = value
+			case "fence_writes":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of fence_writes in s3-storage config: " + err.Error())
+				}
+				s3.FenceWrites = boolValue
+			case "storage_class":
+				s3.StorageClass = value
+			case "skip_self_test":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of skip_self_test in s3-storage config: " + err.Error())
+				}
+				s3.SkipSelfTest = boolValue
+			case "atomic_store":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of atomic_store in s3-storage config: " + err.Error())
+				}
+				s3.AtomicStore = boolValue
+			case "cluster_rate_limit":
+				limit, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return d.Err("Invalid usage of cluster_rate_limit in s3-storage config: " + err.Error())
+				}
+				s3.ClusterRateLimit = limit
+			case "strict_env":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of strict_env in s3-storage config: " + err.Error())
+				}
+				s3.StrictEnv = boolValue
+			case "max_concurrent_requests":
+				max, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Err("Invalid usage of max_concurrent_requests in s3-storage config: " + err.Error())
+				}
+				s3.MaxConcurrent = max
+			case "verify_issuance":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of verify_issuance in s3-storage config: " + err.Error())
+				}
+				s3.VerifyIssuance = boolValue
+			case "dual_stack":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of dual_stack in s3-storage config: " + err.Error())
+				}
+				s3.DualStack = boolValue
+			case "fips":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of fips in s3-storage config: " + err.Error())
+				}
+				s3.FIPS = boolValue
+			case "accelerate":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of accelerate in s3-storage config: " + err.Error())
+				}
+				s3.Accelerate = boolValue
+			case "soft_delete":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of soft_delete in s3-storage config: " + err.Error())
+				}
+				s3.SoftDelete = boolValue
+			case "trace_requests":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of trace_requests in s3-storage config: " + err.Error())
+				}
+				s3.TraceRequests = boolValue
+			case "sse_customer_key":
+				s3.SSECustomerKey = value
+			case "metrics":
+				boolValue, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Err("Invalid usage of metrics in s3-storage config: " + err.Error())
+				}
+				s3.Metrics = boolValue
+			case "metrics_backend":
+				if !validMetricsBackend(value) {
+					return d.Err("Invalid usage of metrics_backend in s3-storage config: must be one of prometheus, statsd, otlp")
+				}
+				s3.MetricsBackend = value
+			case "metrics_endpoint":
+				s3.MetricsEndpoint = value
+			case "log_keys":
+				if !validLogKeys(value) {
+					return d.Err("Invalid usage of log_keys in s3-storage config: must be one of full, hash, truncate")
+				}
+				s3.LogKeys = value
+			default:
+				return d.Errf("Invalid usage of s3-storage config: unrecognized option %s", key)
+			}
+		}
 	}
 
 	return nil
 }
 
 func (s3 *S3) Provision(ctx caddy.Context) error {
-	s3.logger = ctx.Logger(s3)
+	return s3.provision(ctx.Context, ctx.Logger(s3))
+}
+
+// provision sets the storage up and connects to the endpoint, unless that
+// is deferred. Background work stops when ctx is done.
+func (s3 *S3) provision(ctx context.Context, logger *zap.Logger) error {
+	s3.logger = logger
 
 	// Load Environment
+	if !s3.StrictEnv {
+		boolVal := os.Getenv("S3_STRICT_ENV")
+		if boolVal != "" {
+			strict, err := strconv.ParseBool(boolVal)
+			if err != nil {
+				s3.logger.Warn("ignoring malformed environment variable", zap.String("variable", "S3_STRICT_ENV"), zap.String("expected", "a boolean"), zap.String("got", envShape(boolVal)))
+			}
+			s3.StrictEnv = strict
+		}
+	}
+
+	s3.replacePlaceholders()
+
 	if s3.Host == "" {
 		s3.Host = os.Getenv("S3_HOST")
 	}
@@ -89,6 +1193,20 @@ func (s3 *S3) Provision(ctx caddy.Context) error {
 		s3.Bucket = os.Getenv("S3_BUCKET")
 	}
 
+	if s3.Region == "" {
+		s3.Region = os.Getenv("S3_REGION")
+	}
+
+	if err := s3.envBool("S3_DUAL_STACK", &s3.DualStack); err != nil {
+		return err
+	}
+	if err := s3.envBool("S3_FIPS", &s3.FIPS); err != nil {
+		return err
+	}
+	if (s3.DualStack || s3.FIPS) && s3.Host == "" && s3.Region != "" {
+		s3.Host = awsEndpoint(s3.Region, s3.DualStack, s3.FIPS)
+	}
+
 	if s3.AccessID == "" {
 		s3.AccessID = os.Getenv("S3_ACCESS_ID")
 	}
@@ -97,44 +1215,478 @@ func (s3 *S3) Provision(ctx caddy.Context) error {
 		s3.SecretKey = os.Getenv("S3_SECRET_KEY")
 	}
 
+	if s3.AccessIDFile == "" {
+		s3.AccessIDFile = os.Getenv("S3_ACCESS_ID_FILE")
+	}
+
+	if s3.SecretKeyFile == "" {
+		s3.SecretKeyFile = os.Getenv("S3_SECRET_KEY_FILE")
+	}
+
+	if s3.SessionToken == "" {
+		s3.SessionToken = os.Getenv("S3_SESSION_TOKEN")
+	}
+
+	if s3.Profile == "" {
+		s3.Profile = os.Getenv("S3_PROFILE")
+	}
+	if s3.Profile == "" {
+		s3.Profile = os.Getenv("AWS_PROFILE")
+	}
+
+	if s3.CredentialsFile == "" {
+		s3.CredentialsFile = os.Getenv("S3_CREDENTIALS_FILE")
+	}
+	if s3.CredentialsFile == "" {
+		s3.CredentialsFile = os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	}
+
 	if s3.Prefix == "" {
 		s3.Prefix = os.Getenv("S3_PREFIX")
 	}
 
-	if !s3.Insecure {
-		insecure := os.Getenv("S3_INSECURE")
-		if insecure != "" {
-			s3.Insecure, _ = strconv.ParseBool(insecure)
+	if s3.KeyEncoding == "" {
+		s3.KeyEncoding = os.Getenv("S3_KEY_ENCODING")
+	}
+
+	if s3.Layout == "" {
+		s3.Layout = os.Getenv("S3_LAYOUT")
+	}
+
+	if s3.ListAPI == "" {
+		s3.ListAPI = os.Getenv("S3_LIST_API")
+	}
+
+	if s3.LockStrategy == "" {
+		s3.LockStrategy = os.Getenv("S3_LOCK_STRATEGY")
+	}
+
+	if s3.TenantPrefix == "" {
+		s3.TenantPrefix = os.Getenv("S3_TENANT_PREFIX")
+	}
+	s3.provisionTenants()
+
+	if s3.CAFile == "" {
+		s3.CAFile = os.Getenv("S3_CA_FILE")
+	}
+
+	if s3.ClientCertFile == "" {
+		s3.ClientCertFile = os.Getenv("S3_CLIENT_CERT_FILE")
+	}
+
+	if s3.ClientKeyFile == "" {
+		s3.ClientKeyFile = os.Getenv("S3_CLIENT_KEY_FILE")
+	}
+
+	if s3.SSECustomerKey == "" {
+		s3.SSECustomerKey = os.Getenv("S3_SSE_CUSTOMER_KEY")
+	}
+
+	s3.provisioned = true
+
+	if s3.LogKeys == "" {
+		s3.LogKeys = os.Getenv("S3_LOG_KEYS")
+	}
+
+	if err := s3.provisionLoggers(); err != nil {
+		return err
+	}
+
+	if err := s3.envBool("S3_INSECURE", &s3.Insecure); err != nil {
+		return err
+	}
+
+	if err := s3.envBool("S3_USE_IAM_PROVIDER", &s3.UseIamProvider); err != nil {
+		return err
+	}
+
+	if s3.RoleARN == "" {
+		s3.RoleARN = os.Getenv("S3_ROLE_ARN")
+	}
+
+	if s3.WebIdentityTokenFile == "" {
+		s3.WebIdentityTokenFile = os.Getenv("S3_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if s3.WebIdentityTokenFile == "" {
+		s3.WebIdentityTokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	if s3.RoleARN == "" && s3.WebIdentityTokenFile != "" {
+		s3.RoleARN = os.Getenv("AWS_ROLE_ARN")
+	}
+
+	if s3.ExternalID == "" {
+		s3.ExternalID = os.Getenv("S3_EXTERNAL_ID")
+	}
+
+	if s3.RoleSessionName == "" {
+		s3.RoleSessionName = os.Getenv("S3_ROLE_SESSION_NAME")
+	}
+	if s3.RoleSessionName == "" {
+		s3.RoleSessionName = defaultRoleSessionName
+	}
+
+	if s3.STSEndpoint == "" {
+		s3.STSEndpoint = os.Getenv("S3_STS_ENDPOINT")
+	}
+	if s3.STSEndpoint == "" {
+		s3.STSEndpoint = defaultSTSEndpoint
+	}
+
+	if s3.STSRegion == "" {
+		s3.STSRegion = os.Getenv("S3_STS_REGION")
+	}
+	if s3.STSRegion == "" {
+		s3.STSRegion = stsRegion(s3.STSEndpoint, s3.Region)
+	}
+
+	if err := s3.envBool("S3_METRICS", &s3.Metrics); err != nil {
+		return err
+	}
+
+	if s3.MetricsBackend == "" {
+		s3.MetricsBackend = os.Getenv("S3_METRICS_BACKEND")
+	}
+
+	if s3.MetricsEndpoint == "" {
+		s3.MetricsEndpoint = os.Getenv("S3_METRICS_ENDPOINT")
+	}
+
+	if err := s3.envBool("S3_FENCE_WRITES", &s3.FenceWrites); err != nil {
+		return err
+	}
+
+	if err := s3.envBool("S3_ATOMIC_STORE", &s3.AtomicStore); err != nil {
+		return err
+	}
+
+	if err := s3.envBool("S3_SKIP_SELF_TEST", &s3.SkipSelfTest); err != nil {
+		return err
+	}
+
+	var createBucket bool
+	if err := s3.envBool("S3_CREATE_BUCKET", &createBucket); err != nil {
+		return err
+	}
+	if createBucket && s3.CreateBucket == nil {
+		s3.CreateBucket = new(CreateBucket)
+	}
+
+	if s3.StorageClass == "" {
+		s3.StorageClass = os.Getenv("S3_STORAGE_CLASS")
+	}
+
+	if s3.Vault != nil {
+		if err := s3.Vault.provision(); err != nil {
+			return err
 		}
 	}
-	secure := !s3.Insecure
 
-	if !s3.UseIamProvider {
-		boolVal := os.Getenv("S3_USE_IAM_PROVIDER")
-		if boolVal != "" {
-			s3.UseIamProvider, _ = strconv.ParseBool(boolVal)
+	if err := s3.envBool("S3_LAZY_PROVISION", &s3.LazyProvision); err != nil {
+		return err
+	}
+
+	if err := s3.envBool("S3_VERIFY_ISSUANCE", &s3.VerifyIssuance); err != nil {
+		return err
+	}
+
+	if err := s3.envBool("S3_TRACE_REQUESTS", &s3.TraceRequests); err != nil {
+		return err
+	}
+
+	if err := s3.envBool("S3_ACCELERATE", &s3.Accelerate); err != nil {
+		return err
+	}
+
+	if err := s3.envBool("S3_SOFT_DELETE", &s3.SoftDelete); err != nil {
+		return err
+	}
+	if s3.SoftDelete {
+		s3.provisionSoftDelete()
+	}
+
+	if s3.Provider == "" {
+		s3.Provider = os.Getenv("S3_PROVIDER")
+	}
+	if provider, ok := providers[s3.Provider]; ok {
+		provider.apply(s3)
+
+		s3.logger.Info("use the profile of provider", zap.String("provider", s3.Provider))
+	}
+
+	if s3.Preset == "" {
+		s3.Preset = os.Getenv("S3_PRESET")
+	}
+	if preset, ok := presets[s3.Preset]; ok {
+		preset(s3)
+
+		s3.logger.Info("use preset", zap.String("preset", s3.Preset))
+	}
+
+	if err := s3.Validate(); err != nil {
+		return err
+	}
+
+	if err := s3.register(ctx); err != nil {
+		return err
+	}
+
+	s3.caps = newCapabilities()
+	s3.locks = newLockSet()
+	s3.etags = newETagSet()
+	s3.usage = new(usageCache)
+	s3.writes = new(inflight)
+
+	if s3.HealthCheck != nil {
+		s3.health = newHealth(s3.HealthCheck)
+	}
+
+	if s3.Tagging != nil {
+		if err := s3.provisionTagging(); err != nil {
+			return err
 		}
 	}
 
-	var creds *credentials.Credentials
-	if s3.UseIamProvider {
-		s3.logger.Info("use iam aws provider for credentials")
-		creds = credentials.NewIAM("")
-	} else {
-		s3.logger.Info("use secret_key and access_id for credentials")
-		creds = credentials.NewStaticV4(s3.AccessID, s3.SecretKey, "")
+	if s3.Audit != nil {
+		if err := s3.provisionAudit(); err != nil {
+			return err
+		}
 	}
 
-	// S3 Client
-	client, err := minio.New(s3.Host, &minio.Options{
-		Creds:  creds,
-		Secure: secure,
-	})
+	if len(s3.Hooks) > 0 {
+		if err := s3.loadInstanceID(); err != nil {
+			return fmt.Errorf("hooks: %v", err)
+		}
+		s3.hooks = &hooks{client: &http.Client{Timeout: hookTimeout}, pending: new(inflight)}
+	}
+
+	if s3.Cache != nil {
+		s3.cache = newReadCache(s3.Cache)
+	}
+
+	if s3.Spool == "" {
+		s3.Spool = os.Getenv("S3_SPOOL")
+	}
+	if s3.Spool != "" {
+		spool, err := newSpool(s3.Spool)
+		if err != nil {
+			return err
+		}
+		s3.spool = spool
+
+		s3.logger.Info("spool writes S3 can't take", zap.String("spool", s3.Spool))
+	}
 
+	creds, err := s3.newCredentials()
 	if err != nil {
 		return err
+	}
+	s3.creds = creds
+
+	// S3 Client
+	s3.httpTransport, err = s3.newTransport()
+	if err != nil {
+		return err
+	}
+
+	if s3.Metrics {
+		s3.meter, err = newMetricsBackend(ctx, s3.MetricsBackend, s3.MetricsEndpoint, s3.logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s3.Mirror != nil {
+		s3.mirror, err = s3.newMirror()
+		if err != nil {
+			return err
+		}
+
+		s3.logger.Info("mirror writes", zap.String("bucket", s3.Mirror.Bucket))
+	}
+
+	if s3.CircuitBreaker != nil {
+		s3.breaker = newCircuitBreaker(s3.CircuitBreaker, s3.log(logRequests), s3.meter, func() string {
+			return s3.endpoint()
+		})
+	}
+
+	s3.throttle = newThrottle(s3.log(logRequests))
+	s3.limits = append(s3.limits, s3.throttle)
+	s3.pressure = append(s3.pressure, s3.throttle)
+
+	s3.current = new(currentClient)
+
+	if s3.Failover != nil {
+		s3.failover, err = newFailover(s3.Failover, s3.Host)
+		if err != nil {
+			return err
+		}
+
+		s3.logger.Info("fail over to more endpoints", zap.Int("endpoints", len(s3.Failover.Endpoints)))
+	}
+
+	if s3.SSECustomerKey != "" {
+		s3.sse, err = parseSSECustomerKey(s3.SSECustomerKey)
+		if err != nil {
+			return err
+		}
+
+		s3.logger.Info("use sse-c customer key for server side encryption")
+	}
+
+	if s3.Encryption != nil {
+		s3.encryptor, err = newAgeEncryptor(s3.Encryption)
+		if err != nil {
+			return err
+		}
+
+		s3.logger.Info("use age encryption", zap.Strings("keys", s3.encryptor.patterns), zap.Int("recipients", len(s3.encryptor.recipients)))
+	}
+
+	if s3.RateLimit != nil {
+		s3.limits = append(s3.limits, newRateLimit(s3.RateLimit))
+	}
+
+	if s3.ClusterRateLimit > 0 {
+		budget, err := newClusterBudget(s3.ClusterRateLimit)
+		if err != nil {
+			return err
+		}
+		s3.limits = append(s3.limits, budget)
+		s3.pressure = append(s3.pressure, budget)
+
+		s3.logger.Info("limit the requests of all instances", zap.Float64("per_second", s3.ClusterRateLimit))
+	}
+
+	// last, so requests don't hold a slot while waiting for the rate limits
+	if s3.MaxConcurrent > 0 {
+		concurrency := newConcurrencyLimit(s3.MaxConcurrent)
+		s3.limits = append(s3.limits, concurrency)
+		s3.pressure = append(s3.pressure, concurrency)
+
+		s3.logger.Info("limit the requests in flight", zap.Int("max_concurrent", s3.MaxConcurrent))
+	}
+
+	if s3.LazyProvision {
+		s3.lazy = &lazyConnect{connect: func() error {
+			return s3.connect(ctx)
+		}}
+
+		s3.logger.Info("connect to S3 on first use")
+
+		go s3.connectInBackground(ctx)
+
+		return nil
+	}
+
+	return s3.connect(ctx)
+}
+
+// connect builds the client, runs the checks that need the endpoint and
+// starts the background jobs. It is the part of provisioning that
+// lazy_provision defers.
+func (s3 *S3) connect(ctx context.Context) error {
+	if s3.Discovery != nil {
+		if err := s3.discoverEndpoint(ctx); err != nil {
+			return err
+		}
 	} else {
-		s3.Client = client
+		client, err := s3.newClient(s3.Host)
+		if err != nil {
+			return err
+		}
+
+		s3.current.set(s3.Host, client)
+	}
+
+	if s3.CreateBucket != nil {
+		if err := s3.createBucket(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s3.BucketWait > 0 {
+		if err := s3.waitForBucket(ctx, time.Duration(s3.BucketWait)); err != nil {
+			return err
+		}
+	}
+
+	if s3.Region == "" {
+		s3.detectRegion(ctx)
+	}
+
+	s3.Host, s3.Client = s3.current.get()
+
+	if proxy, err := s3.proxyFor(s3.Host); err == nil && proxy != nil {
+		s3.logger.Info("use proxy", zap.String("proxy", proxy.Host), zap.String("host", s3.Host))
+	}
+
+	if !s3.SkipSelfTest || s3.LockStrategy == lockAuto || s3.ListAPI == listAuto {
+		s3.probeCapabilities(ctx)
+	}
+
+	if !s3.SkipSelfTest {
+		if err := s3.selfTest(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s3.sse != nil {
+		if err := s3.checkSSECustomerKey(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s3.ObjectLock != nil {
+		if err := s3.checkObjectLock(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s3.Lifecycle != nil {
+		s3.installLifecycle(ctx)
+	}
+
+	if s3.Discovery != nil {
+		go s3.refreshEndpoints(ctx)
+	}
+
+	if s3.failover != nil {
+		go s3.probeEndpoints(ctx)
+	}
+
+	if s3.health != nil {
+		go s3.checkHealth(ctx)
+	}
+
+	if s3.multipartUploads() {
+		go s3.abortAbandonedUploads(ctx)
+	}
+
+	for _, l := range s3.limits {
+		if budget, ok := l.(*clusterBudget); ok {
+			go s3.syncBudget(ctx, budget)
+		}
+	}
+
+	if len(s3.Retention) > 0 {
+		go s3.enforceRetention(ctx)
+	}
+
+	if s3.GarbageCollection != nil {
+		go s3.collectGarbage(ctx)
+	}
+
+	if s3.Cache != nil && s3.Cache.ListenNotifications {
+		go s3.listenNotifications(ctx)
+	}
+
+	if s3.spool != nil {
+		go s3.replaySpool(ctx)
+	}
+
+	if s3.mirror != nil && !s3.mirror.sync {
+		go s3.mirror.run(ctx)
 	}
 
 	return nil
@@ -153,109 +1705,458 @@ func (s3 S3) CertMagicStorage() (certmagic.Storage, error) {
 	return s3, nil
 }
 
-func (s3 S3) Lock(ctx context.Context, key string) error {
-	return nil
-}
+func (s3 S3) Store(ctx context.Context, key string, value []byte) (err error) {
+	ctx, span := s3.startSpan(ctx, "store", key)
+	defer func() { endSpan(span, err) }()
 
-func (s3 S3) Unlock(ctx context.Context, key string) error {
-	return nil
+	if err := s3.checkKey(key); err != nil {
+		return err
+	}
+	defer func() { s3.audit("store", key, len(value), err) }()
+	defer func() { s3.notifyHooks(storeEvent(err), key, value, err) }()
+
+	s3.writes.start()
+	defer s3.writes.done()
+
+	etag, ok := s3.etags.get(key)
+	if !ok || !isConditionalKey(key) {
+		return s3.store(ctx, key, value, nil)
+	}
+
+	err = s3.store(ctx, key, value, ifMatch(etag))
+	if errors.Is(err, ErrPreconditionFailed) {
+		// another instance updated it since, which is as good
+		s3.etags.remove(key)
+		s3.log(logOperations).Debug("store superseded by a concurrent update, keeping that", s3.keyField(key))
+		return nil
+	}
+	return err
 }
 
-func (s3 S3) Store(ctx context.Context, key string, value []byte) error {
+// store writes value to key, if the preconditions in condition hold.
+func (s3 S3) store(ctx context.Context, key string, value []byte, condition http.Header) error {
+	if err := s3.checkBackPressure(key); err != nil {
+		return err
+	}
+
+	if isLowPriorityKey(key) {
+		ctx = withPriority(ctx, priorityMaintenance)
+	}
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutWrite)
+	defer cancel()
+
+	// again afterwards, in case a concurrent read cached the old value
+	s3.cache.invalidate(key)
+	defer s3.cache.invalidate(key)
+
+	if s3.FenceWrites {
+		if err := s3.checkFence(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	if s3.encryptor != nil && s3.encryptor.matches(key) {
+		encrypted, err := s3.encryptor.encrypt(value)
+		if err != nil {
+			return fmt.Errorf("encrypting %s: %v", s3.logKey(key), err)
+		}
+		value = encrypted
+	}
+
+	// the size as stored, released again if the store fails
+	release, err := s3.reserveQuota(ctx, key, len(value))
+	if err != nil {
+		return err
+	}
+
+	var issuance []string
+	if s3.VerifyIssuance && isCertificateKey(key) {
+		issuance = issuanceLocks(s3.locks.snapshot(), key)
+	}
+
+	name := key
 	key = s3.KeyPrefix(key)
 	length := int64(len(value))
+	sum := sha256Hex(value)
+
+	opts := s3.storeOptions(name, sum)
 
-	s3.logger.Debug(fmt.Sprintf("Store: %s, %d bytes", key, length))
+	putCtx := ctx
+	if condition != nil {
+		// a single PUT, preconditions don't apply to parts
+		opts.DisableMultipart = true
+		if s3.conditionalWrites() {
+			putCtx = withCondition(ctx, condition)
+		}
+	}
 
-	_, err := s3.Client.PutObject(context.Background(), s3.Bucket, key, bytes.NewReader(value), length, minio.PutObjectOptions{})
+	var etag string
 
-	return err
+	start := time.Now()
+
+	err = s3.do(ctx, "store", func() error {
+		var info minio.UploadInfo
+		var err error
+		// conditions apply to the PUT, so conditional writes go directly
+		if s3.AtomicStore && condition == nil {
+			info, err = s3.putAtomic(ctx, key, value, opts)
+		} else {
+			info, err = s3.client().PutObject(putCtx, s3.Bucket, key, bytes.NewReader(value), length, opts)
+		}
+		etag = info.ETag
+		return err
+	})
+
+	s3.log(logOperations).Debug("store", s3.keyField(key), zap.Int64("size", length), zap.Duration("duration", time.Since(start)), zap.Error(err))
+
+	if err != nil {
+		if condition != nil {
+			err = s3.storageError("store", name, err)
+		} else {
+			// spooled writes are still to be stored
+			err = s3.spoolWrite(name, value, err)
+		}
+		if err != nil {
+			release()
+		}
+		return err
+	}
+
+	if isConditionalKey(name) {
+		s3.etags.put(name, etag)
+	}
+
+	// superseded by the write to S3
+	s3.spool.remove(name, time.Time{})
+
+	if err := s3.mirror.store(ctx, name, value, sum); err != nil {
+		return err
+	}
+
+	for _, lockName := range issuance {
+		if lock := s3.locks.get(lockName); lock != nil {
+			lock.recordWrite(name, sum)
+		}
+	}
+
+	return nil
 }
 
-func (s3 S3) Load(ctx context.Context, key string) ([]byte, error) {
-	if !s3.Exists(ctx, key) {
-		return nil, fs.ErrNotExist
+func (s3 S3) Load(ctx context.Context, key string) (value []byte, err error) {
+	ctx, span := s3.startSpan(ctx, "load", key)
+	defer func() { endSpan(span, err) }()
+
+	if err := s3.checkKey(key); err != nil {
+		return nil, err
+	}
+
+	if entry, ok := s3.cache.get(key); ok {
+		if !entry.exists {
+			return nil, fs.ErrNotExist
+		}
+		if entry.value != nil {
+			return append([]byte(nil), entry.value...), nil
+		}
+	}
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutRead)
+	defer cancel()
+
+	if value, spooled, ok := s3.spool.get(key); ok {
+		return s3.loadSpooled(ctx, key, value, spooled)
 	}
 
+	value, _, err = s3.loadObject(ctx, key)
+	return value, err
+}
+
+// loadObject reads key from S3, and returns its value and ETag.
+func (s3 S3) loadObject(ctx context.Context, key string) ([]byte, string, error) {
+	name := key
+	action := s3.mismatchAction(key)
+
 	key = s3.KeyPrefix(key)
 
-	s3.logger.Debug(fmt.Sprintf("Load key: %s", key))
+	var value []byte
+	var info minio.ObjectInfo
+
+	start := time.Now()
+
+	err := s3.do(ctx, "load", func() error {
+		// the object is only requested once stat'ed, a single GET that also
+		// tells if it is missing
+		object, err := s3.client().GetObject(ctx, s3.Bucket, key, s3.getObjectOptions())
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		info, err = object.Stat()
+		if err != nil {
+			return err
+		}
+
+		value, err = ioutil.ReadAll(object)
+		return err
+	})
 
-	object, err := s3.Client.GetObject(context.Background(), s3.Bucket, key, minio.GetObjectOptions{})
+	s3.log(logOperations).Debug("load", s3.keyField(key), zap.Int("size", len(value)), zap.Duration("duration", time.Since(start)), zap.Error(err))
 
 	if err != nil {
-		return nil, err
+		if isNotFound(err) {
+			s3.cache.putExists(name, false)
+		}
+		return nil, "", s3.storageError("load", name, err)
+	}
+
+	if err := s3.verifyChecksum(s3.logKey(key), value, info); err != nil {
+		switch action {
+		case mismatchWarn:
+			s3.logger.Warn("serving an object with a checksum mismatch", s3.keyField(key), zap.Error(err))
+		case mismatchMirror:
+			mirrored, mirrorErr := s3.mirror.load(ctx, name)
+			if mirrorErr != nil {
+				return nil, "", fmt.Errorf("%v, and reading it from the mirror failed: %v", err, mirrorErr)
+			}
+			s3.logger.Warn("serving an object from the mirror after a checksum mismatch", s3.keyField(key), zap.Error(err))
+			value = mirrored
+		default:
+			return nil, "", err
+		}
+	}
+	if isAgeEncrypted(value) {
+		if s3.encryptor == nil {
+			return nil, "", fmt.Errorf("%s is age encrypted, but no encryption is configured", s3.logKey(key))
+		}
+
+		value, err = s3.encryptor.decrypt(value)
+		if err != nil {
+			return nil, "", err
+		}
 	}
 
-	return ioutil.ReadAll(object)
+	s3.cache.putValue(name, value)
+	if isConditionalKey(name) {
+		s3.etags.put(name, info.ETag)
+	}
+
+	return value, info.ETag, nil
 }
 
-func (s3 S3) Delete(ctx context.Context, key string) error {
+func (s3 S3) Delete(ctx context.Context, key string) (err error) {
+	ctx, span := s3.startSpan(ctx, "delete", key)
+	defer func() { endSpan(span, err) }()
+
+	if err := s3.checkKey(key); err != nil {
+		return err
+	}
+	defer func() { s3.audit("delete", key, 0, err) }()
+
+	s3.writes.start()
+	defer s3.writes.done()
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutWrite)
+	defer cancel()
+
+	// again afterwards, in case a concurrent read cached the old value
+	s3.cache.invalidate(key)
+	defer s3.cache.invalidate(key)
+
+	s3.spool.remove(key, time.Time{})
+	s3.etags.remove(key)
+
+	name := key
 	key = s3.KeyPrefix(key)
 
-	s3.logger.Debug(fmt.Sprintf("Delete key: %s", key))
+	start := time.Now()
+
+	// a key that is an object has no keys below it to list, as in file
+	// system storage
+	var object bool
+
+	err = s3.do(ctx, "delete", func() error {
+		_, err := s3.client().StatObject(ctx, s3.Bucket, key, s3.getObjectOptions())
+		object = err == nil
+
+		if s3.softDeletes(name) {
+			return s3.moveToTrash(ctx, name, key, start)
+		}
+		return s3.client().RemoveObject(ctx, s3.Bucket, key, minio.RemoveObjectOptions{})
+	})
+
+	s3.log(logOperations).Debug("delete", s3.keyField(key), zap.Duration("duration", time.Since(start)), zap.Error(err))
+
+	if err != nil {
+		return s3.storageError("delete", name, err)
+	}
+
+	s3.releaseQuota(name)
+	s3.notifyHooks(hookDeleted, name, nil, nil)
 
-	return s3.Client.RemoveObject(context.Background(), s3.Bucket, key, minio.RemoveObjectOptions{})
+	if !object {
+		if err := s3.deleteDirectory(ctx, name, start); err != nil {
+			return s3.storageError("delete", name, err)
+		}
+	}
+
+	return s3.mirror.delete(ctx, name, !object)
 }
 
 func (s3 S3) Exists(ctx context.Context, key string) bool {
+	ctx, span := s3.startSpan(ctx, "exists", key)
+	defer endSpan(span, nil)
+
+	if s3.checkKey(key) != nil {
+		return false
+	}
+
+	if entry, ok := s3.cache.get(key); ok {
+		return entry.exists
+	}
+
+	if _, _, ok := s3.spool.get(key); ok {
+		return true
+	}
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutRead)
+	defer cancel()
+
+	name := key
 	key = s3.KeyPrefix(key)
 
-	_, err := s3.Client.StatObject(context.Background(), s3.Bucket, key, minio.StatObjectOptions{})
+	start := time.Now()
+
+	err := s3.do(ctx, "exists", func() error {
+		_, err := s3.client().StatObject(ctx, s3.Bucket, key, s3.getObjectOptions())
+		return err
+	})
 
 	exists := err == nil
 
-	s3.logger.Debug(fmt.Sprintf("Check exists: %s, %t", key, exists))
+	if exists || isNotFound(err) {
+		s3.cache.putExists(name, exists)
+	}
+
+	s3.log(logOperations).Debug("exists", s3.keyField(key), zap.Bool("exists", exists), zap.Duration("duration", time.Since(start)))
 
 	return exists
 }
 
-func (s3 S3) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
-	ctx, cancel := context.WithCancel(context.Background())
+func (s3 S3) List(ctx context.Context, prefix string, recursive bool) (keys []string, err error) {
+	ctx, span := s3.startSpan(ctx, "list", prefix)
+	defer func() { endSpan(span, err) }()
 
+	if err := s3.checkPrefix(prefix); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutList)
 	defer cancel()
 
-	objects := s3.Client.ListObjects(ctx, s3.Bucket, minio.ListObjectsOptions{
-		Prefix:    s3.KeyPrefix(prefix),
-		Recursive: recursive,
+	err = s3.Walk(ctx, prefix, recursive, func(key string) error {
+		keys = append(keys, key)
+		return nil
 	})
 
-	keys := make([]string, len(objects))
+	spooled := s3.spool.keys(prefix, recursive)
+	if errors.Is(err, fs.ErrNotExist) && len(spooled) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	for object := range objects {
-		keys = append(keys, s3.CutKeyPrefix(object.Key))
+	for _, key := range spooled {
+		if !containsKey(keys, key) {
+			keys = append(keys, key)
+		}
 	}
 
 	return keys, nil
 }
 
-func (s3 S3) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+func (s3 S3) Stat(ctx context.Context, key string) (info certmagic.KeyInfo, err error) {
+	ctx, span := s3.startSpan(ctx, "stat", key)
+	defer func() { endSpan(span, err) }()
+
+	if err := s3.checkKey(key); err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+
+	if entry, ok := s3.cache.get(key); ok && entry.info != nil {
+		return *entry.info, nil
+	}
+
+	ctx, cancel := s3.withTimeout(ctx, timeoutRead)
+	defer cancel()
+
+	if value, spooled, ok := s3.spool.get(key); ok {
+		return s3.statSpooled(ctx, key, value, spooled), nil
+	}
+
+	name := key
 	key = s3.KeyPrefix(key)
 
-	object, err := s3.Client.StatObject(context.Background(), s3.Bucket, key, minio.StatObjectOptions{})
+	var object minio.ObjectInfo
 
-	if err != nil {
-		s3.logger.Error(fmt.Sprintf("Stat key: %s, error: %v", key, err))
+	err = s3.do(ctx, "stat", func() error {
+		var err error
+		object, err = s3.client().StatObject(ctx, s3.Bucket, key, s3.getObjectOptions())
+		return err
+	})
 
-		return certmagic.KeyInfo{}, nil
+	// a directory, like in file system storage, unless telling would
+	// take listing every object
+	if isNotFound(err) && !s3.scans(name) {
+		if isDir, dirErr := s3.isDirectory(ctx, name); dirErr == nil && isDir {
+			return certmagic.KeyInfo{Key: name, IsTerminal: false}, nil
+		}
 	}
 
-	s3.logger.Debug(fmt.Sprintf("Stat key: %s, size: %d bytes", key, object.Size))
+	if err != nil {
+		return certmagic.KeyInfo{}, s3.storageError("stat", name, err)
+	}
+
+	s3.log(logOperations).Debug("stat", s3.keyField(key), zap.Int64("size", object.Size))
 
-	return certmagic.KeyInfo{
-		Key:        object.Key,
+	info = certmagic.KeyInfo{
+		Key:        name,
 		Modified:   object.LastModified,
 		Size:       object.Size,
-		IsTerminal: strings.HasSuffix(object.Key, "/"),
-	}, err
+		IsTerminal: true,
+	}
+	s3.cache.putInfo(name, info)
+
+	return info, err
 }
 
+// KeyPrefix returns the object key of key, below the prefix, and below the
+// prefix of its tenant if it has one.
 func (s3 S3) KeyPrefix(key string) string {
-	return path.Join(s3.Prefix, key)
+	if tenant := s3.tenantOf(key); tenant != nil {
+		return path.Join(cleanPrefix(s3.Prefix), tenant.Prefix, s3.physicalKey(key))
+	}
+	return path.Join(cleanPrefix(s3.Prefix), s3.physicalKey(key))
 }
-func (s3 S3) CutKeyPrefix(key string) string {
-	cutted, _ := strings.CutPrefix(key, s3.Prefix)
-	return cutted
+
+// CutKeyPrefix returns the key of an object key, the reverse of KeyPrefix.
+// Object keys that aren't below the prefix are returned as they are.
+func (s3 S3) CutKeyPrefix(objectKey string) string {
+	root := s3.KeyPrefix("")
+	if root == "" {
+		return s3.relKey(objectKey)
+	}
+	if !strings.HasPrefix(objectKey, root+"/") {
+		return objectKey
+	}
+	return s3.relKey(strings.TrimPrefix(objectKey, root+"/"))
+}
+
+// cleanPrefix normalizes a configured prefix to have no leading or
+// trailing slashes, so "/ssl/", "ssl/" and "ssl" are the same prefix.
+func cleanPrefix(prefix string) string {
+	return strings.Trim(path.Clean("/"+prefix), "/")
 }
 
 func (s3 S3) String() string {
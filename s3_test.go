@@ -0,0 +1,821 @@
+package certmagic_s3
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"go.uber.org/zap"
+)
+
+func TestCleanPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"ssl", "ssl"},
+		{"ssl/", "ssl"},
+		{"/ssl/", "ssl"},
+		{"caddy/ssl", "caddy/ssl"},
+		{"/caddy/ssl/", "caddy/ssl"},
+		{"caddy//ssl", "caddy/ssl"},
+	}
+
+	for _, test := range tests {
+		if got := cleanPrefix(test.prefix); got != test.want {
+			t.Errorf("cleanPrefix(%q) = %q, want %q", test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		key    string
+		want   string
+	}{
+		{"", "", ""},
+		{"", "certificates/acme/example.com/example.com.crt", "certificates/acme/example.com/example.com.crt"},
+		{"ssl", "", "ssl"},
+		{"ssl", "certificates", "ssl/certificates"},
+		{"ssl/", "certificates/acme/example.com/example.com.crt", "ssl/certificates/acme/example.com/example.com.crt"},
+		{"/caddy/ssl/", "certificates/acme/example.com/example.com.key", "caddy/ssl/certificates/acme/example.com/example.com.key"},
+		{"caddy/ssl", "locks/issue_cert_example.com.lock", "caddy/ssl/locks/issue_cert_example.com.lock"},
+	}
+
+	for _, test := range tests {
+		s3 := S3{Prefix: test.prefix}
+
+		got := s3.KeyPrefix(test.key)
+		if got != test.want {
+			t.Errorf("KeyPrefix(%q) with prefix %q = %q, want %q", test.key, test.prefix, got, test.want)
+			continue
+		}
+
+		if test.key == "" {
+			continue
+		}
+		if key := s3.CutKeyPrefix(got); key != test.key {
+			t.Errorf("CutKeyPrefix(%q) with prefix %q = %q, want %q", got, test.prefix, key, test.key)
+		}
+	}
+}
+
+func TestCutKeyPrefix(t *testing.T) {
+	tests := []struct {
+		prefix    string
+		objectKey string
+		want      string
+	}{
+		{"", "certificates/acme/example.com/example.com.crt", "certificates/acme/example.com/example.com.crt"},
+		{"ssl", "ssl/certificates/acme/example.com/example.com.crt", "certificates/acme/example.com/example.com.crt"},
+		{"/ssl/", "ssl/acme/account.json", "acme/account.json"},
+		{"caddy/ssl", "caddy/ssl/ocsp/example.com", "ocsp/example.com"},
+		// not below the prefix
+		{"ssl", "other/certificates/example.com.crt", "other/certificates/example.com.crt"},
+		{"ssl", "sslcertificates/example.com.crt", "sslcertificates/example.com.crt"},
+		{"caddy/ssl", "caddy/certificates/example.com.crt", "caddy/certificates/example.com.crt"},
+	}
+
+	for _, test := range tests {
+		s3 := S3{Prefix: test.prefix}
+		if got := s3.CutKeyPrefix(test.objectKey); got != test.want {
+			t.Errorf("CutKeyPrefix(%q) with prefix %q = %q, want %q", test.objectKey, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestPhysicalKey(t *testing.T) {
+	const (
+		wildcard = "certificates/acme/wildcard_*.example.com/wildcard_*.example.com.crt"
+		account  = "acme/account+1.json"
+		lock     = "locks/issue_cert_example.com.lock"
+	)
+
+	tests := []struct {
+		layout   string
+		encoding string
+		key      string
+		want     string
+	}{
+		{"", "", wildcard, wildcard},
+		{"", keyEncodingPercent, wildcard, "certificates/acme/wildcard_%2A.example.com/wildcard_%2A.example.com.crt"},
+		{"", keyEncodingPercent, account, "acme/account%2B1.json"},
+		{"", keyEncodingBase32, account, "c5hmqp8/c5hm6rrldpq2mc9ed9pmurg"},
+		{"", keyEncodingBase32, ".trash/x", ".trash/f0"},
+		{layoutFlat, "", wildcard, "9b150005f72cd96f-certificates%2Facme%2Fwildcard_%2A.example.com%2Fwildcard_%2A.example.com.crt"},
+		{layoutFlat, "", lock, lock},
+		{layoutFlat, keyEncodingPercent, account, "c76380bfae2e22d7-acme%2Faccount%252B1.json"},
+		{layoutSharded, "", account, "c7/63/acme/account+1.json"},
+		{layoutSharded, keyEncodingBase32, account, "c7/63/c5hmqp8/c5hm6rrldpq2mc9ed9pmurg"},
+		{layoutSharded, keyEncodingBase32, lock, "dhnm6qrj/d5pn6tb5bthmasjkbtingobde1m6abj3dtmisr3fcdlg"},
+	}
+
+	for _, test := range tests {
+		s3 := S3{Layout: test.layout, KeyEncoding: test.encoding}
+		got := s3.physicalKey(test.key)
+		if got != test.want {
+			t.Errorf("physicalKey(%q) with layout %q and encoding %q = %q, want %q", test.key, test.layout, test.encoding, got, test.want)
+			continue
+		}
+		if key := s3.logicalKey(got); key != test.key {
+			t.Errorf("logicalKey(%q) with layout %q and encoding %q = %q, want %q", got, test.layout, test.encoding, key, test.key)
+		}
+
+		// and back through the prefix and the tenants
+		s3.Prefix = "ssl"
+		s3.Tenants = map[string]*Tenant{"a": {Domains: []string{"*.example.com"}}}
+		s3.provisionTenants()
+		if key := s3.CutKeyPrefix(s3.KeyPrefix(test.key)); key != test.key {
+			t.Errorf("CutKeyPrefix(KeyPrefix(%q)) with layout %q and encoding %q = %q", test.key, test.layout, test.encoding, key)
+		}
+	}
+}
+
+func TestTenantOf(t *testing.T) {
+	s3 := S3{Tenants: map[string]*Tenant{
+		"wildcard": {Domains: []string{"*.example.com"}, Prefix: "tenants/wildcard"},
+		"foo":      {Domains: []string{"foo.example.com"}, Prefix: "tenants/foo"},
+		"sub":      {Domains: []string{"*.foo.example.com"}, Prefix: "tenants/sub"},
+		"b":        {Domains: []string{"*.example.org"}, Prefix: "tenants/b"},
+		"a":        {Domains: []string{"*.example.org"}, Prefix: "tenants/a"},
+		"c":        {Domains: []string{"*.EXAMPLE.net"}, Prefix: "tenants/c"},
+	}}
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"certificates/acme/foo.example.com/foo.example.com.crt", "tenants/foo"},
+		{"certificates/acme/bar.example.com/bar.example.com.crt", "tenants/wildcard"},
+		{"certificates/acme/www.foo.example.com/www.foo.example.com.key", "tenants/sub"},
+		{"certificates/acme/wildcard_.example.com/wildcard_.example.com.crt", "tenants/wildcard"},
+		{"certificates/acme/www.example.org/www.example.org.crt", "tenants/a"},
+		{"certificates/acme/www.example.net/www.example.net.crt", "tenants/c"},
+		{"certificates/acme/example.com/example.com.crt", ""},
+		{"acme/acme/users/admin@example.com/admin.json", ""},
+	}
+
+	for _, test := range tests {
+		// map order changes between runs, the tenant mustn't
+		for i := 0; i < 20; i++ {
+			var got string
+			if tenant := s3.tenantOf(test.key); tenant != nil {
+				got = tenant.Prefix
+			}
+			if got != test.want {
+				t.Errorf("tenantOf(%q) = %q, want %q", test.key, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestReserveQuota(t *testing.T) {
+	tenant := &Tenant{Domains: []string{"*.example.com"}, Prefix: "tenants/example", MaxObjects: 2, MaxBytes: 100}
+	s3 := S3{Tenants: map[string]*Tenant{"example": tenant}}
+	s3.provisionTenants()
+
+	existing := "certificates/acme/a.example.com/a.example.com.crt"
+	tenant.usage.objects, tenant.usage.bytes = 1, 40
+	tenant.usage.sizes = map[string]int64{s3.KeyPrefix(existing): 40}
+	tenant.usage.computed = time.Now()
+
+	tests := []struct {
+		key     string
+		size    int
+		undo    bool
+		objects int
+		bytes   int64
+		err     error
+	}{
+		// an overwrite only counts the difference
+		{existing, 50, false, 1, 50, nil},
+		{existing, 30, false, 1, 30, nil},
+		// a failed store is undone
+		{"certificates/acme/b.example.com/b.example.com.crt", 20, true, 1, 30, nil},
+		{existing, 60, true, 1, 30, nil},
+		{"certificates/acme/b.example.com/b.example.com.crt", 20, false, 2, 50, nil},
+		{"certificates/acme/c.example.com/c.example.com.crt", 1, false, 2, 50, ErrQuotaExceeded},
+		{existing, 81, false, 2, 50, ErrQuotaExceeded},
+		// not in a tenant
+		{"acme/acme/users/admin@example.com/admin.json", 1000, false, 2, 50, nil},
+	}
+
+	for _, test := range tests {
+		release, err := s3.reserveQuota(context.Background(), test.key, test.size)
+		if !errors.Is(err, test.err) {
+			t.Errorf("reserveQuota(%q, %d) = %v, want %v", test.key, test.size, err, test.err)
+			continue
+		}
+		if err == nil && test.undo {
+			release()
+		}
+		if tenant.usage.objects != test.objects || tenant.usage.bytes != test.bytes {
+			t.Errorf("after reserveQuota(%q, %d): %d objects of %d bytes, want %d of %d",
+				test.key, test.size, tenant.usage.objects, tenant.usage.bytes, test.objects, test.bytes)
+		}
+	}
+}
+
+// fakeS3 serves the parts of the S3 API the storage uses from memory, for
+// tests that go through a real minio client.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject // by bucket/key
+
+	// the next requests answered with 503 Slow Down
+	unavailable int
+	// how many listings were requested
+	lists int
+}
+
+type fakeObject struct {
+	value    []byte
+	etag     string
+	metadata http.Header
+	modified time.Time
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	var key string
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	name := bucket + "/" + key
+	object, exists := f.objects[name]
+	query := r.URL.Query()
+
+	if f.unavailable > 0 {
+		f.unavailable--
+		fakeError(w, http.StatusServiceUnavailable, "SlowDown")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && query["location"] != nil:
+		fmt.Fprint(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+	case r.Method == http.MethodGet && key == "":
+		f.lists++
+		f.list(w, bucket, query)
+	case r.Method == http.MethodPost && query["delete"] != nil:
+		f.deleteObjects(w, r, bucket)
+	case r.Method == http.MethodPut:
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != object.etag) ||
+			r.Header.Get("If-None-Match") == "*" && exists {
+			fakeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		value, _ := ioutil.ReadAll(r.Body)
+		sum := md5.Sum(value)
+		object = fakeObject{value: value, etag: `"` + hex.EncodeToString(sum[:]) + `"`, metadata: http.Header{}, modified: time.Now()}
+		for name, values := range r.Header {
+			if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+				object.metadata[name] = values
+			}
+		}
+		f.objects[name] = object
+		w.Header().Set("ETag", object.etag)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case !exists:
+		fakeError(w, http.StatusNotFound, "NoSuchKey")
+	default:
+		for name, values := range object.metadata {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", object.etag)
+		w.Header().Set("Last-Modified", object.modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.value)))
+		if r.Method == http.MethodGet {
+			w.Write(object.value)
+		}
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, query url.Values) {
+	prefix, delimiter, startAfter := query.Get("prefix"), query.Get("delimiter"), query.Get("start-after")
+
+	var keys []string
+	for name := range f.objects {
+		if key := strings.TrimPrefix(name, bucket+"/"); key != name && strings.HasPrefix(key, prefix) && key > startAfter {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, `<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>%s</Name><Prefix>%s</Prefix><IsTruncated>false</IsTruncated>`, bucket, prefix)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			common := key[:len(prefix)+i+len(delimiter)]
+			if !seen[common] {
+				seen[common] = true
+				fmt.Fprintf(w, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, common)
+			}
+			continue
+		}
+		object := f.objects[bucket+"/"+key]
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><LastModified>%s</LastModified><ETag>%s</ETag><Size>%d</Size></Contents>`,
+			key, object.modified.UTC().Format(time.RFC3339Nano), object.etag, len(object.value))
+	}
+	fmt.Fprint(w, `</ListBucketResult>`)
+}
+
+func (f *fakeS3) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	var request struct {
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		fakeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	fmt.Fprint(w, `<DeleteResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+	for _, object := range request.Objects {
+		delete(f.objects, bucket+"/"+object.Key)
+		fmt.Fprintf(w, `<Deleted><Key>%s</Key></Deleted>`, object.Key)
+	}
+	fmt.Fprint(w, `</DeleteResult>`)
+}
+
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (f *fakeS3) failNext(requests int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unavailable = requests
+}
+
+func (f *fakeS3) put(bucket, key string, value []byte, metadata map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sum := md5.Sum(value)
+	object := fakeObject{value: value, etag: `"` + hex.EncodeToString(sum[:]) + `"`, metadata: http.Header{}, modified: time.Now()}
+	for name, value := range metadata {
+		object.metadata.Set("X-Amz-Meta-"+name, value)
+	}
+	f.objects[bucket+"/"+key] = object
+}
+
+func (f *fakeS3) keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for name := range f.objects {
+		if key := strings.TrimPrefix(name, bucket+"/"); key != name {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// newTestClient returns a client of the fake S3 at server.
+func newTestClient(t *testing.T, server *httptest.Server) *minio.Client {
+	t.Helper()
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:     credentials.NewStatic("", "", "", credentials.SignatureAnonymous),
+		Region:    "us-east-1",
+		Transport: newThrottle(zap.NewNop()).roundTripper(http.DefaultTransport),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// newTestStorage returns the storage configured by config, connected to a
+// fake S3 with the bucket "bucket".
+func newTestStorage(t *testing.T, config S3) (S3, *fakeS3) {
+	t.Helper()
+
+	fake := &fakeS3{objects: make(map[string]fakeObject)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	s3 := config
+	s3.Bucket = "bucket"
+	s3.Host = strings.TrimPrefix(server.URL, "http://")
+	s3.Insecure = true
+	s3.Client = newTestClient(t, server)
+	s3.logger = zap.NewNop()
+	s3.caps = newCapabilities()
+	s3.locks = newLockSet()
+	s3.etags = newETagSet()
+	s3.usage = new(usageCache)
+	s3.writes = new(inflight)
+	s3.provisionTenants()
+
+	return s3, fake
+}
+
+func TestVerifyWrites(t *testing.T) {
+	const (
+		certificate = "certificates/acme/example.com/example.com.crt"
+		privateKey  = "certificates/acme/example.com/example.com.key"
+	)
+	value := []byte("certificate")
+
+	tests := []struct {
+		name       string
+		config     S3
+		privateKey bool
+		mirrored   []byte
+		wantErr    bool
+	}{
+		{"hierarchical", S3{Prefix: "ssl"}, true, nil, false},
+		{"flat", S3{Prefix: "ssl", Layout: layoutFlat}, true, nil, false},
+		{"sharded base32", S3{Layout: layoutSharded, KeyEncoding: keyEncodingBase32}, true, nil, false},
+		{"no private key", S3{Layout: layoutSharded}, false, nil, true},
+		{"mirrored", S3{Layout: layoutFlat}, true, value, false},
+		{"mirror differs", S3{Layout: layoutFlat}, true, []byte("stale"), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, fake := newTestStorage(t, test.config)
+
+			sum := sha256Hex(value)
+			fake.put(s3.Bucket, s3.KeyPrefix(certificate), value, map[string]string{checksumMetadata: sum})
+			if test.privateKey {
+				fake.put(s3.Bucket, s3.KeyPrefix(privateKey), []byte("key"), nil)
+			}
+			if test.mirrored != nil {
+				s3.mirror = &mirror{client: s3.Client, bucket: "mirror", layout: s3, sync: true, logKey: s3.logKey}
+				fake.put("mirror", s3.physicalKey(certificate), test.mirrored, nil)
+			}
+
+			lock := &heldLock{}
+			lock.recordWrite(certificate, sum)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			if err := s3.verifyWrites(ctx, lock); (err != nil) != test.wantErr {
+				t.Errorf("verifyWrites() = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestMirrorWrites(t *testing.T) {
+	const (
+		tenantKey = "certificates/acme/www.example.com/www.example.com.crt"
+		otherKey  = "certificates/acme/example.org/example.org.crt"
+	)
+
+	tests := []struct {
+		name      string
+		layout    string
+		key       string
+		delete    bool
+		directory bool
+		want      []string
+		wantLists int
+	}{
+		{"store of a tenant", "", tenantKey, false, false,
+			[]string{"dr/certificates/acme/example.org/example.org.crt", "dr/tenants/a/" + tenantKey, "dr/tenants/a/" + tenantKey + ".old"}, 0},
+		{"delete of an object", "", tenantKey, true, false,
+			[]string{"dr/certificates/acme/example.org/example.org.crt", "dr/tenants/a/" + tenantKey + ".old"}, 0},
+		{"delete of a directory", "", "certificates/acme", true, true, nil, 2},
+		{"delete of a directory in a scanned layout", layoutFlat, "certificates/acme", true, true, nil, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, fake := newTestStorage(t, S3{Layout: test.layout, Tenants: map[string]*Tenant{"a": {Domains: []string{"*.example.com"}}}})
+			ctx := context.Background()
+
+			m := &mirror{
+				client:    s3.Client,
+				bucket:    "mirror",
+				layout:    S3{Prefix: "dr", Layout: s3.Layout, Tenants: s3.Tenants},
+				queueSize: 1,
+				logger:    zap.NewNop(),
+				logKey:    s3.logKey,
+				wake:      make(chan struct{}, 1),
+				room:      make(chan struct{}),
+			}
+			for _, key := range []string{tenantKey, tenantKey + ".old", otherKey} {
+				fake.put("mirror", m.layout.KeyPrefix(key), []byte("old"), nil)
+			}
+
+			write := mirrorWrite{key: test.key, value: []byte("new"), delete: test.delete, directory: test.directory}
+			if err := m.write(ctx, write); err != nil {
+				t.Fatalf("write() = %v", err)
+			}
+
+			if got := fake.keys("mirror"); strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("mirror keys = %v, want %v", got, test.want)
+			}
+			if fake.lists != test.wantLists {
+				t.Errorf("%d listings, want %d", fake.lists, test.wantLists)
+			}
+		})
+	}
+}
+
+func TestMirrorQueueFull(t *testing.T) {
+	s3, fake := newTestStorage(t, S3{})
+
+	m := &mirror{
+		client:    s3.Client,
+		bucket:    "mirror",
+		queueSize: 1,
+		logger:    zap.NewNop(),
+		logKey:    s3.logKey,
+		wake:      make(chan struct{}, 1),
+		room:      make(chan struct{}),
+	}
+
+	if err := m.store(context.Background(), "first", []byte("1"), ""); err != nil {
+		t.Fatalf("store() = %v", err)
+	}
+
+	// the queue is full, so the write waits until it gives up
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := m.store(ctx, "dropped", []byte("2"), ""); err == nil {
+		t.Error("store() to a full queue succeeded")
+	}
+
+	// or until the queue has room
+	done := make(chan error)
+	go func() { done <- m.store(context.Background(), "second", []byte("3"), "") }()
+	select {
+	case err := <-done:
+		t.Fatalf("store() to a full queue returned %v, want it waiting", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if left := m.flush(context.Background()); left != 0 {
+		t.Fatalf("flush() left %d writes", left)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("store() = %v", err)
+	}
+	if left := m.flush(context.Background()); left != 0 {
+		t.Fatalf("flush() left %d writes", left)
+	}
+
+	if got, want := fake.keys("mirror"), []string{"first", "second"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("mirror keys = %v, want %v", got, want)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	tests := []struct {
+		name      string
+		layout    string
+		prefix    string
+		recursive bool
+		want      []string
+	}{
+		{"root", "", "", false, []string{"acme", "certificates"}},
+		{"root recursive", "", "", true, []string{
+			"acme", "acme/account.json", "certificates", "certificates/acme",
+			"certificates/acme/example.org", "certificates/acme/example.org/example.org.crt",
+			"certificates/acme/www.example.com", "certificates/acme/www.example.com/www.example.com.crt",
+		}},
+		{"directory", "", "certificates/acme", false, []string{"certificates/acme/example.org", "certificates/acme/www.example.com"}},
+		{"directory flat", layoutFlat, "certificates/acme", false, []string{"certificates/acme/example.org", "certificates/acme/www.example.com"}},
+		{"directory recursive", "", "certificates/acme", true, []string{
+			"certificates/acme/example.org", "certificates/acme/example.org/example.org.crt",
+			"certificates/acme/www.example.com", "certificates/acme/www.example.com/www.example.com.crt",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3, fake := newTestStorage(t, S3{Prefix: "ssl", Layout: test.layout, Tenants: map[string]*Tenant{"a": {Domains: []string{"*.example.com"}}}})
+			for _, key := range []string{
+				"acme/account.json",
+				"certificates/acme/example.org/example.org.crt",
+				"certificates/acme/www.example.com/www.example.com.crt",
+			} {
+				fake.put(s3.Bucket, s3.KeyPrefix(key), []byte(key), nil)
+			}
+
+			// the deadline is that close that every page holds one object
+			var keys []string
+			var pages int
+			for next := ""; pages == 0 || next != ""; pages++ {
+				if pages > 10 {
+					t.Fatal("ListPage() doesn't end")
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), listDeadlineMargin-time.Second)
+				page, after, err := s3.ListPage(ctx, test.prefix, test.recursive, next)
+				cancel()
+				if err != nil {
+					t.Fatalf("ListPage() = %v", err)
+				}
+				keys = append(keys, page...)
+				next = after
+			}
+
+			seen := make(map[string]bool)
+			var got []string
+			for _, key := range keys {
+				if !seen[key] {
+					seen[key] = true
+					got = append(got, key)
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(test.want, " ") {
+				t.Errorf("ListPage() listed %v, want %v", got, test.want)
+			}
+			if pages < 2 {
+				t.Errorf("ListPage() listed %d pages, want several", pages)
+			}
+		})
+	}
+}
+
+func TestLockRetries(t *testing.T) {
+	s3, fake := newTestStorage(t, S3{Retry: &Retry{MaxAttempts: 3, Base: caddy.Duration(time.Millisecond)}})
+	ctx := context.Background()
+
+	// retried by the storage only, not by the client as well
+	maxRetry := minio.MaxRetry
+	minio.MaxRetry = 1
+	defer func() { minio.MaxRetry = maxRetry }()
+
+	const name = "issue_cert_example.com"
+
+	// every lock request is answered with 503 once
+	fake.failNext(1)
+	acquired, err := s3.TryLock(ctx, name)
+	if err != nil || !acquired {
+		t.Fatalf("TryLock() = %t, %v, want the lock", acquired, err)
+	}
+
+	other := s3
+	other.locks = newLockSet()
+	if acquired, err := other.TryLock(ctx, name); err != nil || acquired {
+		t.Errorf("TryLock() of a held lock = %t, %v, want it held", acquired, err)
+	}
+
+	fake.failNext(1)
+	if err := s3.Unlock(ctx, name); err != nil {
+		t.Fatalf("Unlock() = %v", err)
+	}
+	if keys := fake.keys(s3.Bucket); len(keys) != 0 {
+		t.Errorf("objects left after Unlock: %v", keys)
+	}
+
+	if acquired, err := other.TryLock(ctx, name); err != nil || !acquired {
+		t.Errorf("TryLock() of a released lock = %t, %v, want the lock", acquired, err)
+	}
+	other.Unlock(ctx, name)
+}
+
+func TestMarshalRedacts(t *testing.T) {
+	const secret = "s3cr3t"
+
+	s3 := S3{
+		AccessID:       "access",
+		SecretKey:      secret,
+		SessionToken:   secret,
+		SSECustomerKey: secret,
+		ProxyURL:       "http://user:" + secret + "@proxy.example.com:3128",
+		Mirror:         &Mirror{Bucket: "mirror", SecretKey: secret},
+		Vault:          &Vault{Token: secret},
+		Audit:          &Audit{Webhook: "https://audit.example.com", Headers: map[string]string{"Authorization": "Bearer " + secret}},
+		Hooks:          []Hook{{URL: "https://hooks.example.com", Headers: map[string]string{"X-Api-Token": secret}}},
+	}
+
+	tests := []struct {
+		name   string
+		config interface{}
+		secret bool
+	}{
+		{"unprovisioned", s3, true},
+		{"provisioned", func() S3 { s3 := s3; s3.provisioned = true; return s3 }(), false},
+		{"proxy unprovisioned", Proxy{URL: "https://caddy.example.com", Token: secret}, true},
+		{"proxy provisioned", Proxy{URL: "https://caddy.example.com", Token: secret, client: http.DefaultClient}, false},
+		{"proxy handler provisioned", ProxyHandler{Token: secret, leases: &proxyLeases{}}, false},
+	}
+
+	for _, test := range tests {
+		out, err := json.Marshal(test.config)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if strings.Contains(string(out), secret) != test.secret {
+			t.Errorf("%s: marshaled to %s, want the secret %t", test.name, out, test.secret)
+		}
+	}
+
+	// the config itself is left as it is
+	if s3.Hooks[0].Headers["X-Api-Token"] != secret || s3.Audit.Headers["Authorization"] != "Bearer "+secret {
+		t.Error("marshaling redacted the headers of the config")
+	}
+}
+
+func TestProxyLocks(t *testing.T) {
+	handler := ProxyHandler{
+		Token:   "token",
+		storage: &certmagic.FileStorage{Path: t.TempDir()},
+		leases:  &proxyLeases{leases: make(map[string]*lease)},
+		logger:  zap.NewNop(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var handlerErr caddyhttp.HandlerError
+		if err := handler.ServeHTTP(w, r, nil); errors.As(err, &handlerErr) {
+			http.Error(w, handlerErr.Error(), handlerErr.StatusCode)
+		}
+	}))
+	defer server.Close()
+
+	newProxy := func() Proxy {
+		return Proxy{URL: server.URL, Token: "token", client: server.Client(), locks: newLockSet(), logger: zap.NewNop()}
+	}
+	proxy, other := newProxy(), newProxy()
+	ctx := context.Background()
+
+	const name = "issue_cert_example.com"
+
+	if err := proxy.Store(ctx, "big", make([]byte, proxyMaxValueSize+1)); err == nil {
+		t.Error("Store() of an oversized value succeeded")
+	}
+
+	if err := proxy.Lock(ctx, name); err != nil {
+		t.Fatalf("Lock() = %v", err)
+	}
+	lock := proxy.locks.get(name)
+
+	tests := []struct {
+		name      string
+		operation string
+		lease     string
+	}{
+		{"renew without lease", "renew", ""},
+		{"renew with another lease", "renew", "other"},
+		{"unlock without lease", "unlock", ""},
+		{"unlock with another lease", "unlock", "other"},
+	}
+
+	for _, test := range tests {
+		_, err := other.request(ctx, http.MethodPost, test.operation, url.Values{"key": {name}, "lease": {test.lease}}, nil)
+		if !errors.Is(err, errLeaseLost) {
+			t.Errorf("%s: %v, want errLeaseLost", test.name, err)
+		}
+	}
+	if err := other.Unlock(ctx, name); err == nil {
+		t.Error("Unlock() of a lock taken by another client succeeded")
+	}
+
+	if err := proxy.renew(name, lock); err != nil {
+		t.Errorf("renew() = %v", err)
+	}
+	if err := proxy.Unlock(ctx, name); err != nil {
+		t.Fatalf("Unlock() = %v", err)
+	}
+
+	// the lease runs out while the client still holds the lock
+	if err := other.Lock(ctx, name); err != nil {
+		t.Fatalf("Lock() = %v", err)
+	}
+	lock = other.locks.get(name)
+	handler.leases.stop(name, lock.owner)
+	if err := other.renew(name, lock); !errors.Is(err, errLeaseLost) {
+		t.Errorf("renew() of a lost lease = %v, want errLeaseLost", err)
+	}
+	if other.locks.get(name) != nil {
+		t.Error("lock is still held after its lease was lost")
+	}
+}
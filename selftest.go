@@ -0,0 +1,64 @@
+package certmagic_s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// selfTest makes sure the bucket exists and the credentials may do what
+// certmagic needs, so that a wrong secret key or a missing permission fails
+// provisioning with an error saying so, and not the first ACME attempt.
+func (s3 S3) selfTest(ctx context.Context) error {
+	report := s3.Preflight(ctx)
+
+	for _, check := range report.Checks {
+		switch {
+		case check.Allowed || check.Skipped:
+		case errors.Is(check.err, ErrBucketMissing):
+			return fmt.Errorf("self-test: bucket %s does not exist, create it or set create_bucket", s3.Bucket)
+		case errorKind(check.err) != ErrPermissionDenied || isCredentialsError(check.err):
+			return s3.selfTestError(check.err, check.Action)
+		}
+	}
+	if missing := report.Denied(); len(missing) > 0 {
+		return fmt.Errorf("self-test: the credentials lack %s, grant them on bucket %s and prefix %q (caddy s3-storage preflight prints the policy), or skip the test with skip_self_test",
+			strings.Join(missing, ", "), s3.Bucket, s3.Prefix)
+	}
+
+	s3.logger.Debug("self-test passed", zap.String("bucket", s3.Bucket))
+
+	return nil
+}
+
+// isCredentialsError reports whether err means the credentials themselves
+// are wrong, as opposed to lacking a permission.
+func isCredentialsError(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return isRejectedCredentials(err) || code == "SignatureDoesNotMatch"
+}
+
+// selfTestError explains why the self-test failed at the request needing
+// permission.
+func (s3 S3) selfTestError(err error, permission string) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "InvalidAccessKeyId":
+		return fmt.Errorf("self-test: the endpoint %s doesn't know access_id, check it and the host: %w", s3.endpoint(), err)
+	case "SignatureDoesNotMatch":
+		return fmt.Errorf("self-test: secret_key doesn't match access_id: %w", err)
+	case "AuthorizationHeaderMalformed", "IllegalLocationConstraintException", "PermanentRedirect":
+		return fmt.Errorf("self-test: bucket %s is in another region than %q, check region: %w", s3.Bucket, s3.Region, err)
+	}
+
+	switch errorKind(err) {
+	case ErrPermissionDenied:
+		return fmt.Errorf("self-test: the credentials lack %s, grant it on bucket %s, or skip the test with skip_self_test: %w", permission, s3.Bucket, s3.explainError(err))
+	case ErrEndpointUnreachable:
+		return fmt.Errorf("self-test: endpoint %s is unreachable: %w", s3.endpoint(), err)
+	}
+	return fmt.Errorf("self-test: %s failed: %w", permission, s3.explainError(err))
+}
@@ -0,0 +1,133 @@
+package certmagic_s3
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// cleanupTimeout bounds how long Cleanup holds up a reload or shutdown.
+const cleanupTimeout = 15 * time.Second
+
+// inflight counts the writes in progress, for Cleanup to wait for. A nil
+// inflight counts nothing.
+type inflight struct {
+	mu      sync.Mutex
+	n       int
+	waiting []chan struct{}
+}
+
+func (f *inflight) start() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n++
+}
+
+func (f *inflight) done() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+	if f.n == 0 {
+		for _, idle := range f.waiting {
+			close(idle)
+		}
+		f.waiting = nil
+	}
+}
+
+// wait returns once no write is in progress, or ctx is done.
+func (f *inflight) wait(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	if f.n == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	f.waiting = append(f.waiting, idle)
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Cleanup winds the storage down when its config is unloaded, on a reload
+// or shutdown: it waits for writes in progress, releases the locks this
+// instance still holds, writes what is spooled or queued for the mirror,
+// waits for hooks being called, and drops the read cache. The background
+// work started on connecting already stopped with the config, or stops now
+// for storages created with New. Whatever
+// isn't done within cleanupTimeout is left to the next instance, like
+// after a crash.
+func (s3 S3) Cleanup() error {
+	if s3.locks == nil {
+		// never provisioned
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	if err := s3.writes.wait(ctx); err != nil {
+		s3.logger.Warn("writes still in progress on cleanup", zap.Error(err))
+	}
+
+	for name := range s3.locks.snapshot() {
+		if err := s3.Unlock(ctx, name); err != nil {
+			s3.log(logLocks).Warn("releasing lock on cleanup", s3.keyField(s3.lockObjectKey(name)), zap.Error(err))
+			continue
+		}
+		s3.log(logLocks).Info("released lock on cleanup", s3.keyField(s3.lockObjectKey(name)))
+	}
+
+	if s3.spool != nil && s3.connected() {
+		if err := s3.replaySpoolOnce(ctx); err != nil {
+			s3.logger.Warn("writes left in spool on cleanup", zap.String("spool", s3.Spool), zap.Error(err))
+		}
+	}
+
+	if s3.mirror != nil && !s3.mirror.sync {
+		if left := s3.mirror.flush(ctx); left > 0 {
+			s3.logger.Warn("dropped writes queued for the mirror on cleanup", zap.Int("writes", left))
+		}
+	}
+
+	if s3.hooks != nil {
+		if err := s3.hooks.pending.wait(ctx); err != nil {
+			s3.logger.Warn("hooks still being called on cleanup", zap.Error(err))
+		}
+	}
+
+	s3.cache.invalidatePrefix("")
+
+	if s3.stop != nil {
+		s3.stop()
+	}
+
+	return nil
+}
+
+// connected reports whether the client was built, which lazy_provision
+// defers.
+func (s3 S3) connected() bool {
+	if s3.current == nil {
+		return false
+	}
+	_, client := s3.current.get()
+	return client != nil
+}
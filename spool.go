@@ -0,0 +1,350 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// spoolReplayInterval is how often spooled writes are replayed to S3.
+const spoolReplayInterval = 30 * time.Second
+
+// spool keeps the writes that failed against S3 in a local directory, one
+// file per key, until they are replayed. The modification time of a file is
+// when its write was spooled.
+type spool struct {
+	dir string
+
+	mu sync.Mutex
+}
+
+func newSpool(dir string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating spool directory: %v", err)
+	}
+	return &spool{dir: dir}, nil
+}
+
+// path returns the file of key, which must stay inside the directory.
+func (s *spool) path(key string) (string, bool) {
+	clean := path.Clean("/" + key)
+	if clean == "/" {
+		return "", false
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), true
+}
+
+func (s *spool) write(key string, value []byte) error {
+	file, ok := s.path(key)
+	if !ok {
+		return fmt.Errorf("invalid key %q", key)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".spool-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// get returns the spooled value of key and when it was spooled. A nil
+// spool has none.
+func (s *spool) get(key string) ([]byte, time.Time, bool) {
+	if s == nil {
+		return nil, time.Time{}, false
+	}
+
+	file, ok := s.path(key)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		return nil, time.Time{}, false
+	}
+	value, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+
+	return value, info.ModTime(), true
+}
+
+// remove drops the spooled value of key. With a non-zero spooled, only if
+// it is still the value spooled then.
+func (s *spool) remove(key string, spooled time.Time) {
+	if s == nil {
+		return
+	}
+
+	file, ok := s.path(key)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		return
+	}
+	if !spooled.IsZero() && !info.ModTime().Equal(spooled) {
+		return
+	}
+
+	os.Remove(file)
+}
+
+// removeAll drops the spooled values of the keys below key.
+func (s *spool) removeAll(key string) {
+	if s == nil {
+		return
+	}
+
+	file, ok := s.path(key)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if info, err := os.Stat(file); err == nil && info.IsDir() {
+		os.RemoveAll(file)
+	}
+}
+
+// keys returns the spooled keys under prefix, the way List does.
+func (s *spool) keys(prefix string, recursive bool) []string {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	listPrefix := path.Clean("/" + prefix)[1:]
+	if listPrefix != "" {
+		listPrefix += "/"
+	}
+
+	var files []string
+
+	filepath.WalkDir(s.dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || strings.HasPrefix(entry.Name(), ".spool-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, file)
+		if err != nil {
+			return nil
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, listPrefix) {
+			files = append(files, key)
+		}
+		return nil
+	})
+
+	sort.Strings(files)
+
+	lister := newKeyLister(prefix, listPrefix, recursive)
+	seen := make(map[string]bool)
+	var keys []string
+
+	for _, file := range files {
+		for _, key := range lister.keys(file) {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys
+}
+
+// unreachable reports whether err means S3 could not be reached, rather
+// than that it refused the request.
+func unreachable(err error) bool {
+	return isRetryable(err) || errors.As(err, new(CircuitOpenError)) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// spoolWrite keeps value, as it would have been stored, in the spool after
+// the write of key failed with err. It returns the error to report.
+func (s3 S3) spoolWrite(key string, value []byte, err error) error {
+	if s3.spool == nil || !unreachable(err) {
+		return s3.storageError("store", key, err)
+	}
+
+	if spoolErr := s3.spool.write(key, value); spoolErr != nil {
+		s3.log(logOperations).Error("spooling", s3.keyField(key), zap.Error(spoolErr))
+		return s3.storageError("store", key, err)
+	}
+
+	s3.log(logOperations).Warn("store spooled locally until S3 is reachable", s3.keyField(key), zap.Error(err))
+
+	return nil
+}
+
+// newerThanSpooled returns the object of key in S3 when it is newer than the
+// spooled value, which is dropped then. Otherwise, the spooled value wins,
+// also when S3 can't be reached.
+func (s3 S3) newerThanSpooled(ctx context.Context, key string, spooled time.Time) (minio.ObjectInfo, bool) {
+	var object minio.ObjectInfo
+
+	err := s3.do(ctx, "stat", func() error {
+		var err error
+		object, err = s3.client().StatObject(ctx, s3.Bucket, s3.KeyPrefix(key), s3.getObjectOptions())
+		return err
+	})
+	if err != nil || !object.LastModified.After(spooled) {
+		return minio.ObjectInfo{}, false
+	}
+
+	s3.spool.remove(key, spooled)
+
+	return object, true
+}
+
+// loadSpooled returns the spooled value of key, unless S3 has a newer one.
+func (s3 S3) loadSpooled(ctx context.Context, key string, value []byte, spooled time.Time) ([]byte, error) {
+	if _, newer := s3.newerThanSpooled(ctx, key, spooled); newer {
+		return s3.Load(ctx, key)
+	}
+
+	if isAgeEncrypted(value) {
+		if s3.encryptor == nil {
+			return nil, fmt.Errorf("%s is age encrypted, but no encryption is configured", s3.logKey(key))
+		}
+		return s3.encryptor.decrypt(value)
+	}
+
+	return value, nil
+}
+
+// statSpooled returns the info of the spooled value of key, unless S3 has a
+// newer one.
+func (s3 S3) statSpooled(ctx context.Context, key string, value []byte, spooled time.Time) certmagic.KeyInfo {
+	if object, newer := s3.newerThanSpooled(ctx, key, spooled); newer {
+		return certmagic.KeyInfo{
+			Key:        key,
+			Modified:   object.LastModified,
+			Size:       object.Size,
+			IsTerminal: true,
+		}
+	}
+
+	return certmagic.KeyInfo{
+		Key:        key,
+		Modified:   spooled,
+		Size:       int64(len(value)),
+		IsTerminal: true,
+	}
+}
+
+// replaySpool stores the spooled writes in S3 until ctx is done.
+func (s3 S3) replaySpool(ctx context.Context) {
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s3.replaySpoolOnce(ctx); err != nil {
+			s3.logger.Debug("replaying spooled writes", zap.Error(err))
+		}
+	}
+}
+
+// replaySpoolOnce stores the spooled writes in S3, stopping at the first
+// that fails.
+func (s3 S3) replaySpoolOnce(ctx context.Context) error {
+	for _, key := range s3.spool.keys("", true) {
+		if err := s3.replaySpooled(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaySpooled stores the spooled value of key in S3 and drops it, unless
+// S3 has a newer value meanwhile.
+func (s3 S3) replaySpooled(ctx context.Context, key string) error {
+	value, spooled, ok := s3.spool.get(key)
+	if !ok {
+		return nil
+	}
+
+	ctx, cancel := s3.withTimeout(withPriority(ctx, priorityMaintenance), timeoutWrite)
+	defer cancel()
+
+	if _, newer := s3.newerThanSpooled(ctx, key, spooled); newer {
+		s3.log(logOperations).Info("dropped spooled write, S3 has a newer one", s3.keyField(key))
+		return nil
+	}
+
+	opts := s3.storeOptions(key, sha256Hex(value))
+
+	err := s3.do(ctx, "store", func() error {
+		_, err := s3.client().PutObject(ctx, s3.Bucket, s3.KeyPrefix(key), bytes.NewReader(value), int64(len(value)), opts)
+		return err
+	})
+	if err != nil {
+		return s3.explainError(err)
+	}
+
+	s3.spool.remove(key, spooled)
+	s3.cache.invalidate(key)
+
+	s3.log(logOperations).Info("replayed spooled write", s3.keyField(key))
+
+	return s3.mirror.store(ctx, key, value, opts.UserMetadata[checksumMetadata])
+}
+
+func containsKey(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+const sseCheckKey = "sse_c_check"
+
+func parseSSECustomerKey(value string) (encrypt.ServerSide, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("decoding sse_customer_key: %v", err)
+	}
+
+	return encrypt.NewSSEC(key)
+}
+
+// checkSSECustomerKey writes, stats and removes a small object with the
+// customer key to make sure the endpoint actually honors SSE-C.
+func (s3 S3) checkSSECustomerKey(ctx context.Context) error {
+	key := s3.KeyPrefix(sseCheckKey)
+	value := []byte("sse-c")
+
+	_, err := s3.client().PutObject(ctx, s3.Bucket, key, bytes.NewReader(value), int64(len(value)), s3.putObjectOptions())
+	if err != nil {
+		return fmt.Errorf("s3 endpoint rejected an SSE-C upload: %v", err)
+	}
+
+	defer s3.client().RemoveObject(ctx, s3.Bucket, key, minio.RemoveObjectOptions{})
+
+	_, err = s3.client().StatObject(ctx, s3.Bucket, key, minio.StatObjectOptions{})
+	if err == nil {
+		return errors.New("s3 endpoint does not support SSE-C: object is readable without the customer key")
+	}
+
+	_, err = s3.client().StatObject(ctx, s3.Bucket, key, s3.getObjectOptions())
+	if err != nil {
+		return fmt.Errorf("s3 endpoint does not support SSE-C: %v", err)
+	}
+
+	return nil
+}
+
+// putObjectOptions are the options of every upload. With Content-MD5, S3
+// rejects uploads corrupted on the way.
+func (s3 S3) putObjectOptions() minio.PutObjectOptions {
+	return minio.PutObjectOptions{ServerSideEncryption: s3.sse, SendContentMd5: true, DisableMultipart: !s3.multipartUploads()}
+}
+
+// storeOptions are the options of uploading value to key for Store.
+func (s3 S3) storeOptions(key string, sum string) minio.PutObjectOptions {
+	opts := s3.putObjectOptions()
+	opts.UserMetadata = map[string]string{checksumMetadata: sum}
+	opts.UserTags = s3.objectTags(key)
+	opts.StorageClass = s3.storageClassFor(key)
+	opts.Mode, opts.RetainUntilDate = s3.retention()
+	return opts
+}
+
+func (s3 S3) getObjectOptions() minio.GetObjectOptions {
+	return minio.GetObjectOptions{ServerSideEncryption: s3.sse}
+}
@@ -0,0 +1,41 @@
+package certmagic_s3
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+// Config configures a storage created with New, for Go programs using
+// certmagic directly rather than through Caddy.
+type Config struct {
+	// Storage holds the settings, the fields of the JSON config of the
+	// Caddy module. Settings left unset are taken from the S3_*
+	// environment variables, as in Caddy.
+	Storage S3
+
+	// Logger defaults to discarding the logs.
+	Logger *zap.Logger
+}
+
+// New provisions a storage the way Caddy would, connecting to the endpoint
+// unless lazy_provision defers that, for use as certmagic.Config.Storage.
+// Placeholders are replaced from the environment. Call Cleanup when done
+// with it, to stop its background work and release its locks.
+func New(config Config) (*S3, error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s3 := config.Storage
+	s3.stop = cancel
+	if err := s3.provision(ctx, logger); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &s3, nil
+}
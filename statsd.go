@@ -0,0 +1,53 @@
+package certmagic_s3
+
+import (
+	"fmt"
+	"net"
+)
+
+const defaultStatsDAddress = "127.0.0.1:8125"
+
+// statsDBackend sends every measurement to a StatsD daemon over UDP. Labels
+// become part of the metric name, as plain StatsD has no tags.
+type statsDBackend struct {
+	conn net.Conn
+}
+
+func newStatsDBackend(address string) (statsDBackend, error) {
+	if address == "" {
+		address = defaultStatsDAddress
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return statsDBackend{}, fmt.Errorf("connecting to statsd: %v", err)
+	}
+
+	return statsDBackend{conn: conn}, nil
+}
+
+func (b statsDBackend) observeDuration(operation, result string, seconds float64, traceID string) {
+	b.send(fmt.Sprintf("caddy.storage_s3.operation_duration.%s.%s:%.3f|ms", operation, result, seconds*1000))
+}
+
+func (b statsDBackend) setCircuitState(state circuitState) {
+	b.send(fmt.Sprintf("caddy.storage_s3.circuit_breaker_state:%d|g", state))
+}
+
+func (b statsDBackend) setMirrorLag(seconds float64) {
+	b.send(fmt.Sprintf("caddy.storage_s3.mirror_lag:%.3f|g", seconds))
+}
+
+func (b statsDBackend) countMirrorError(operation string) {
+	b.send(fmt.Sprintf("caddy.storage_s3.mirror_errors.%s:1|c", operation))
+}
+
+func (b statsDBackend) countCollected(class string) {
+	b.send(fmt.Sprintf("caddy.storage_s3.gc_deleted.%s:1|c", class))
+}
+
+// send writes a single metric. Like StatsD clients do, it drops the metric
+// if that fails.
+func (b statsDBackend) send(metric string) {
+	b.conn.Write([]byte(metric))
+}
@@ -0,0 +1,60 @@
+package certmagic_s3
+
+import (
+	"fmt"
+	"path"
+)
+
+// storageClasses are the storage classes objects can be stored in. Archive
+// classes are left out, their objects have to be restored before reading.
+var storageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER_IR":          true,
+}
+
+// gcsStorageClasses are those of Google Cloud Storage, whose colder classes
+// are read like any other.
+var gcsStorageClasses = map[string]bool{
+	"STANDARD": true,
+	"NEARLINE": true,
+	"COLDLINE": true,
+	"ARCHIVE":  true,
+}
+
+// StorageClassRule stores the keys matching Pattern in StorageClass. A
+// pattern without a slash matches the file name, one with a slash matches
+// the key or any of its parent directories.
+type StorageClassRule struct {
+	Pattern      string `json:"pattern"`
+	StorageClass string `json:"storage_class"`
+}
+
+func validateStorageClasses(classes map[string]bool, class string, rules []StorageClassRule) error {
+	if class != "" && !classes[class] {
+		return fmt.Errorf("invalid storage_class %q", class)
+	}
+	for _, rule := range rules {
+		if !classes[rule.StorageClass] {
+			return fmt.Errorf("invalid storage class %q for %s", rule.StorageClass, rule.Pattern)
+		}
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid storage class pattern %s: %v", rule.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// storageClassFor returns the storage class of key: that of the first rule
+// matching it, or the default. Empty leaves it to the bucket.
+func (s3 S3) storageClassFor(key string) string {
+	for _, rule := range s3.StorageClasses {
+		if matchKey(rule.Pattern, key) {
+			return rule.StorageClass
+		}
+	}
+	return s3.StorageClass
+}
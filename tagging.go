@@ -0,0 +1,73 @@
+package certmagic_s3
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// The tags every object is tagged with.
+const (
+	tagInstance = "caddy-instance"
+	tagKeyClass = "key-class"
+	tagSite     = "site"
+)
+
+// Tagging tags every stored object with the ID of the Caddy instance that
+// wrote it, its key class and the site it belongs to, if any, for lifecycle
+// rules, cost reports and IAM conditions. Tags are added to those, and
+// replace them if named the same.
+type Tagging struct {
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+func (s3 *S3) provisionTagging() error {
+	if err := s3.loadInstanceID(); err != nil {
+		return fmt.Errorf("tagging: %v", err)
+	}
+
+	// a key with every tag set
+	_, err := tags.NewTags(s3.objectTags("certificates/acme/example.com/example.com.crt"), true)
+	if err != nil {
+		return fmt.Errorf("tagging: %v", err)
+	}
+
+	return nil
+}
+
+// loadInstanceID reads the ID of the Caddy instance, for tags and records
+// of what it wrote.
+func (s3 *S3) loadInstanceID() error {
+	if s3.instanceID != "" {
+		return nil
+	}
+	id, err := caddy.InstanceID()
+	if err != nil {
+		return fmt.Errorf("reading the instance ID: %v", err)
+	}
+	s3.instanceID = id.String()
+	return nil
+}
+
+// objectTags returns the tags of the object of key, or nil without tagging.
+func (s3 S3) objectTags(key string) map[string]string {
+	if s3.Tagging == nil || !s3.Capabilities().ObjectTagging {
+		return nil
+	}
+
+	objectTags := map[string]string{
+		tagInstance: s3.instanceID,
+		tagKeyClass: keyClass(key),
+	}
+	// tag values can't contain "*"
+	if site := keyDomain(key); site != "" {
+		objectTags[tagSite] = strings.Replace(site, "*", "wildcard_", 1)
+	}
+	for name, value := range s3.Tagging.Tags {
+		objectTags[name] = value
+	}
+
+	return objectTags
+}
@@ -0,0 +1,312 @@
+package certmagic_s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+)
+
+// defaultTenantPrefix is where the keys of a tenant go, below the prefix of
+// the storage, unless the tenant sets its own prefix.
+const defaultTenantPrefix = "tenants/{tenant}"
+
+// ErrQuotaExceeded is returned when a store would take a tenant beyond its
+// max_objects or max_bytes.
+var ErrQuotaExceeded = errors.New("tenant quota exceeded")
+
+// Tenant keeps the certificates and OCSP staples of the domains matching
+// Domains, globs like "*.example.com", under a prefix of its own below the
+// prefix of the storage. Prefix defaults to the tenant_prefix template, in
+// which {tenant} is the name of the tenant. MaxObjects and MaxBytes, if
+// set, cap what the tenant may store.
+type Tenant struct {
+	Domains    []string `json:"domains,omitempty"`
+	Prefix     string   `json:"prefix"`
+	MaxObjects int      `json:"max_objects"`
+	MaxBytes   int64    `json:"max_bytes"`
+
+	name  string
+	usage *tenantUsage
+}
+
+// tenantUsage is what a tenant stores, as listed at most usageTTL ago plus
+// the stores since. sizes holds the size of every object by object key, so
+// an overwrite counts no new object.
+type tenantUsage struct {
+	mu       sync.Mutex
+	objects  int
+	bytes    int64
+	sizes    map[string]int64
+	computed time.Time
+}
+
+// provisionTenants names the tenants and resolves their prefixes.
+func (s3 *S3) provisionTenants() {
+	template := s3.TenantPrefix
+	if template == "" {
+		template = defaultTenantPrefix
+	}
+
+	repl := caddy.NewReplacer()
+	for name, tenant := range s3.Tenants {
+		repl.Set("tenant", name)
+		if tenant.Prefix == "" {
+			tenant.Prefix = template
+		}
+		tenant.Prefix = strings.Trim(repl.ReplaceKnown(tenant.Prefix, ""), "/")
+		tenant.name = name
+		tenant.usage = new(tenantUsage)
+	}
+}
+
+// validateTenants returns the problems of the tenant configs.
+func (s3 S3) validateTenants() []string {
+	var problems []string
+
+	for name, tenant := range s3.Tenants {
+		if len(tenant.Domains) == 0 {
+			problems = append(problems, fmt.Sprintf("tenant %s has no domains", name))
+		}
+		for _, glob := range tenant.Domains {
+			if _, err := path.Match(glob, ""); err != nil {
+				problems = append(problems, fmt.Sprintf("invalid domain %q of tenant %s: %v", glob, name, err))
+			}
+		}
+		if tenant.MaxObjects < 0 || tenant.MaxBytes < 0 {
+			problems = append(problems, fmt.Sprintf("max_objects and max_bytes of tenant %s can't be negative", name))
+		}
+
+		prefix := strings.Trim(tenant.Prefix, "/")
+		if prefix == "" {
+			// not provisioned yet
+			continue
+		}
+		if reason := prefixProblem(prefix); reason != "" {
+			problems = append(problems, fmt.Sprintf("invalid prefix %q of tenant %s: %s", prefix, name, reason))
+		}
+		if first := strings.Split(prefix, "/")[0]; first == "certificates" || first == "acme" || first == "ocsp" || first == "locks" || strings.HasPrefix(first, ".") {
+			problems = append(problems, fmt.Sprintf("prefix %q of tenant %s is taken by the storage itself", prefix, name))
+		}
+		for otherName, other := range s3.Tenants {
+			otherPrefix := strings.Trim(other.Prefix, "/")
+			if otherName < name && (otherPrefix == prefix || strings.HasPrefix(otherPrefix, prefix+"/") || strings.HasPrefix(prefix, otherPrefix+"/")) {
+				problems = append(problems, fmt.Sprintf("tenants %s and %s have overlapping prefixes %q and %q", otherName, name, otherPrefix, prefix))
+			}
+		}
+	}
+
+	return problems
+}
+
+// tenantOf returns the tenant key belongs to, if any: the one whose domains
+// match the domain of a certificate or OCSP staple key, or of a directory
+// of certificates of a site. Of tenants with overlapping domains, the most
+// specific match wins, so a key always goes to the same tenant: an exact
+// name first, then the longest glob, then the first tenant by name.
+func (s3 S3) tenantOf(key string) *Tenant {
+	if len(s3.Tenants) == 0 {
+		return nil
+	}
+
+	domain := tenantDomain(key)
+	if domain == "" {
+		return nil
+	}
+
+	var best *Tenant
+	var bestName, bestGlob string
+	var bestExact bool
+	for name, tenant := range s3.Tenants {
+		if tenant.Prefix == "" {
+			continue
+		}
+		for _, glob := range tenant.Domains {
+			glob = strings.ToLower(glob)
+			if ok, _ := path.Match(glob, domain); !ok {
+				continue
+			}
+
+			exact := glob == domain
+			switch {
+			case best == nil,
+				exact && !bestExact,
+				exact == bestExact && len(glob) > len(bestGlob),
+				exact == bestExact && len(glob) == len(bestGlob) && name < bestName:
+				best, bestName, bestGlob, bestExact = tenant, name, glob, exact
+			}
+		}
+	}
+	return best
+}
+
+func tenantDomain(key string) string {
+	parts := strings.Split(key, "/")
+
+	switch {
+	case parts[0] == "certificates" && len(parts) >= 3:
+		name := parts[2]
+		if strings.HasPrefix(name, "wildcard_") {
+			name = "*" + strings.TrimPrefix(name, "wildcard_")
+		}
+		return name
+	case parts[0] == "ocsp" && len(parts) == 2:
+		return keyDomain(key)
+	}
+	return ""
+}
+
+// relKey returns the key of an object key relative to the prefix of the
+// storage, be it below the prefix of a tenant or not.
+func (s3 S3) relKey(rel string) string {
+	for _, tenant := range s3.Tenants {
+		if tenant.Prefix != "" && strings.HasPrefix(rel, tenant.Prefix+"/") {
+			return s3.logicalKey(strings.TrimPrefix(rel, tenant.Prefix+"/"))
+		}
+	}
+	return s3.logicalKey(rel)
+}
+
+// tenantListPrefix is the object key prefix of the directory key in
+// tenant, like listPrefix.
+func (s3 S3) tenantListPrefix(tenant *Tenant, key string) string {
+	return path.Join(cleanPrefix(s3.Prefix), tenant.Prefix, s3.physicalKey(key)) + "/"
+}
+
+// tenantListPrefixes returns the object key prefixes of the directory key
+// in every tenant, unless the listing of key covers them already, as it
+// belongs to a tenant or scans all objects.
+func (s3 S3) tenantListPrefixes(key string) []string {
+	if len(s3.Tenants) == 0 || s3.scans(key) || s3.tenantOf(key) != nil {
+		return nil
+	}
+
+	var prefixes []string
+	for _, tenant := range s3.Tenants {
+		if tenant.Prefix != "" {
+			prefixes = append(prefixes, s3.tenantListPrefix(tenant, key))
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// inTenant reports whether objectKey is below the prefix of a tenant, or a
+// common prefix on the way to one.
+func (s3 S3) inTenant(objectKey string) bool {
+	for _, tenant := range s3.Tenants {
+		if tenant.Prefix == "" {
+			continue
+		}
+		root := path.Join(cleanPrefix(s3.Prefix), tenant.Prefix) + "/"
+		if strings.HasPrefix(objectKey, root) || strings.HasSuffix(objectKey, "/") && strings.HasPrefix(root, objectKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveQuota counts a store of size bytes, as stored, to key against the
+// quota of its tenant, or fails with ErrQuotaExceeded if it would exceed
+// it. Overwriting an object known from the listing or an earlier store only
+// counts the difference in size. The returned func undoes the reservation,
+// for a store that fails.
+func (s3 S3) reserveQuota(ctx context.Context, key string, size int) (func(), error) {
+	tenant := s3.tenantOf(key)
+	if tenant == nil || tenant.usage == nil || tenant.MaxObjects <= 0 && tenant.MaxBytes <= 0 {
+		return func() {}, nil
+	}
+
+	if err := s3.ready(); err != nil {
+		return nil, err
+	}
+
+	usage := tenant.usage
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	if time.Since(usage.computed) >= usageTTL {
+		if err := s3.computeTenantUsage(ctx, tenant); err != nil {
+			return nil, fmt.Errorf("checking quota of tenant %s: %v", tenant.name, err)
+		}
+	}
+
+	objectKey := s3.KeyPrefix(key)
+	old, known := usage.sizes[objectKey]
+	objects, bytes := usage.objects, usage.bytes+int64(size)-old
+	if !known {
+		objects++
+	}
+
+	if tenant.MaxObjects > 0 && objects > tenant.MaxObjects || tenant.MaxBytes > 0 && bytes > tenant.MaxBytes {
+		return nil, fmt.Errorf("%w: tenant %s would hold %d objects of %d bytes, beyond max_objects %d or max_bytes %d",
+			ErrQuotaExceeded, tenant.name, objects, bytes, tenant.MaxObjects, tenant.MaxBytes)
+	}
+
+	usage.objects, usage.bytes = objects, bytes
+	usage.sizes[objectKey] = int64(size)
+
+	computed := usage.computed
+	return func() {
+		usage.mu.Lock()
+		defer usage.mu.Unlock()
+
+		// a listing since counted what is stored already
+		if usage.computed != computed {
+			return
+		}
+		usage.bytes -= int64(size) - old
+		if known {
+			usage.sizes[objectKey] = old
+		} else {
+			usage.objects--
+			delete(usage.sizes, objectKey)
+		}
+	}, nil
+}
+
+// releaseQuota has the usage of the tenant of key listed again, after
+// deleting it.
+func (s3 S3) releaseQuota(key string) {
+	tenant := s3.tenantOf(key)
+	if tenant == nil || tenant.usage == nil {
+		return
+	}
+
+	tenant.usage.mu.Lock()
+	tenant.usage.computed = time.Time{}
+	tenant.usage.mu.Unlock()
+}
+
+// computeTenantUsage lists the objects of tenant. The caller holds the lock
+// of its usage.
+func (s3 S3) computeTenantUsage(ctx context.Context, tenant *Tenant) error {
+	ctx, cancel := context.WithCancel(withPriority(ctx, priorityMaintenance))
+	defer cancel()
+
+	var objects int
+	var bytes int64
+	sizes := make(map[string]int64)
+
+	prefix := path.Join(cleanPrefix(s3.Prefix), tenant.Prefix) + "/"
+	for object := range s3.listBucket(ctx, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return s3.explainError(object.Err)
+		}
+		objects++
+		bytes += object.Size
+		sizes[object.Key] = object.Size
+	}
+
+	tenant.usage.objects, tenant.usage.bytes = objects, bytes
+	tenant.usage.sizes = sizes
+	tenant.usage.computed = time.Now()
+	return nil
+}
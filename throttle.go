@@ -0,0 +1,222 @@
+package certmagic_s3
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// The request rate is multiplied by throttleBackoff on throttling, at
+	// most once per second, and by throttleRecovery every second without.
+	throttleBackoff  = 0.5
+	throttleRecovery = 1.1
+	throttleMinRate  = 1.0
+
+	// After a minute without throttling, requests are no longer limited.
+	throttleRecoveryTime = time.Minute
+
+	// Longer Retry-After values are cut to this.
+	throttleMaxRetryAfter = time.Minute
+)
+
+// throttle slows down every request to the endpoint once it responds with
+// 503 SlowDown or 429, like the adaptive retry mode of the AWS SDKs: the
+// request rate is cut on throttling and recovers while it stays away, and
+// no request is sent before a Retry-After has passed. It watches responses
+// as the transport of the client and limits requests as a limiter.
+type throttle struct {
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	rate      float64 // zero while not limited
+	tokens    float64
+	last      time.Time
+	throttled time.Time
+	until     time.Time
+
+	// the rate requests are sent at, measured over a second
+	window   time.Time
+	sent     int
+	sentRate float64
+}
+
+func newThrottle(logger *zap.Logger) *throttle {
+	return &throttle{logger: logger, window: time.Now()}
+}
+
+// refill adds the tokens accrued since the last call and lets the rate
+// recover. t.mu must be held.
+func (t *throttle) refill() {
+	now := time.Now()
+
+	if now.Sub(t.throttled) > throttleRecoveryTime {
+		t.rate = 0
+		return
+	}
+
+	elapsed := now.Sub(t.last).Seconds()
+	t.rate *= math.Pow(throttleRecovery, elapsed)
+	t.tokens += elapsed * t.rate
+	if t.tokens > t.rate {
+		t.tokens = t.rate
+	}
+	t.last = now
+}
+
+func (t *throttle) wait(ctx context.Context, operation string, p priority) (func(), error) {
+	t.mu.Lock()
+	for t.rate > 0 {
+		t.refill()
+		if t.rate == 0 {
+			break
+		}
+		if t.tokens >= 1 {
+			t.tokens--
+			break
+		}
+		delay := time.Duration(float64(time.Second) / t.rate)
+		t.mu.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		t.mu.Lock()
+	}
+	t.mu.Unlock()
+
+	return func() {}, nil
+}
+
+func (t *throttle) saturated() (bool, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.refill()
+
+	if wait := time.Until(t.until); wait > 0 {
+		return true, fmt.Sprintf("S3 asked to retry after %s", wait.Round(time.Second))
+	}
+	if t.rate > 0 {
+		return true, fmt.Sprintf("S3 is throttling, requests limited to %.1f/s", t.rate)
+	}
+	return false, ""
+}
+
+// send holds back a request until any Retry-After has passed and counts it.
+func (t *throttle) send(ctx context.Context) error {
+	t.mu.Lock()
+	wait := time.Until(t.until)
+	t.mu.Unlock()
+
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(t.window); elapsed >= time.Second {
+		t.sentRate = float64(t.sent) / elapsed.Seconds()
+		t.sent = 0
+		t.window = now
+	}
+	t.sent++
+
+	return nil
+}
+
+// slowDown cuts the request rate after a throttling response.
+func (t *throttle) slowDown(retryAfter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	if until := now.Add(retryAfter); until.After(t.until) {
+		t.until = until
+	}
+
+	if now.Sub(t.throttled) < time.Second {
+		return
+	}
+
+	if t.rate == 0 {
+		t.rate = math.Max(t.sentRate, float64(t.sent))
+		t.tokens = 0
+		t.last = now
+	} else {
+		t.refill()
+	}
+	t.rate = math.Max(t.rate*throttleBackoff, throttleMinRate)
+	t.throttled = now
+
+	t.logger.Warn("endpoint is throttling requests, slowing down", zap.Float64("per_second", t.rate))
+}
+
+// roundTripper wraps the transport of the client.
+func (t *throttle) roundTripper(next http.RoundTripper) http.RoundTripper {
+	return throttledTransport{next: next, throttle: t}
+}
+
+type throttledTransport struct {
+	next     http.RoundTripper
+	throttle *throttle
+}
+
+func (tt throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = conditional(req)
+
+	if err := tt.throttle.send(req.Context()); err != nil {
+		return nil, err
+	}
+
+	resp, err := tt.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests {
+		tt.throttle.slowDown(retryAfter(resp.Header))
+	}
+
+	return resp, nil
+}
+
+// retryAfter parses the Retry-After header, which is either a number of
+// seconds or a date.
+func retryAfter(header http.Header) time.Duration {
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	}
+
+	if wait < 0 {
+		return 0
+	}
+	if wait > throttleMaxRetryAfter {
+		return throttleMaxRetryAfter
+	}
+	return wait
+}
@@ -0,0 +1,75 @@
+package certmagic_s3
+
+import (
+	"context"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+const (
+	timeoutRead  = "read"
+	timeoutWrite = "write"
+	timeoutList  = "list"
+	timeoutLock  = "lock"
+)
+
+var defaultTimeouts = map[string]time.Duration{
+	timeoutRead:  30 * time.Second,
+	timeoutWrite: time.Minute,
+	timeoutList:  2 * time.Minute,
+	timeoutLock:  30 * time.Second,
+}
+
+// Timeouts are the deadlines of storage operations by type, applied when
+// the caller's context has none, so an endpoint that blackholes traffic
+// can't hang them. Read covers Load, Exists and Stat, Write covers Store
+// and Delete, Lock covers taking, renewing and releasing a lock, but not
+// waiting for another instance to release it.
+type Timeouts struct {
+	Read  caddy.Duration `json:"read,omitempty"`
+	Write caddy.Duration `json:"write,omitempty"`
+	List  caddy.Duration `json:"list,omitempty"`
+	Lock  caddy.Duration `json:"lock,omitempty"`
+}
+
+func (t *Timeouts) set(kind string, d caddy.Duration) {
+	switch kind {
+	case timeoutRead:
+		t.Read = d
+	case timeoutWrite:
+		t.Write = d
+	case timeoutList:
+		t.List = d
+	case timeoutLock:
+		t.Lock = d
+	}
+}
+
+func (s3 S3) timeout(kind string) time.Duration {
+	if s3.Timeouts != nil {
+		var d caddy.Duration
+		switch kind {
+		case timeoutRead:
+			d = s3.Timeouts.Read
+		case timeoutWrite:
+			d = s3.Timeouts.Write
+		case timeoutList:
+			d = s3.Timeouts.List
+		case timeoutLock:
+			d = s3.Timeouts.Lock
+		}
+		if d > 0 {
+			return time.Duration(d)
+		}
+	}
+	return defaultTimeouts[kind]
+}
+
+// withTimeout applies the timeout of kind to ctx, unless it has a deadline.
+func (s3 S3) withTimeout(ctx context.Context, kind string) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s3.timeout(kind))
+}
@@ -0,0 +1,68 @@
+package certmagic_s3
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+
+	"github.com/minio/minio-go/v7"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/ss098/certmagic-s3"
+
+// startSpan starts the span of a storage operation on key, as child of the
+// span in ctx and with its tracer provider, so the operation shows up in the
+// trace of what caused it. Without a span in ctx, nothing is traced.
+func (s3 S3) startSpan(ctx context.Context, operation, key string) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.SpanContext().IsValid() {
+		return ctx, parent
+	}
+
+	return parent.TracerProvider().Tracer(tracerName).Start(ctx, "s3 "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("s3.operation", operation),
+			attribute.String("s3.bucket", s3.Bucket),
+			attribute.String("s3.key_class", keyClass(key)),
+		),
+	)
+}
+
+// endSpan ends span with the result of the operation. Missing keys are
+// no error, certmagic checks for them all the time.
+func endSpan(span trace.Span, err error) {
+	if errors.Is(err, fs.ErrNotExist) {
+		span.SetAttributes(attribute.Bool("s3.not_found", true))
+		err = nil
+	}
+	if err != nil && span.IsRecording() {
+		resp := minio.ToErrorResponse(err)
+		if resp.Code != "" {
+			span.SetAttributes(attribute.String("s3.error_code", resp.Code))
+		}
+		if resp.StatusCode != 0 {
+			span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceRetry records a retry of the request of operation on the span in
+// ctx.
+func traceRetry(ctx context.Context, operation string, attempt int, err error) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	span.AddEvent("retry", trace.WithAttributes(
+		attribute.String("s3.request", operation),
+		attribute.Int("s3.attempt", attempt),
+		attribute.String("error", err.Error()),
+	))
+}
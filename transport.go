@@ -0,0 +1,194 @@
+package certmagic_s3
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// The dialer settings of minio.DefaultTransport, kept when only one of
+// them is configured.
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// customTLS reports whether any option changes how the endpoint's TLS
+// connection is set up.
+func (s3 S3) customTLS() bool {
+	return s3.CAFile != "" || s3.CAPEM != "" || s3.TLSMinVersion != "" || s3.TLSServerName != "" ||
+		s3.ClientCertFile != "" || s3.ClientKeyFile != ""
+}
+
+// Transport tunes the connections to the endpoint. Unset fields keep the
+// defaults of minio.
+type Transport struct {
+	DialTimeout           caddy.Duration `json:"dial_timeout,omitempty"`
+	KeepAlive             caddy.Duration `json:"keep_alive,omitempty"`
+	TLSHandshakeTimeout   caddy.Duration `json:"tls_handshake_timeout,omitempty"`
+	ResponseHeaderTimeout caddy.Duration `json:"response_header_timeout,omitempty"`
+	IdleConnTimeout       caddy.Duration `json:"idle_conn_timeout,omitempty"`
+	MaxIdleConns          int            `json:"max_idle_conns,omitempty"`
+	MaxIdleConnsPerHost   int            `json:"max_idle_conns_per_host,omitempty"`
+}
+
+func (t Transport) apply(transport *http.Transport) {
+	if t.DialTimeout > 0 || t.KeepAlive != 0 {
+		dialer := &net.Dialer{
+			Timeout:   defaultDialTimeout,
+			KeepAlive: defaultKeepAlive,
+		}
+		if t.DialTimeout > 0 {
+			dialer.Timeout = time.Duration(t.DialTimeout)
+		}
+		if t.KeepAlive != 0 {
+			// negative disables keep-alive probes
+			dialer.KeepAlive = time.Duration(t.KeepAlive)
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	if t.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(t.TLSHandshakeTimeout)
+	}
+	if t.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = time.Duration(t.ResponseHeaderTimeout)
+	}
+	if t.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(t.IdleConnTimeout)
+	}
+	if t.MaxIdleConns > 0 {
+		transport.MaxIdleConns = t.MaxIdleConns
+	}
+	if t.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = t.MaxIdleConnsPerHost
+	}
+}
+
+// newTransport builds the transport for the minio client from the TLS,
+// proxy and transport options. It returns nil to use minio's default
+// transport.
+func (s3 S3) newTransport() (*http.Transport, error) {
+	transport, err := minio.DefaultTransport(!s3.Insecure)
+	if err != nil {
+		return nil, err
+	}
+
+	if s3.Transport != nil {
+		s3.Transport.apply(transport)
+	}
+
+	if s3.customTLS() {
+		if s3.Insecure {
+			return nil, errors.New("ca_file, ca_pem, tls_min_version, tls_server_name and client certificates require a secure connection, unset insecure")
+		}
+		if err := s3.configureTLS(transport); err != nil {
+			return nil, err
+		}
+	}
+
+	if s3.ProxyURL != "" {
+		proxy, err := url.Parse(s3.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_url: %v", err)
+		}
+
+		// like the environment, but with the configured proxy
+		config := httpproxy.FromEnvironment()
+		config.HTTPProxy = proxy.String()
+		config.HTTPSProxy = proxy.String()
+		proxyFunc := config.ProxyFunc()
+
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+
+	return transport, nil
+}
+
+// proxyFor returns the proxy requests to host go through, if any.
+func (s3 S3) proxyFor(host string) (*url.URL, error) {
+	scheme := "https"
+	if s3.Insecure {
+		scheme = "http"
+	}
+
+	req, err := http.NewRequest(http.MethodGet, scheme+"://"+host, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.httpTransport.Proxy(req)
+}
+
+func (s3 S3) configureTLS(transport *http.Transport) error {
+	config := transport.TLSClientConfig.Clone()
+	config.ServerName = s3.TLSServerName
+
+	if s3.TLSMinVersion != "" {
+		version, ok := tlsVersions[s3.TLSMinVersion]
+		if !ok {
+			return fmt.Errorf("invalid tls_min_version %q: must be one of 1.0, 1.1, 1.2, 1.3", s3.TLSMinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if s3.CAFile != "" || s3.CAPEM != "" {
+		pool := config.RootCAs
+		if pool == nil {
+			var err error
+			pool, err = x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+		}
+
+		if s3.CAFile != "" {
+			pem, err := ioutil.ReadFile(s3.CAFile)
+			if err != nil {
+				return fmt.Errorf("reading ca_file: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("ca_file %s contains no certificates", s3.CAFile)
+			}
+		}
+		if s3.CAPEM != "" && !pool.AppendCertsFromPEM([]byte(s3.CAPEM)) {
+			return errors.New("ca_pem contains no certificates")
+		}
+
+		config.RootCAs = pool
+	}
+
+	if s3.ClientCertFile != "" || s3.ClientKeyFile != "" {
+		if s3.ClientCertFile == "" || s3.ClientKeyFile == "" {
+			return errors.New("client_cert_file and client_key_file must be given together")
+		}
+
+		cert, err := tls.LoadX509KeyPair(s3.ClientCertFile, s3.ClientKeyFile)
+		if err != nil {
+			return fmt.Errorf("loading client certificate %s with key %s: %v", s3.ClientCertFile, s3.ClientKeyFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	transport.TLSClientConfig = config
+
+	return nil
+}
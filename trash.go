@@ -0,0 +1,70 @@
+package certmagic_s3
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+)
+
+// defaultTrashRetention is how long deleted keys stay in the trash with
+// soft_delete, unless the retention of the trash class says otherwise.
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// softDeletes reports whether deleting key moves it to the trash. Keys in
+// the trash already, and the module's own, are deleted for good.
+func (s3 S3) softDeletes(key string) bool {
+	return s3.SoftDelete && !strings.HasPrefix(key, trashPrefix) && !isInternalKey(key)
+}
+
+// provisionSoftDelete has the trash purged after defaultTrashRetention,
+// unless its retention is set.
+func (s3 *S3) provisionSoftDelete() {
+	if s3.retentionFor(ClassTrash) > 0 {
+		return
+	}
+	if s3.Retention == nil {
+		s3.Retention = make(map[string]caddy.Duration)
+	}
+	s3.Retention[ClassTrash] = caddy.Duration(defaultTrashRetention)
+}
+
+// trashKey is where key goes when deleted at t: below a directory of the
+// trash named after the time, so what one Delete removed stays together.
+func trashKey(key string, t time.Time) string {
+	return trashPrefix + t.UTC().Format("20060102T150405.000Z") + "/" + key
+}
+
+// moveToTrash moves the object objectKey of key to the trash, with a
+// server-side copy and a delete. Missing objects are fine, as for deletes.
+func (s3 S3) moveToTrash(ctx context.Context, key, objectKey string, t time.Time) error {
+	err := s3.copyAndRemove(ctx, objectKey, s3.KeyPrefix(trashKey(key, t)))
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// trashObjects moves every object below prefix that match reports true
+// for, if it isn't nil, to the trash, and calls moved for each.
+func (s3 S3) trashObjects(ctx context.Context, prefix string, match func(objectKey string) bool, t time.Time, moved func(objectKey string)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for object := range s3.listBucket(ctx, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		if match != nil && !match(object.Key) {
+			continue
+		}
+
+		if err := s3.moveToTrash(ctx, s3.CutKeyPrefix(object.Key), object.Key, t); err != nil {
+			return err
+		}
+		moved(object.Key)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package certmagic_s3
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/minio/minio-go/v7"
+)
+
+// usageTTL is how long a usage report is served before the bucket is
+// listed again.
+const usageTTL = 5 * time.Minute
+
+// Usage is how many objects the storage holds, and how many bytes they
+// take, by key class and by tenant.
+type Usage struct {
+	Objects  int64                 `json:"objects"`
+	Bytes    int64                 `json:"bytes"`
+	Classes  map[string]ClassUsage `json:"classes,omitempty"`
+	Tenants  map[string]ClassUsage `json:"tenants,omitempty"`
+	Computed time.Time             `json:"computed"`
+}
+
+// ClassUsage is the usage of a single key class.
+type ClassUsage struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+type usageCache struct {
+	mu    sync.Mutex
+	usage Usage
+}
+
+// Usage lists every object under the prefix and sums them up by key class.
+// The result is kept for five minutes; refresh lists the bucket again
+// regardless.
+func (s3 S3) Usage(ctx context.Context, refresh bool) (Usage, error) {
+	if s3.usage != nil {
+		s3.usage.mu.Lock()
+		defer s3.usage.mu.Unlock()
+
+		if !refresh && time.Since(s3.usage.usage.Computed) < usageTTL {
+			return s3.usage.usage, nil
+		}
+	}
+
+	usage, err := s3.computeUsage(ctx)
+	if err != nil {
+		return usage, err
+	}
+
+	if s3.usage != nil {
+		s3.usage.usage = usage
+	}
+	return usage, nil
+}
+
+func (s3 S3) computeUsage(ctx context.Context) (Usage, error) {
+	if err := s3.ready(); err != nil {
+		return Usage{}, err
+	}
+	ctx = withPriority(ctx, priorityMaintenance)
+
+	usage := Usage{Classes: make(map[string]ClassUsage)}
+	if len(s3.Tenants) > 0 {
+		usage.Tenants = make(map[string]ClassUsage)
+	}
+
+	prefix := s3.listPrefix("")
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for object := range s3.listBucket(ctx, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return Usage{}, s3.explainError(object.Err)
+		}
+
+		key := s3.CutKeyPrefix(object.Key)
+		class := keyClass(key)
+
+		classUsage := usage.Classes[class]
+		classUsage.Objects++
+		classUsage.Bytes += object.Size
+		usage.Classes[class] = classUsage
+
+		if tenant := s3.tenantOf(key); tenant != nil {
+			tenantUsage := usage.Tenants[tenant.name]
+			tenantUsage.Objects++
+			tenantUsage.Bytes += object.Size
+			usage.Tenants[tenant.name] = tenantUsage
+		}
+
+		usage.Objects++
+		usage.Bytes += object.Size
+	}
+
+	usage.Computed = time.Now()
+
+	return usage, nil
+}
+
+// handleUsage serves the usage of the storage at /s3-storage/usage, listed
+// again with refresh=true.
+func (a *ReconcileAPI) handleUsage(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+
+	s3, ok := a.ctx.Storage().(S3)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("storage is not s3"),
+		}
+	}
+
+	usage, err := s3.Usage(r.Context(), r.URL.Query().Get("refresh") == "true")
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,309 @@
+package certmagic_s3
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// maxRetryAttempts bounds retry max_attempts, as every attempt may wait up
+// to the longest backoff.
+const maxRetryAttempts = 20
+
+// Validate checks the config for problems that don't need the bucket to
+// show: conflicting credential sources, malformed endpoints and prefixes,
+// and out of range timeouts and retries. All problems are reported at
+// once.
+func (s3 S3) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// credentials
+	var sources []string
+	if s3.AccessID != "" || s3.SecretKey != "" {
+		sources = append(sources, "access_id/secret_key")
+	}
+	if s3.AccessIDFile != "" || s3.SecretKeyFile != "" {
+		sources = append(sources, "access_id_file/secret_key_file")
+	}
+	if s3.UseIamProvider {
+		sources = append(sources, "use_iam_provider")
+	}
+	if s3.Vault != nil {
+		sources = append(sources, "vault")
+	}
+	if len(sources) > 1 {
+		problem("credentials are given by %s: use only one", strings.Join(sources, " and "))
+	}
+	if (s3.AccessID == "") != (s3.SecretKey == "") {
+		problem("access_id and secret_key must be given together")
+	}
+	if (s3.AccessIDFile == "") != (s3.SecretKeyFile == "") {
+		problem("access_id_file and secret_key_file must be given together")
+	}
+	if s3.SessionToken != "" && s3.AccessID == "" {
+		problem("session_token requires access_id and secret_key")
+	}
+	if s3.ExternalID != "" && s3.RoleARN == "" {
+		problem("external_id requires role_arn")
+	}
+	if s3.RoleARN != "" && !strings.HasPrefix(s3.RoleARN, "arn:") {
+		problem("invalid role_arn %q: must be an ARN like arn:aws:iam::123456789012:role/caddy", s3.RoleARN)
+	}
+
+	// endpoints
+	validateHost := func(option, host string) {
+		if host != "" && !validHost(host) {
+			problem("invalid %s %q: must be a host with an optional port, without scheme or path", option, host)
+		}
+	}
+	validateURL := func(option, value string) {
+		if value != "" && !validURL(value) {
+			problem("invalid %s %q: must be an http or https URL", option, value)
+		}
+	}
+	validateHost("host", s3.Host)
+	validateURL("proxy_url", s3.ProxyURL)
+	validateURL("sts_endpoint", s3.STSEndpoint)
+	for _, hook := range s3.Hooks {
+		if !validURL(hook.URL) {
+			problem("invalid hook url %q: must be an http or https URL", hook.URL)
+		}
+		for _, event := range hook.Events {
+			if !validHookEvent(event) {
+				problem("invalid hook event %q: must be one of %s", event, strings.Join(hookEvents, ", "))
+			}
+		}
+	}
+	if s3.Audit != nil {
+		validateURL("audit webhook", s3.Audit.Webhook)
+		if reason := prefixProblem(s3.Audit.Prefix); reason != "" {
+			problem("invalid audit prefix %q: %s", s3.Audit.Prefix, reason)
+		}
+	}
+	if s3.Mirror != nil {
+		validateHost("mirror host", s3.Mirror.Host)
+		if reason := prefixProblem(s3.Mirror.Prefix); reason != "" {
+			problem("invalid mirror prefix %q: %s", s3.Mirror.Prefix, reason)
+		}
+	}
+	if s3.Discovery != nil {
+		if (s3.Discovery.SRV == "") == (s3.Discovery.URL == "") {
+			problem("discovery requires exactly one of srv and url")
+		}
+		validateURL("discovery url", s3.Discovery.URL)
+		if s3.Failover != nil {
+			problem("failover can't be combined with discovery")
+		}
+	}
+	if s3.Failover != nil {
+		for _, endpoint := range s3.Failover.Endpoints {
+			validateHost("failover endpoint", endpoint.Host)
+		}
+	}
+	if s3.DualStack || s3.FIPS {
+		option := s3.awsEndpointOption()
+		switch {
+		case s3.Region == "":
+			problem("%s requires region", option)
+		case s3.Host != "" && s3.Host != awsEndpoint(s3.Region, s3.DualStack, s3.FIPS):
+			problem("%s builds the host from region, unset host %q", option, s3.Host)
+		}
+		if s3.FIPS && s3.Region != "" && !validFIPSRegion(s3.Region) {
+			problem("invalid region %q for fips: must be one of %s", s3.Region, strings.Join(fipsRegions, ", "))
+		}
+		if s3.FIPS && s3.Accelerate {
+			problem("accelerate can't be combined with fips")
+		}
+		if s3.Discovery != nil || s3.Failover != nil {
+			problem("%s can't be combined with discovery or failover", option)
+		}
+	}
+	if s3.Accelerate {
+		if strings.Contains(s3.Bucket, ".") {
+			problem("accelerate requires a bucket name without dots, unlike %q", s3.Bucket)
+		}
+		if s3.Host != "" && !strings.HasSuffix(strings.Split(s3.Host, ":")[0], ".amazonaws.com") {
+			problem("accelerate requires an AWS S3 host, not %q", s3.Host)
+		}
+		if s3.Discovery != nil {
+			problem("accelerate can't be combined with discovery")
+		}
+	}
+	if s3.SSECustomerKey != "" && s3.Insecure {
+		problem("sse_customer_key requires a secure connection, unset insecure")
+	}
+
+	if reason := prefixProblem(s3.Prefix); reason != "" {
+		problem("invalid prefix %q: %s", s3.Prefix, reason)
+	}
+	if !validKeyEncoding(s3.KeyEncoding) {
+		problem("invalid key_encoding %q: must be one of percent, base32", s3.KeyEncoding)
+	}
+	if !validLayout(s3.Layout) {
+		problem("invalid layout %q: must be one of hierarchical, flat, sharded", s3.Layout)
+	}
+	if !validListAPI(s3.ListAPI) {
+		problem("invalid list_api %q: must be one of v1, v2, auto", s3.ListAPI)
+	}
+	if !validLockStrategy(s3.LockStrategy) {
+		problem("invalid lock_strategy %q: must be one of conditional, candidates, auto", s3.LockStrategy)
+	}
+	problems = append(problems, s3.validateTenants()...)
+
+	// timeouts and retries
+	if s3.Retry != nil {
+		if s3.Retry.MaxAttempts < 0 || s3.Retry.MaxAttempts > maxRetryAttempts {
+			problem("invalid retry max_attempts %d: must be between 0 and %d", s3.Retry.MaxAttempts, maxRetryAttempts)
+		}
+		if s3.Retry.Base < 0 || s3.Retry.Max < 0 {
+			problem("retry base and max can't be negative")
+		}
+		if s3.Retry.Max > 0 && s3.Retry.Base > s3.Retry.Max {
+			problem("retry base %v exceeds max %v", time.Duration(s3.Retry.Base), time.Duration(s3.Retry.Max))
+		}
+		if !validJitter(s3.Retry.Jitter) {
+			problem("invalid retry jitter %q: must be one of full, equal, none", s3.Retry.Jitter)
+		}
+	}
+	if s3.Timeouts != nil {
+		durations := map[string]caddy.Duration{
+			timeoutRead:  s3.Timeouts.Read,
+			timeoutWrite: s3.Timeouts.Write,
+			timeoutList:  s3.Timeouts.List,
+			timeoutLock:  s3.Timeouts.Lock,
+		}
+		for _, kind := range []string{timeoutRead, timeoutWrite, timeoutList, timeoutLock} {
+			if durations[kind] < 0 {
+				problem("invalid %s timeout %v: can't be negative", kind, time.Duration(durations[kind]))
+			}
+		}
+	}
+	if s3.BucketWait < 0 {
+		problem("invalid bucket_wait %v: can't be negative", time.Duration(s3.BucketWait))
+	}
+	if s3.MaxConcurrent < 0 {
+		problem("invalid max_concurrent_requests %d: can't be negative", s3.MaxConcurrent)
+	}
+
+	// options taking one of a set of values
+	if !validLogKeys(s3.LogKeys) {
+		problem("invalid log_keys %q: must be one of full, hash, truncate", s3.LogKeys)
+	}
+	for class, action := range s3.OnChecksumMismatch {
+		if !validMismatchClass(class) {
+			problem("invalid on_checksum_mismatch key class %q: must be one of %s, default", class, strings.Join(keyClasses, ", "))
+		}
+		if !validMismatchAction(action) {
+			problem("invalid on_checksum_mismatch action %q for %s: must be one of error, warn, mirror", action, class)
+		}
+		if action == mismatchMirror && s3.Mirror == nil {
+			problem("on_checksum_mismatch mirror for %s requires mirror", class)
+		}
+	}
+	for class := range s3.Retention {
+		if !validKeyClass(class) {
+			problem("invalid retention key class %q: must be one of %s", class, strings.Join(keyClasses, ", "))
+		}
+	}
+	for operation, name := range s3.Priorities {
+		if !validPriority(name) {
+			problem("invalid priority %q for %s: must be one of critical, issuance, maintenance", name, operation)
+		}
+	}
+	if !validMetricsBackend(s3.MetricsBackend) {
+		problem("invalid metrics_backend %q: must be one of prometheus, statsd, otlp", s3.MetricsBackend)
+	}
+	if s3.Preset != "" {
+		if _, ok := presets[s3.Preset]; !ok {
+			problem("invalid preset %q: must be one of %s", s3.Preset, presetNames())
+		}
+	}
+	if s3.Provider != "" {
+		if _, ok := providers[s3.Provider]; !ok {
+			problem("invalid provider %q: must be one of %s", s3.Provider, providerNames())
+		}
+	}
+	if s3.Provider == providerB2 {
+		if s3.Host == "" && s3.Discovery == nil {
+			problem("provider b2 requires region or host")
+		}
+		if s3.Accelerate || s3.DualStack || s3.FIPS {
+			problem("provider b2 can't be combined with accelerate, dual_stack or fips")
+		}
+		if s3.StorageClass != "" || len(s3.StorageClasses) > 0 {
+			problem("provider b2 has no storage classes, unset storage_class")
+		}
+		if s3.Lifecycle != nil {
+			problem("provider b2 takes lifecycle rules through its own API only, unset lifecycle")
+		}
+	}
+	if s3.Provider == providerGCS {
+		if s3.Tagging != nil || s3.ObjectLock != nil || s3.Lifecycle != nil {
+			problem("provider gcs has no object tags, Object Lock or S3 lifecycle rules, unset tagging, object_lock and lifecycle")
+		}
+		if s3.Accelerate || s3.DualStack || s3.FIPS {
+			problem("provider gcs can't be combined with accelerate, dual_stack or fips")
+		}
+	}
+	if err := validateStorageClasses(s3.storageClassNames(), s3.StorageClass, s3.StorageClasses); err != nil {
+		problem("%v", err)
+	}
+	if s3.ObjectLock != nil {
+		if err := s3.ObjectLock.validate(); err != nil {
+			problem("%v", err)
+		}
+	}
+	if s3.Lifecycle != nil {
+		if err := s3.Lifecycle.validate(); err != nil {
+			problem("%v", err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid s3-storage config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validHost reports whether host is a host name or IP address with an
+// optional port, as minio takes endpoints.
+func validHost(host string) bool {
+	u, err := url.Parse("//" + host)
+	if err != nil {
+		return false
+	}
+	return u.Host == host && u.Hostname() != ""
+}
+
+func validURL(value string) bool {
+	u, err := url.Parse(value)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// prefixProblem tells what's wrong with prefix, if anything. Leading and
+// trailing slashes are fine, but the prefix must be clean otherwise, as
+// object keys are joined to it.
+func prefixProblem(prefix string) string {
+	trimmed := strings.Trim(prefix, "/")
+	if trimmed == "" {
+		return ""
+	}
+	for _, segment := range strings.Split(trimmed, "/") {
+		switch segment {
+		case "":
+			return "must not contain empty path segments"
+		case ".", "..":
+			return "must not contain . or .. path segments"
+		}
+	}
+	return ""
+}
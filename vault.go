@@ -0,0 +1,203 @@
+package certmagic_s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	vaultAuthToken      = "token"
+	vaultAuthAppRole    = "approle"
+	vaultAuthKubernetes = "kubernetes"
+
+	defaultVaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// Secrets without a lease are fetched again after this long.
+	defaultVaultLease = time.Hour
+)
+
+// Vault fetches dynamic S3 credentials from a secrets engine of HashiCorp
+// Vault, such as the AWS one ("aws/creds/<role>" or "aws/sts/<role>").
+// The secret must have access_key and secret_key, and may have
+// security_token. New credentials are fetched as the lease runs out.
+type Vault struct {
+	Address    string `json:"address,omitempty"`
+	SecretPath string `json:"secret_path,omitempty"`
+
+	// Auth is one of token (the default), approle and kubernetes.
+	Auth      string `json:"auth,omitempty"`
+	AuthMount string `json:"auth_mount,omitempty"`
+	Token     string `json:"token,omitempty"`
+	RoleID    string `json:"role_id,omitempty"`
+	SecretID  string `json:"secret_id,omitempty"`
+	Role      string `json:"role,omitempty"`
+	TokenFile string `json:"token_file,omitempty"`
+}
+
+func (v *Vault) provision() error {
+	if v.Address == "" {
+		v.Address = os.Getenv("VAULT_ADDR")
+	}
+	if v.Token == "" {
+		v.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if v.Auth == "" {
+		v.Auth = vaultAuthToken
+	}
+	if v.AuthMount == "" {
+		v.AuthMount = v.Auth
+	}
+	if v.TokenFile == "" {
+		v.TokenFile = defaultVaultKubernetesTokenFile
+	}
+
+	if v.Address == "" {
+		return errors.New("vault requires address or VAULT_ADDR")
+	}
+	if v.SecretPath == "" {
+		return errors.New("vault requires secret_path")
+	}
+
+	switch v.Auth {
+	case vaultAuthToken:
+		if v.Token == "" {
+			return errors.New("vault token auth requires token or VAULT_TOKEN")
+		}
+	case vaultAuthAppRole:
+		if v.RoleID == "" {
+			return errors.New("vault approle auth requires role_id")
+		}
+	case vaultAuthKubernetes:
+		if v.Role == "" {
+			return errors.New("vault kubernetes auth requires role")
+		}
+	default:
+		return fmt.Errorf("vault auth must be one of token, approle, kubernetes, not %s", v.Auth)
+	}
+
+	return nil
+}
+
+// vaultCredentials retrieves the secret at the configured path, logging in
+// first unless a token is given.
+type vaultCredentials struct {
+	credentials.Expiry
+
+	client *http.Client
+	vault  Vault
+}
+
+func (v *vaultCredentials) Retrieve() (credentials.Value, error) {
+	token, err := v.login()
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("logging in to vault: %v", err)
+	}
+
+	var secret struct {
+		LeaseDuration int `json:"lease_duration"`
+		Data          struct {
+			AccessKey     string `json:"access_key"`
+			SecretKey     string `json:"secret_key"`
+			SecurityToken string `json:"security_token"`
+		} `json:"data"`
+	}
+	if err := v.request(http.MethodGet, v.vault.SecretPath, token, nil, &secret); err != nil {
+		return credentials.Value{}, fmt.Errorf("reading %s from vault: %v", v.vault.SecretPath, err)
+	}
+	if secret.Data.AccessKey == "" || secret.Data.SecretKey == "" {
+		return credentials.Value{}, fmt.Errorf("reading %s from vault: secret has no access_key and secret_key", v.vault.SecretPath)
+	}
+
+	lease := time.Duration(secret.LeaseDuration) * time.Second
+	if lease <= 0 {
+		lease = defaultVaultLease
+	}
+	v.SetExpiration(time.Now().Add(lease), credentials.DefaultExpiryWindow)
+
+	return credentials.Value{
+		AccessKeyID:     secret.Data.AccessKey,
+		SecretAccessKey: secret.Data.SecretKey,
+		SessionToken:    secret.Data.SecurityToken,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+func (v *vaultCredentials) login() (string, error) {
+	var body map[string]string
+
+	switch v.vault.Auth {
+	case vaultAuthToken:
+		return v.vault.Token, nil
+	case vaultAuthAppRole:
+		body = map[string]string{"role_id": v.vault.RoleID, "secret_id": v.vault.SecretID}
+	case vaultAuthKubernetes:
+		jwt, err := ioutil.ReadFile(v.vault.TokenFile)
+		if err != nil {
+			return "", err
+		}
+		body = map[string]string{"role": v.vault.Role, "jwt": strings.TrimSpace(string(jwt))}
+	}
+
+	var result struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := v.request(http.MethodPost, "auth/"+v.vault.AuthMount+"/login", "", body, &result); err != nil {
+		return "", err
+	}
+
+	return result.Auth.ClientToken, nil
+}
+
+func (v *vaultCredentials) request(method, path, token string, body interface{}, result interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(v.vault.Address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCredentialsResponse))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		if err := json.Unmarshal(respBody, &errResp); err != nil || len(errResp.Errors) == 0 {
+			return errors.New(resp.Status)
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.Join(errResp.Errors, "; "))
+	}
+
+	return json.Unmarshal(respBody, result)
+}
@@ -0,0 +1,209 @@
+package certmagic_s3
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/minio/minio-go/v7"
+)
+
+// ErrNotVersioned is returned for versions of keys in buckets that never
+// had versioning enabled.
+var ErrNotVersioned = errors.New("bucket versioning is not enabled")
+
+// Version is a version of the object of a key in a versioned bucket.
+// Deleted is set for the delete markers left by deleting the key.
+type Version struct {
+	VersionID string    `json:"version_id"`
+	Modified  time.Time `json:"modified"`
+	Size      int64     `json:"size"`
+	Latest    bool      `json:"latest"`
+	Deleted   bool      `json:"deleted"`
+}
+
+// Versions lists the versions of key, the latest first.
+func (s3 S3) Versions(ctx context.Context, key string) ([]Version, error) {
+	if err := s3.checkKey(key); err != nil {
+		return nil, err
+	}
+	if err := s3.checkVersioning(ctx); err != nil {
+		return nil, err
+	}
+
+	objectKey := s3.KeyPrefix(key)
+
+	var versions []Version
+	for object := range s3.listBucket(ctx, minio.ListObjectsOptions{Prefix: objectKey, WithVersions: true}) {
+		if object.Err != nil {
+			return nil, s3.storageError("versions", key, object.Err)
+		}
+		if object.Key != objectKey {
+			continue
+		}
+		versions = append(versions, Version{
+			VersionID: object.VersionID,
+			Modified:  object.LastModified,
+			Size:      object.Size,
+			Latest:    object.IsLatest,
+			Deleted:   object.IsDeleteMarker,
+		})
+	}
+
+	if len(versions) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return versions, nil
+}
+
+// RestoreVersion stores the value key had in the version versionID again,
+// as its latest version, e.g. after it was overwritten with a corrupted
+// value or deleted. Being a store, it goes to the mirror, the audit log
+// and hooks like any other. Restoring a delete marker isn't possible.
+func (s3 S3) RestoreVersion(ctx context.Context, key, versionID string) error {
+	if err := s3.checkKey(key); err != nil {
+		return err
+	}
+	if err := s3.checkVersioning(ctx); err != nil {
+		return err
+	}
+
+	value, err := s3.loadVersion(ctx, key, versionID)
+	if err != nil {
+		return err
+	}
+
+	// the version replaces whatever was read last
+	s3.etags.remove(key)
+
+	return s3.Store(ctx, key, value)
+}
+
+// loadVersion reads the version versionID of key, verified and decrypted
+// like Load does.
+func (s3 S3) loadVersion(ctx context.Context, key, versionID string) ([]byte, error) {
+	objectKey := s3.KeyPrefix(key)
+
+	opts := s3.getObjectOptions()
+	opts.VersionID = versionID
+
+	var value []byte
+	var info minio.ObjectInfo
+
+	err := s3.do(ctx, "load", func() error {
+		object, err := s3.client().GetObject(ctx, s3.Bucket, objectKey, opts)
+		if err != nil {
+			return err
+		}
+		defer object.Close()
+
+		info, err = object.Stat()
+		if err != nil {
+			return err
+		}
+
+		value, err = ioutil.ReadAll(object)
+		return err
+	})
+	if err != nil {
+		return nil, s3.storageError("load", key, err)
+	}
+	if info.IsDeleteMarker {
+		return nil, fmt.Errorf("version %s of %s is a delete marker", versionID, s3.logKey(key))
+	}
+
+	if err := s3.verifyChecksum(s3.logKey(objectKey), value, info); err != nil {
+		return nil, err
+	}
+	if isAgeEncrypted(value) {
+		if s3.encryptor == nil {
+			return nil, fmt.Errorf("%s is age encrypted, but no encryption is configured", s3.logKey(objectKey))
+		}
+		return s3.encryptor.decrypt(value)
+	}
+
+	return value, nil
+}
+
+// checkVersioning fails with ErrNotVersioned unless the bucket has or had
+// versioning enabled.
+func (s3 S3) checkVersioning(ctx context.Context) error {
+	if err := s3.ready(); err != nil {
+		return err
+	}
+	if s3.Capabilities().Versioning {
+		return nil
+	}
+
+	var config minio.BucketVersioningConfiguration
+	err := s3.do(ctx, "versioning", func() error {
+		var err error
+		config, err = s3.client().GetBucketVersioning(ctx, s3.Bucket)
+		return err
+	})
+	if err != nil {
+		return s3.explainError(err)
+	}
+	if config.Status == "" {
+		return fmt.Errorf("%w on bucket %s", ErrNotVersioned, s3.Bucket)
+	}
+	return nil
+}
+
+func restoreFlags(fs *flag.FlagSet) {
+	fs.String("key", "", "Key to restore")
+	fs.String("version", "", "Version ID to restore, the versions are listed without it")
+	configFlags(fs)
+}
+
+func cmdRestore(fl caddycmd.Flags) (int, error) {
+	key := fl.String("key")
+	if key == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("--key is required")
+	}
+
+	storage, err := loadStorageConfig(fl)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	s3, err := provisionStorage(ctx, storage)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	versionID := fl.String("version")
+	if versionID == "" {
+		versions, err := s3.Versions(ctx, key)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		for _, version := range versions {
+			var notes string
+			if version.Latest {
+				notes += " latest"
+			}
+			if version.Deleted {
+				notes += " deleted"
+			}
+			fmt.Printf("%s  %s  %8d%s\n", version.VersionID, version.Modified.Format(time.RFC3339), version.Size, notes)
+		}
+		return caddy.ExitCodeSuccess, nil
+	}
+
+	if err := s3.RestoreVersion(ctx, key, versionID); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Printf("restored version %s of %s\n", versionID, key)
+
+	return caddy.ExitCodeSuccess, nil
+}
@@ -0,0 +1,72 @@
+package certmagic_s3
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// tracedHeaders are the headers whose values are scrubbed from traces, as
+// they carry credentials or keys.
+var tracedHeaders = []string{
+	"Authorization",
+	"X-Amz-Security-Token",
+	"X-Amz-Server-Side-Encryption-Customer-Key",
+	"X-Amz-Server-Side-Encryption-Customer-Key-Md5",
+	"X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key",
+	"X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key-Md5",
+}
+
+// tracedQuery matches the credentials of presigned URLs.
+var tracedQuery = regexp.MustCompile(`(?i)(X-Amz-(?:Credential|Signature|Security-Token)=)[^&\s]+`)
+
+// tracingTransport logs every HTTP exchange with S3 at debug level, like
+// minio's TraceOn, but as a single entry, so exchanges of concurrent
+// requests don't interleave. Bodies are left out, but for those of error
+// responses, which tell what the provider didn't like.
+type tracingTransport struct {
+	next   http.RoundTripper
+	logger *zap.Logger
+}
+
+func (tt tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	dump, _ := httputil.DumpRequestOut(req, false)
+	trace := string(dump)
+
+	resp, err := tt.next.RoundTrip(req)
+	if err != nil {
+		tt.logger.Debug("http exchange", zap.String("request", scrubTrace(trace)), zap.Error(err))
+		return nil, err
+	}
+
+	success := resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNoContent
+	dump, _ = httputil.DumpResponse(resp, !success)
+
+	tt.logger.Debug("http exchange",
+		zap.String("request", scrubTrace(trace)),
+		zap.String("response", scrubTrace(string(dump))))
+
+	return resp, nil
+}
+
+// scrubTrace replaces credentials in a dumped request or response.
+func scrubTrace(dump string) string {
+	lines := strings.Split(dump, "\r\n")
+	for i, line := range lines {
+		if i == 0 {
+			lines[i] = tracedQuery.ReplaceAllString(line, "${1}"+redacted)
+			continue
+		}
+		name := strings.SplitN(line, ":", 2)[0]
+		for _, header := range tracedHeaders {
+			if strings.EqualFold(name, header) {
+				lines[i] = name + ": " + redacted
+				break
+			}
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}